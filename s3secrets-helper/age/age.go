@@ -0,0 +1,173 @@
+// Package age decrypts secrets encrypted with age, or with sops using age
+// keys, by running the age and sops commands, which must be installed.
+package age
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// Decryptor decrypts age and sops encrypted secrets with an age identity.
+type Decryptor struct {
+	// IdentityPath is the path of a file of age identities (private keys),
+	// as made by age-keygen.
+	IdentityPath string
+
+	// Identity, if set, is used instead of IdentityPath, e.g. identities got
+	// from SSM Parameter Store. It's never written to disk, nor put in the
+	// environment: age and sops read it from a pipe.
+	Identity []byte
+}
+
+// identityFD is the file descriptor age and sops read Identity from.
+const identityFD = 3
+
+// passedEnv are the only variables of this process's environment passed to
+// age and sops.
+var passedEnv = []string{"PATH", "HOME", "TMPDIR"}
+
+// format is how a secret is encrypted.
+type format int
+
+const (
+	plaintext format = iota
+	ageBinary
+	ageArmored
+	sopsJSON
+	sopsYAML
+	sopsDotenv
+)
+
+var (
+	ageHeader        = []byte("age-encryption.org/v1\n")
+	ageArmorHeader   = []byte("-----BEGIN AGE ENCRYPTED FILE-----")
+	regexpSopsYAML   = regexp.MustCompile(`(?m)^sops:\s*$`)
+	regexpSopsDotenv = regexp.MustCompile(`(?m)^sops_mac=ENC\[`)
+	regexpEnvName    = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// detect returns how data is encrypted. sops files are recognised by the
+// metadata sops adds to them, at the top level.
+func detect(data []byte) format {
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(data, ageHeader):
+		return ageBinary
+	case bytes.HasPrefix(trimmed, ageArmorHeader):
+		return ageArmored
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		var doc map[string]json.RawMessage
+		if json.Unmarshal(trimmed, &doc) == nil && doc["sops"] != nil {
+			return sopsJSON
+		}
+	case regexpSopsYAML.Match(data):
+		return sopsYAML
+	case regexpSopsDotenv.Match(data):
+		return sopsDotenv
+	}
+	return plaintext
+}
+
+// Decrypt decrypts ciphertext if it's encrypted with age, or with sops, in
+// which case only the values are decrypted and the document is otherwise
+// unchanged, less the sops metadata. Decrypted dotenv files are output as
+// NAME='value' lines, so values aren't interpreted by the shell. Anything
+// else is returned as is.
+func (d *Decryptor) Decrypt(key string, ciphertext []byte) ([]byte, error) {
+	identity := d.IdentityPath
+	if d.Identity != nil {
+		identity = fmt.Sprintf("/dev/fd/%d", identityFD)
+	}
+	switch f := detect(ciphertext); f {
+	case plaintext:
+		return ciphertext, nil
+	case ageBinary, ageArmored:
+		return d.run(ciphertext, nil, "age", "--decrypt", "--identity", identity)
+	default:
+		typ := map[format]string{sopsJSON: "json", sopsYAML: "yaml", sopsDotenv: "dotenv"}[f]
+		env := []string{"SOPS_AGE_KEY_FILE=" + identity}
+		data, err := d.run(ciphertext, env, "sops", "--decrypt", "--input-type", typ, "--output-type", typ, "/dev/stdin")
+		if err != nil || f != sopsDotenv {
+			return data, err
+		}
+		return quoteDotenv(data), nil
+	}
+}
+
+// run runs a command with stdin, returning its stdout. Identity, if set, is
+// written to a pipe the command has as identityFD. The command's environment
+// is only env and passedEnv.
+func (d *Decryptor) run(stdin []byte, env []string, name string, args ...string) ([]byte, error) {
+	if d.IdentityPath == "" && d.Identity == nil {
+		return nil, errors.New("no age identity configured")
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	for _, v := range passedEnv {
+		if value, ok := os.LookupEnv(v); ok {
+			cmd.Env = append(cmd.Env, v+"="+value)
+		}
+	}
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	written := make(chan error, 1)
+	if d.Identity == nil {
+		written <- nil
+	} else {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		cmd.ExtraFiles = []*os.File{r} // identityFD
+		go func() {
+			_, err := w.Write(d.Identity)
+			if cerr := w.Close(); err == nil {
+				err = cerr
+			}
+			written <- err
+		}()
+	}
+	err := cmd.Run()
+	if werr := <-written; werr != nil && err == nil {
+		return nil, fmt.Errorf("%s: writing identity: %w", name, werr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", name, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// quoteDotenv returns the NAME=value lines sops outputs for a dotenv file as
+// NAME='value' lines, zeroing data. sops escapes newlines in values as \n.
+// Lines which don't assign a valid name are dropped.
+func quoteDotenv(data []byte) []byte {
+	defer zero(data)
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.IndexByte(line, '=')
+		if i <= 0 || !regexpEnvName.MatchString(line[:i]) {
+			continue
+		}
+		value := strings.Replace(line[i+1:], `\n`, "\n", -1)
+		fmt.Fprintf(&out, "%s='%s'\n", line[:i], strings.Replace(value, "'", `'\''`, -1))
+	}
+	return out.Bytes()
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
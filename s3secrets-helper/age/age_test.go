@@ -0,0 +1,96 @@
+package age
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetect(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		data     string
+		expected format
+	}{
+		{"env", "A=one\n", plaintext},
+		{"json", `{"A": "one"}`, plaintext},
+		{"yaml", "a: one\n", plaintext},
+		{"age", "age-encryption.org/v1\n-> X25519 abc\n", ageBinary},
+		{"armored age", "-----BEGIN AGE ENCRYPTED FILE-----\nYWdl\n-----END AGE ENCRYPTED FILE-----\n", ageArmored},
+		{"sops json", `{"A": "ENC[AES256_GCM,data:abc]", "sops": {"age": []}}`, sopsJSON},
+		{"sops yaml", "a: ENC[AES256_GCM,data:abc]\nsops:\n    age: []\n", sopsYAML},
+		{"sops dotenv", "A=ENC[AES256_GCM,data:abc]\nsops_mac=ENC[AES256_GCM,data:def]\n", sopsDotenv},
+		{"nested sops yaml", "a:\n  sops:\n", plaintext},
+	} {
+		if f := detect([]byte(tc.data)); f != tc.expected {
+			t.Errorf("%s: expected format %d, got %d", tc.name, tc.expected, f)
+		}
+	}
+}
+
+func TestDecryptPlaintext(t *testing.T) {
+	d := &Decryptor{}
+	data, err := d.Decrypt("env", []byte("A=one\n"))
+	if err != nil || string(data) != "A=one\n" {
+		t.Errorf("expected plaintext to be returned as is, got %q, %v", data, err)
+	}
+	if _, err := d.Decrypt("env", []byte("age-encryption.org/v1\n")); err == nil {
+		t.Error("expected an error without an identity")
+	}
+}
+
+func TestIdentityPipe(t *testing.T) {
+	// a fake age prints the identity it's given, and what it decrypts.
+	dir, err := ioutil.TempDir("", "age")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := "#!/bin/sh\ncat \"$3\"\ncat\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "age"), []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	d := &Decryptor{Identity: []byte("AGE-SECRET-KEY-1\n")}
+	data, err := d.Decrypt("env", []byte("age-encryption.org/v1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "AGE-SECRET-KEY-1\nage-encryption.org/v1\n"; string(data) != expected {
+		t.Errorf("expected %q, got %q", expected, data)
+	}
+}
+
+func TestSopsDotenv(t *testing.T) {
+	// a fake sops outputs the identity it's given as a variable, after
+	// checking it isn't in its environment.
+	dir, err := ioutil.TempDir("", "sops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := "#!/bin/sh\n" +
+		"[ \"$SOPS_AGE_KEY_FILE\" = /dev/fd/3 ] || exit 1\n" +
+		"[ -z \"$SOPS_AGE_KEY$UNRELATED_SECRET\" ] || exit 2\n" +
+		"printf 'IDENTITY=%s\\n' \"$(cat \"$SOPS_AGE_KEY_FILE\")\"\n" +
+		"printf '%s\\n' 'A=one $(id) it'\\''s' 'B=two\\nlines' '# comment' 'bad name=x'\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "sops"), []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	os.Setenv("UNRELATED_SECRET", "secret")
+	defer os.Unsetenv("UNRELATED_SECRET")
+
+	d := &Decryptor{Identity: []byte("AGE-SECRET-KEY-1\n")}
+	data, err := d.Decrypt("env", []byte("A=ENC[AES256_GCM,data:abc]\nsops_mac=ENC[AES256_GCM,data:def]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "IDENTITY='AGE-SECRET-KEY-1'\nA='one $(id) it'\\''s'\nB='two\nlines'\n"; string(data) != expected {
+		t.Errorf("expected %q, got %q", expected, data)
+	}
+}
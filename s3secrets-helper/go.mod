@@ -2,4 +2,8 @@ module github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v
 
 go 1.15
 
-require github.com/aws/aws-sdk-go v1.35.14
+require (
+	github.com/aws/aws-sdk-go v1.35.14
+	golang.org/x/crypto v0.0.0-20201016220609-9e8e0b390897
+	golang.org/x/text v0.3.0
+)
@@ -0,0 +1,33 @@
+// Package gpg imports private keys into gpg, whose gpg-agent holds them for
+// signing commits and packages.
+package gpg
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// Agent imports keys with the gpg command, which starts gpg-agent if it
+// isn't already running.
+type Agent struct {
+	// Home, if set, is the GNUPGHOME keys are imported into, rather than
+	// ~/.gnupg.
+	Home string
+}
+
+// Import imports key, armored or binary, into the keyring.
+func (a *Agent) Import(key []byte) error {
+	cmd := exec.Command("gpg", "--batch", "--import")
+	if a.Home != "" {
+		cmd.Env = append(os.Environ(), "GNUPGHOME="+a.Home)
+	}
+	var stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(key)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("gpg: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+// Package kms decrypts data with AWS KMS, for secrets stored with KMS
+// envelope encryption.
+package kms
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+type Client struct {
+	kms *kms.KMS
+}
+
+// New returns a Client using KMS in region, with creds, or the default
+// credentials if that's nil.
+func New(region string, creds *credentials.Credentials) (*Client, error) {
+	sess, err := session.NewSession(&aws.Config{Region: &region, Credentials: creds})
+	if err != nil {
+		return nil, err
+	}
+	return &Client{kms: kms.New(sess)}, nil
+}
+
+// Decrypt decrypts ciphertext, which must have been encrypted with keyID if
+// it is set.
+func (c *Client) Decrypt(ctx context.Context, keyID string, ciphertext []byte, encryptionContext map[string]string) ([]byte, error) {
+	in := &kms.DecryptInput{
+		CiphertextBlob:    ciphertext,
+		EncryptionContext: aws.StringMap(encryptionContext),
+	}
+	if keyID != "" {
+		in.KeyId = &keyID
+	}
+	out, err := c.kms.DecryptWithContext(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
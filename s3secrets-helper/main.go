@@ -1,64 +1,462 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/age"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/gpg"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/kms"
 	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/s3"
 	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/secrets"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/secretsmanager"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sentinel"
 	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sshagent"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/ssm"
 )
 
 const (
-	envBucket     = "BUILDKITE_PLUGIN_S3_SECRETS_BUCKET"
-	envPrefix     = "BUILDKITE_PLUGIN_S3_SECRETS_BUCKET_PREFIX"
-	envPipeline   = "BUILDKITE_PIPELINE_SLUG"
-	envRepo       = "BUILDKITE_REPO"
-	envCredHelper = "BUILDKITE_PLUGIN_S3_SECRETS_CREDHELPER"
+	envBucket      = "BUILDKITE_PLUGIN_S3_SECRETS_BUCKET"
+	envBuckets     = "BUILDKITE_PLUGIN_S3_SECRETS_BUCKETS"
+	envPrefix      = "BUILDKITE_PLUGIN_S3_SECRETS_BUCKET_PREFIX"
+	envPipeline    = "BUILDKITE_PIPELINE_SLUG"
+	envRepo        = "BUILDKITE_REPO"
+	envCredHelper  = "BUILDKITE_PLUGIN_S3_SECRETS_CREDHELPER"
+	envStripBOM    = "BUILDKITE_PLUGIN_S3_SECRETS_STRIP_BOM"
+	envEndpoint    = "BUILDKITE_PLUGIN_S3_SECRETS_ENDPOINT"
+	envPathStyle   = "BUILDKITE_PLUGIN_S3_SECRETS_FORCE_PATH_STYLE"
+	envRejectBin   = "BUILDKITE_PLUGIN_S3_SECRETS_REJECT_BINARY_ENV"
+	envRepoPrefix  = "BUILDKITE_PLUGIN_S3_SECRETS_PREFIX_FROM_REPO"
+	envKMSKeyID    = "BUILDKITE_PLUGIN_S3_SECRETS_KMS_KEY_ID"
+	envDryRun      = "BUILDKITE_PLUGIN_S3_SECRETS_DRY_RUN"
+	envDiscover    = "BUILDKITE_PLUGIN_S3_SECRETS_DISCOVER_KEYS"
+	envManifest    = "BUILDKITE_PLUGIN_S3_SECRETS_KEY_MANIFEST"
+	envManifestDir = "BUILDKITE_PLUGIN_S3_SECRETS_KEY_MANIFEST_FILE_DIR"
+	envRoleARN     = "BUILDKITE_PLUGIN_S3_SECRETS_ASSUME_ROLE_ARN"
+	envExternalID  = "BUILDKITE_PLUGIN_S3_SECRETS_EXTERNAL_ID"
+	envSession     = "BUILDKITE_PLUGIN_S3_SECRETS_SESSION_NAME"
+	envEnvFormat   = "BUILDKITE_PLUGIN_S3_SECRETS_ENV_FORMAT"
+	envLogFormat   = "BUILDKITE_PLUGIN_S3_SECRETS_LOG_FORMAT"
+	envRequireKey  = "BUILDKITE_PLUGIN_S3_SECRETS_REQUIRE_SSH_KEY"
+	envRequireEnv  = "BUILDKITE_PLUGIN_S3_SECRETS_REQUIRE_ENV"
+	envMaxBytes    = "BUILDKITE_PLUGIN_S3_SECRETS_MAX_SECRET_BYTES"
+	envEnvPrefix   = "BUILDKITE_PLUGIN_S3_SECRETS_ENV_PREFIX"
+	envAllowlist   = "BUILDKITE_PLUGIN_S3_SECRETS_ENV_ALLOWLIST"
+	envDebug       = "BUILDKITE_PLUGIN_S3_SECRETS_DEBUG"
+	envPinned      = "BUILDKITE_PLUGIN_S3_SECRETS_PINNED_VERSIONS"
+	envAgeID       = "BUILDKITE_PLUGIN_S3_SECRETS_AGE_IDENTITY"
+	envKeyPrefix   = "BUILDKITE_PLUGIN_S3_SECRETS_SSH_KEY_PREFIX"
+	envNoSSH       = "BUILDKITE_PLUGIN_S3_SECRETS_DISABLE_SSH"
+	envNoEnv       = "BUILDKITE_PLUGIN_S3_SECRETS_DISABLE_ENV"
+	envNoGitCreds  = "BUILDKITE_PLUGIN_S3_SECRETS_DISABLE_GIT_CREDENTIALS"
+	envKeyTTL      = "BUILDKITE_PLUGIN_S3_SECRETS_SSH_KEY_LIFETIME"
+	envAudit       = "BUILDKITE_PLUGIN_S3_SECRETS_AUDIT_BUCKET"
+	envValidKeys   = "BUILDKITE_PLUGIN_S3_SECRETS_VALIDATE_SSH_KEYS"
+	envWebToken    = "BUILDKITE_PLUGIN_S3_SECRETS_WEB_IDENTITY_TOKEN_FILE"
+	envWebRole     = "BUILDKITE_PLUGIN_S3_SECRETS_WEB_IDENTITY_ROLE_ARN"
+	envPrefixes    = "BUILDKITE_PLUGIN_S3_SECRETS_BUCKET_PREFIXES"
+	envKnownHosts  = "BUILDKITE_PLUGIN_S3_SECRETS_KNOWN_HOSTS"
+	envKeySep      = "BUILDKITE_PLUGIN_S3_SECRETS_KEY_SEPARATOR"
+	envLowerKeys   = "BUILDKITE_PLUGIN_S3_SECRETS_LOWERCASE_KEYS"
+	envAgentOpt    = "BUILDKITE_PLUGIN_S3_SECRETS_SSH_AGENT_OPTIONAL"
+	envSecretRefs  = "BUILDKITE_PLUGIN_S3_SECRETS_RESOLVE_SECRET_REFS"
+	envFirstMatch  = "BUILDKITE_PLUGIN_S3_SECRETS_FIRST_MATCH_ONLY"
+	envDenylist    = "BUILDKITE_PLUGIN_S3_SECRETS_ENV_DENYLIST"
+	envSource      = "BUILDKITE_PLUGIN_S3_SECRETS_SOURCE"
+	envParamPath   = "BUILDKITE_PLUGIN_S3_SECRETS_PARAMETER_PATH"
+	envKMSDecrypt  = "BUILDKITE_PLUGIN_S3_SECRETS_KMS_DECRYPT"
+	envGPGKeys     = "BUILDKITE_PLUGIN_S3_SECRETS_GPG_KEYS"
+	envDockerCfg   = "BUILDKITE_PLUGIN_S3_SECRETS_DOCKER_CONFIG"
+	envDockerPath  = "BUILDKITE_PLUGIN_S3_SECRETS_DOCKER_CONFIG_PATH"
+	envNPMRC       = "BUILDKITE_PLUGIN_S3_SECRETS_NPMRC"
+	envNPMRCPath   = "BUILDKITE_PLUGIN_S3_SECRETS_NPMRC_PATH"
+	envNPMRCMode   = "BUILDKITE_PLUGIN_S3_SECRETS_NPMRC_MODE"
+	envFiles       = "BUILDKITE_PLUGIN_S3_SECRETS_FILES"
+	envKubeconfig  = "BUILDKITE_PLUGIN_S3_SECRETS_KUBECONFIG"
+	envNetrc       = "BUILDKITE_PLUGIN_S3_SECRETS_NETRC"
+	envSSHKeys     = "BUILDKITE_PLUGIN_S3_SECRETS_SSH_KEYS"
+)
+
+// Sources of secrets; see envSource.
+const (
+	sourceS3             = "s3"
+	sourceSecretsManager = "secretsmanager"
+)
+
+// sourceClient is a client for a source of secrets, whose region and
+// credentials are also used for KMS.
+type sourceClient interface {
+	secrets.Client
+	Region() string
+	Credentials() *credentials.Credentials
+}
+
+// Exit codes for classes of failure, so the hook can tell them apart.
+const (
+	exitFailure        = 1
+	exitBucketNotFound = 2
+	exitAgentFailed    = 3
+	exitTempFail       = 75 // EX_TEMPFAIL; worth retrying
 )
 
 func main() {
 	log := log.New(os.Stderr, "", log.Lmsgprefix)
 	if err := mainWithError(log); err != nil {
-		log.Fatalf("fatal error: %v", err)
+		log.Printf("fatal error: %v", err)
+		os.Exit(exitCode(err))
 	}
 }
 
+// exitCode returns the exit code for err.
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, secrets.ErrBucketNotFound):
+		return exitBucketNotFound
+	case errors.Is(err, secrets.ErrAgentFailed):
+		return exitAgentFailed
+	case errors.Is(err, secrets.ErrDownloadFailed), errors.Is(err, sentinel.ErrTransient):
+		return exitTempFail
+	}
+	return exitFailure
+}
+
 func mainWithError(log *log.Logger) error {
 	bucket := os.Getenv(envBucket)
+	buckets := envList(envBuckets)
+	if bucket == "" && len(buckets) > 0 {
+		bucket = buckets[0]
+	}
 	if bucket == "" {
 		return nil
 	}
 
+	// a list of prefixes replaces the single prefix.
+	prefixes := envList(envPrefixes)
 	prefix := os.Getenv(envPrefix)
-	if prefix == "" {
+	if prefix == "" && len(prefixes) == 0 {
 		prefix = os.Getenv(envPipeline)
 	}
-	if prefix == "" {
+	if prefix == "" && len(prefixes) == 0 {
 		return fmt.Errorf("%s or %s required", envPrefix, envPipeline)
 	}
 
-	client, err := s3.New(log, bucket)
+	maxBytes := int64(secrets.DefaultMaxSecretBytes)
+	if v := os.Getenv(envMaxBytes); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %w", envMaxBytes, err)
+		}
+		maxBytes = n
+	}
+
+	var keyLifetime time.Duration
+	if v := os.Getenv(envKeyTTL); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", envKeyTTL, err)
+		}
+		keyLifetime = d
+	}
+
+	// pinned versions are listed as key@version, e.g. my-pipeline/env@3HL4kqtJ
+	var pinned map[string]string
+	for _, v := range envList(envPinned) {
+		i := strings.LastIndexByte(v, '@')
+		if i <= 0 || i == len(v)-1 {
+			return fmt.Errorf("%s: expected key@version, got %q", envPinned, v)
+		}
+		if pinned == nil {
+			pinned = make(map[string]string)
+		}
+		pinned[v[:i]] = v[i+1:]
+	}
+
+	s3conf := s3.Config{
+		Endpoint:             os.Getenv(envEndpoint),
+		ForcePathStyle:       envBool(envPathStyle, false),
+		AssumeRoleARN:        os.Getenv(envRoleARN),
+		ExternalID:           os.Getenv(envExternalID),
+		SessionName:          os.Getenv(envSession),
+		WebIdentityTokenFile: os.Getenv(envWebToken),
+		WebIdentityRoleARN:   os.Getenv(envWebRole),
+		MaxObjectBytes:       maxBytes,
+	}
+	credHelper := os.Getenv(envCredHelper)
+	var newClient func(bucket string) (sourceClient, error)
+	switch source := os.Getenv(envSource); source {
+	case "", sourceS3:
+		newClient = func(bucket string) (sourceClient, error) {
+			return s3.New(log, bucket, s3conf)
+		}
+	case sourceSecretsManager:
+		smconf := secretsmanager.Config{Endpoint: os.Getenv(envEndpoint)}
+		// the credential helper downloads from S3, so git-credentials are
+		// written to a credential store instead.
+		credHelper = ""
+		newClient = func(namespace string) (sourceClient, error) {
+			return secretsmanager.New(log, namespace, smconf)
+		}
+	default:
+		return fmt.Errorf("%s: unknown source %q; expected %q or %q", envSource, source, sourceS3, sourceSecretsManager)
+	}
+	client, err := newClient(bucket)
+	if err != nil {
+		return err
+	}
+
+	decrypter, err := kms.New(client.Region(), client.Credentials())
 	if err != nil {
 		return err
 	}
 
 	agent := &sshagent.Agent{}
 
-	credHelper := os.Getenv(envCredHelper)
-	if credHelper == "" {
-		return fmt.Errorf("%s required", envCredHelper)
-	}
-
-	return secrets.Run(secrets.Config{
-		Repo:                os.Getenv(envRepo),
-		Bucket:              bucket,
-		Prefix:              prefix,
-		Client:              client,
-		Logger:              log,
-		SSHAgent:            agent,
-		EnvSink:             os.Stdout,
-		GitCredentialHelper: credHelper,
+	// the age identity is a path on the agent, or ssm:name for a parameter.
+	var decryptor secrets.Decryptor
+	var encryptedSuffix string
+	if path := os.Getenv(envAgeID); strings.HasPrefix(path, "ssm:") {
+		c, err := ssm.New(client.Region(), client.Credentials())
+		if err != nil {
+			return err
+		}
+		identity, err := c.GetParameter(context.Background(), strings.TrimPrefix(path, "ssm:"))
+		if err != nil {
+			return fmt.Errorf("%s: %w", envAgeID, err)
+		}
+		decryptor = &age.Decryptor{Identity: []byte(identity)}
+		encryptedSuffix = ".age"
+	} else if path != "" {
+		decryptor = &age.Decryptor{IdentityPath: path}
+		encryptedSuffix = ".age"
+	}
+
+	var gpgAgent secrets.GPGAgent
+	if envBool(envGPGKeys, false) {
+		gpgAgent = &gpg.Agent{}
+	}
+
+	var knownHosts string
+	if envBool(envKnownHosts, false) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return fmt.Errorf("%s: %w", envKnownHosts, err)
+		}
+		knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	// {pipeline} in the parameter path is replaced by the pipeline's slug.
+	var params secrets.ParameterStore
+	paramPath := strings.ReplaceAll(os.Getenv(envParamPath), "{pipeline}", os.Getenv(envPipeline))
+	if paramPath != "" {
+		c, err := ssm.New(client.Region(), client.Credentials())
+		if err != nil {
+			return err
+		}
+		params = c
+	}
+
+	// docker reads $DOCKER_CONFIG/config.json, or ~/.docker/config.json.
+	dockerConfig := os.Getenv(envDockerPath)
+	if dockerConfig == "" && envBool(envDockerCfg, false) {
+		dir := os.Getenv("DOCKER_CONFIG")
+		if dir == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return fmt.Errorf("%s: %w", envDockerCfg, err)
+			}
+			dir = filepath.Join(home, ".docker")
+		}
+		dockerConfig = filepath.Join(dir, "config.json")
+	}
+
+	npmrc := os.Getenv(envNPMRCPath)
+	if npmrc == "" && envBool(envNPMRC, false) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return fmt.Errorf("%s: %w", envNPMRC, err)
+		}
+		npmrc = filepath.Join(home, ".npmrc")
+	}
+	var npmrcMode os.FileMode
+	if v := os.Getenv(envNPMRCMode); v != "" {
+		n, err := strconv.ParseUint(v, 8, 32)
+		if err != nil {
+			return fmt.Errorf("%s: %w", envNPMRCMode, err)
+		}
+		npmrcMode = os.FileMode(n).Perm()
+	}
+
+	// kubectl reads the first of the files listed in $KUBECONFIG, or
+	// ~/.kube/config.
+	var kubeconfig string
+	if envBool(envKubeconfig, false) {
+		if list := filepath.SplitList(os.Getenv("KUBECONFIG")); len(list) > 0 {
+			kubeconfig = list[0]
+		}
+		if kubeconfig == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return fmt.Errorf("%s: %w", envKubeconfig, err)
+			}
+			kubeconfig = filepath.Join(home, ".kube", "config")
+		}
+	}
+
+	var netrc string
+	if envBool(envNetrc, false) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return fmt.Errorf("%s: %w", envNetrc, err)
+		}
+		netrc = filepath.Join(home, ".netrc")
+	}
+
+	files, err := fileSecrets(envList(envFiles))
+	if err != nil {
+		return fmt.Errorf("%s: %w", envFiles, err)
+	}
+
+	denylist := envList(envDenylist)
+	if len(denylist) == 0 {
+		denylist = secrets.DefaultEnvDenylist
+	}
+
+	// The CLI doesn't configure a Leaser, so there's nothing to clean up.
+	_, err = secrets.Run(context.Background(), secrets.Config{
+		Repo:                  os.Getenv(envRepo),
+		Bucket:                bucket,
+		Buckets:               buckets,
+		Prefix:                prefix,
+		Prefixes:              prefixes,
+		Client:                client,
+		Logger:                log,
+		LogFormat:             secrets.LogFormat(os.Getenv(envLogFormat)),
+		Debug:                 envBool(envDebug, false),
+		SSHAgent:              agent,
+		SSHAgentOptional:      envBool(envAgentOpt, false),
+		GPGAgent:              gpgAgent,
+		EnvSink:               os.Stdout,
+		GitCredentialHelper:   credHelper,
+		KnownHostsPath:        knownHosts,
+		DockerConfigPath:      dockerConfig,
+		NPMRCPath:             npmrc,
+		NPMRCMode:             npmrcMode,
+		SecretFanout:          files,
+		KubeconfigPath:        kubeconfig,
+		NetrcPath:             netrc,
+		ValidateSSHKeys:       envBool(envValidKeys, false),
+		StripBOM:              envBool(envStripBOM, true),
+		RejectBinaryEnv:       envBool(envRejectBin, true),
+		PrefixFromRepo:        envBool(envRepoPrefix, false),
+		KMS:                   decrypter,
+		KMSKeyID:              os.Getenv(envKMSKeyID),
+		KMSDecrypt:            envBool(envKMSDecrypt, false),
+		Decryptor:             decryptor,
+		EncryptedKeySuffix:    encryptedSuffix,
+		AuditBucket:           envBool(envAudit, false),
+		DryRun:                envBool(envDryRun, false),
+		DiscoverKeys:          envBool(envDiscover, false),
+		KeyManifest:           envBool(envManifest, false),
+		KeyManifestFileDir:    os.Getenv(envManifestDir),
+		DisableSSH:            envBool(envNoSSH, false),
+		DisableEnv:            envBool(envNoEnv, false),
+		DisableGitCredentials: envBool(envNoGitCreds, false),
+		RequireSSHKey:         envBool(envRequireKey, false),
+		RequireEnv:            envBool(envRequireEnv, false),
+		MaxSecretBytes:        maxBytes,
+		PinnedVersions:        pinned,
+		EnvPrefix:             os.Getenv(envEnvPrefix),
+		SSHKeyPrefix:          os.Getenv(envKeyPrefix),
+		SSHKeyNames:           envList(envSSHKeys),
+		SSHKeyLifetime:        keyLifetime,
+		EnvFormat:             secrets.EnvFormat(os.Getenv(envEnvFormat)),
+		ResolveSecretRefs:     envBool(envSecretRefs, false),
+		FirstMatchOnly:        envBool(envFirstMatch, false),
+		EnvAllowlist:          envList(envAllowlist),
+		EnvDenylist:           denylist,
+		ParameterStore:        params,
+		ParameterPath:         paramPath,
+		KeySeparator:          os.Getenv(envKeySep),
+		LowercaseKeys:         envBool(envLowerKeys, false),
+		NewClient: func(bucket string) (secrets.Client, error) {
+			c, err := newClient(bucket)
+			if err != nil {
+				return nil, err
+			}
+			return c, nil
+		},
 	})
+	return err
+}
+
+// regexpFileMode matches the octal mode which may end a file secret.
+var regexpFileMode = regexp.MustCompile(`^0?[0-7]{3}$`)
+
+// fileSecrets returns the destinations of file secrets, listed as key:path
+// or key:path:mode, e.g. my-pipeline/kubeconfig:~/.kube/config:0600. A path
+// starting with ~/ is within the home directory.
+func fileSecrets(list []string) (map[string][]secrets.Destination, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+	files := make(map[string][]secrets.Destination, len(list))
+	for _, v := range list {
+		parts := strings.Split(v, ":")
+		if len(parts) < 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%q isn't key:path or key:path:mode", v)
+		}
+		var mode os.FileMode
+		if n := len(parts); n > 2 && regexpFileMode.MatchString(parts[n-1]) {
+			m, _ := strconv.ParseUint(parts[n-1], 8, 32)
+			mode, parts = os.FileMode(m), parts[:n-1]
+		}
+		path := strings.Join(parts[1:], ":")
+		if strings.HasPrefix(path, "~/") {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, err
+			}
+			path = filepath.Join(home, path[2:])
+		}
+		if path == "" {
+			return nil, fmt.Errorf("%q has no path", v)
+		}
+		files[parts[0]] = append(files[parts[0]], secrets.Destination{Kind: secrets.DestinationFile, Path: path, Mode: mode})
+	}
+	return files, nil
+}
+
+// envList returns the values of a list option, which the agent passes as
+// name_0, name_1, etc.
+func envList(name string) []string {
+	var values []string
+	for i := 0; ; i++ {
+		v, ok := os.LookupEnv(fmt.Sprintf("%s_%d", name, i))
+		if !ok {
+			return values
+		}
+		values = append(values, v)
+	}
+}
+
+// envBool returns whether the named environment variable is "true" or "1",
+// or def if it's unset.
+func envBool(name string, def bool) bool {
+	switch os.Getenv(name) {
+	case "":
+		return def
+	case "true", "1":
+		return true
+	default:
+		return false
+	}
 }
@@ -0,0 +1,157 @@
+//go:build integration
+// +build integration
+
+package s3_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/s3"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/secrets"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/secrets/secretstest"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sentinel"
+)
+
+// These tests run against an S3-compatible store, e.g. MinIO:
+//
+//	docker run -p 9000:9000 minio/minio server /data
+//	go test -tags integration ./s3/
+//
+// S3_SECRETS_TEST_ENDPOINT overrides the endpoint, http://localhost:9000.
+// The AWS credentials in the environment are used, or MinIO's defaults.
+// They're skipped if nothing is listening at the endpoint.
+
+// integrationBucket creates a bucket containing objects, returning its name
+// and the endpoint, and deletes it when the test ends.
+func integrationBucket(t *testing.T, objects map[string]string) (string, string) {
+	endpoint := os.Getenv("S3_SECRETS_TEST_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "http://localhost:9000"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialTimeout("tcp", u.Host, time.Second)
+	if err != nil {
+		t.Skipf("no S3-compatible store at %s: %v", endpoint, err)
+	}
+	conn.Close()
+
+	for name, value := range map[string]string{
+		"AWS_ACCESS_KEY_ID":     "minioadmin",
+		"AWS_SECRET_ACCESS_KEY": "minioadmin",
+		"AWS_DEFAULT_REGION":    "us-east-1",
+	} {
+		if os.Getenv(name) == "" {
+			os.Setenv(name, value)
+		}
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(endpoint),
+		Region:           aws.String(os.Getenv("AWS_DEFAULT_REGION")),
+		S3ForcePathStyle: aws.Bool(true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := awss3.New(sess)
+	bucket := fmt.Sprintf("s3-secrets-test-%d", time.Now().UnixNano())
+	if _, err := svc.CreateBucket(&awss3.CreateBucketInput{Bucket: &bucket}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for key := range objects {
+			svc.DeleteObject(&awss3.DeleteObjectInput{Bucket: &bucket, Key: aws.String(key)})
+		}
+		svc.DeleteBucket(&awss3.DeleteBucketInput{Bucket: &bucket})
+	})
+	for key, value := range objects {
+		if _, err := svc.PutObject(&awss3.PutObjectInput{
+			Bucket: &bucket,
+			Key:    aws.String(key),
+			Body:   strings.NewReader(value),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return bucket, endpoint
+}
+
+func integrationClient(t *testing.T, bucket, endpoint string) *s3.Client {
+	c, err := s3.New(log.New(ioutil.Discard, "", 0), bucket, s3.Config{Endpoint: endpoint, ForcePathStyle: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestIntegrationClient(t *testing.T) {
+	bucket, endpoint := integrationBucket(t, map[string]string{
+		"pipeline/env":         "A=one",
+		"pipeline/env.d/00-a":  "B=two",
+		"pipeline/env.d/10-b/": "",
+	})
+	c := integrationClient(t, bucket, endpoint)
+
+	if exists, err := c.BucketExists(); err != nil || !exists {
+		t.Errorf("expected %s to exist, got %v, %v", bucket, exists, err)
+	}
+	if exists, err := integrationClient(t, bucket+"-missing", endpoint).BucketExists(); err != nil || exists {
+		t.Errorf("expected %s-missing not to exist, got %v, %v", bucket, exists, err)
+	}
+	if data, err := c.Get(context.Background(), "pipeline/env"); err != nil || string(data) != "A=one" {
+		t.Errorf("expected A=one, got %q, %v", data, err)
+	}
+	if _, err := c.Get(context.Background(), "pipeline/missing"); !errors.Is(err, sentinel.ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if keys, err := c.List(context.Background(), "pipeline/env.d/"); err != nil || strings.Join(keys, ",") != "pipeline/env.d/00-a" {
+		t.Errorf("expected pipeline/env.d/00-a, got %v, %v", keys, err)
+	}
+}
+
+func TestIntegrationRun(t *testing.T) {
+	bucket, endpoint := integrationBucket(t, map[string]string{
+		"private_ssh_key": "general key",
+		"env":             "A=one",
+		"pipeline/env":    "B=two",
+	})
+	agent := &secretstest.FakeAgent{}
+	envSink := &bytes.Buffer{}
+	_, err := secrets.Run(context.Background(), secrets.Config{
+		Repo:                "git@github.com:org/repo.git",
+		Bucket:              bucket,
+		Prefix:              "pipeline",
+		Client:              integrationClient(t, bucket, endpoint),
+		Logger:              log.New(ioutil.Discard, "", 0),
+		SSHAgent:            agent,
+		EnvSink:             envSink,
+		GitCredentialHelper: "/path/to/git-credential-s3-secrets",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := agent.Keys(); len(keys) != 1 || keys[0] != "general key" {
+		t.Errorf("expected the general key to be added, got %q", keys)
+	}
+	if !strings.HasSuffix(envSink.String(), "A=one\nB=two\n") {
+		t.Errorf("expected env to be loaded, got %q", envSink.String())
+	}
+}
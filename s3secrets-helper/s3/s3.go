@@ -1,28 +1,142 @@
 package s3
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"net/http"
 	"os"
+	"strings"
+	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
 	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sentinel"
 )
 
-const envDefaultRegion = "AWS_DEFAULT_REGION"
+const (
+	envDefaultRegion = "AWS_DEFAULT_REGION"
+
+	defaultSessionName = "buildkite-s3-secrets"
+
+	groupAllUsers           = "http://acs.amazonaws.com/groups/global/AllUsers"
+	groupAuthenticatedUsers = "http://acs.amazonaws.com/groups/global/AuthenticatedUsers"
+)
 
 type Client struct {
-	s3 *s3.S3
-	bucket string
+	bucket   string
+	creds    *credentials.Credentials
+	maxBytes int64
+	sess     *session.Session
+	log      *log.Logger
+
+	mu     sync.Mutex // guards s3 and region, which change if the bucket is found elsewhere
+	s3     *s3.S3
+	region string
+}
+
+// Config configures the S3 endpoint, for S3-compatible stores such as MinIO,
+// and the credentials used. The zero value uses AWS S3 with the default
+// credentials.
+type Config struct {
+	// Endpoint overrides the S3 endpoint URL, e.g. "http://localhost:9000".
+	Endpoint string
+
+	// ForcePathStyle addresses buckets in the URL path rather than the
+	// hostname, as most S3-compatible stores require.
+	ForcePathStyle bool
+
+	// AssumeRoleARN, if set, is a role assumed with STS to access the
+	// bucket. The role's credentials are refreshed before they expire.
+	AssumeRoleARN string
+
+	// ExternalID is passed to STS when assuming AssumeRoleARN, if the role
+	// requires it.
+	ExternalID string
+
+	// SessionName names the session when assuming AssumeRoleARN; by
+	// default, "buildkite-s3-secrets".
+	SessionName string
+
+	// WebIdentityTokenFile and WebIdentityRoleARN, if both set, are the
+	// path to an OIDC token, such as a Kubernetes service account token,
+	// and the role assumed with it, replacing the default credentials.
+	// The file is read again whenever the credentials are refreshed, so
+	// tokens that are rotated on disk are picked up. AssumeRoleARN, if
+	// also set, is assumed using the web identity role's credentials.
+	WebIdentityTokenFile string
+	WebIdentityRoleARN   string
+
+	// MaxObjectBytes, if positive, is the size of the largest object Get
+	// downloads; larger objects fail with sentinel.ErrTooLarge, without
+	// being read into memory.
+	MaxObjectBytes int64
+
+	// HTTPClient, if set, makes every request, including those to STS and
+	// to discover the bucket's region, e.g. to go through a proxy or trust
+	// a private CA. By default, the AWS SDK's client is used. AWS_CA_BUNDLE
+	// is only supported if its Transport is an *http.Transport.
+	HTTPClient *http.Client
+}
+
+// newAssumeRoler returns the STS client used to assume
+// Config.AssumeRoleARN; it's replaced in tests.
+var newAssumeRoler = func(p client.ConfigProvider) stscreds.AssumeRoler {
+	return sts.New(p)
 }
 
-func New(log *log.Logger, bucket string) (*Client, error) {
-	sess, err := session.NewSession()
+// newWebIdentitySTS returns the STS client used to assume
+// Config.WebIdentityRoleARN; it's replaced in tests.
+var newWebIdentitySTS = func(p client.ConfigProvider) stsiface.STSAPI {
+	return sts.New(p)
+}
+
+// webIdentity returns credentials for conf.WebIdentityRoleARN, assumed
+// with the token in conf.WebIdentityTokenFile, or nil if they aren't set.
+func webIdentity(sess *session.Session, conf Config) *credentials.Credentials {
+	if conf.WebIdentityTokenFile == "" || conf.WebIdentityRoleARN == "" {
+		return nil
+	}
+	sessionName := conf.SessionName
+	if sessionName == "" {
+		sessionName = defaultSessionName
+	}
+	return credentials.NewCredentials(stscreds.NewWebIdentityRoleProvider(
+		newWebIdentitySTS(sess), conf.WebIdentityRoleARN, sessionName, conf.WebIdentityTokenFile))
+}
+
+// assumeRole returns credentials for conf.AssumeRoleARN, assumed using the
+// default credentials of sess, or nil if it isn't set.
+func assumeRole(sess *session.Session, conf Config) *credentials.Credentials {
+	if conf.AssumeRoleARN == "" {
+		return nil
+	}
+	sessionName := conf.SessionName
+	if sessionName == "" {
+		sessionName = defaultSessionName
+	}
+	return stscreds.NewCredentialsWithClient(newAssumeRoler(sess), conf.AssumeRoleARN, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = sessionName
+		if conf.ExternalID != "" {
+			p.ExternalID = aws.String(conf.ExternalID)
+		}
+	})
+}
+
+func New(log *log.Logger, bucket string, conf Config) (*Client, error) {
+	sess, err := session.NewSession(&aws.Config{HTTPClient: conf.HTTPClient})
 	if err != nil {
 		return nil, err
 	}
@@ -40,57 +154,385 @@ func New(log *log.Logger, bucket string) (*Client, error) {
 
 	log.Printf("Discovered current region as %q\n", currentRegion)
 
-	// Using the current region (or a guess) find where the bucket lives
-	bucketRegion, err := s3manager.GetBucketRegion(aws.BackgroundContext(), sess, bucket, currentRegion)
-	if err != nil {
-		return nil, err
+	// STS is called in the current region, as the session may have none
+	sess = sess.Copy(&aws.Config{Region: aws.String(currentRegion)})
+
+	creds := webIdentity(sess, conf)
+	if creds != nil {
+		log.Printf("Assuming role %q with web identity token %q\n", conf.WebIdentityRoleARN, conf.WebIdentityTokenFile)
+		sess = sess.Copy(&aws.Config{Credentials: creds})
+	}
+	if roleCreds := assumeRole(sess, conf); roleCreds != nil {
+		log.Printf("Assuming role %q\n", conf.AssumeRoleARN)
+		creds = roleCreds
+		sess = sess.Copy(&aws.Config{Credentials: creds})
 	}
 
-	log.Printf("Discovered bucket region as %q\n", bucketRegion)
+	bucketRegion := currentRegion
+	if conf.Endpoint == "" {
+		// Using the current region (or a guess) find where the bucket lives
+		if region, err := s3manager.GetBucketRegion(aws.BackgroundContext(), sess, bucket, currentRegion); err != nil {
+			// e.g. the bucket doesn't exist, which BucketExists reports, or
+			// it can't be looked up, in which case requests are redirected.
+			log.Printf("Failed to discover bucket region, using %q: %v\n", currentRegion, err)
+		} else {
+			bucketRegion = region
+			log.Printf("Discovered bucket region as %q\n", bucketRegion)
+		}
+	} else {
+		log.Printf("Using S3 endpoint %q\n", conf.Endpoint)
+	}
 
-	sess, err = session.NewSession(&aws.Config{
-		Region: &bucketRegion,
-	})
+	awsConf := &aws.Config{
+		Region:           &bucketRegion,
+		S3ForcePathStyle: aws.Bool(conf.ForcePathStyle),
+		Credentials:      creds,
+		HTTPClient:       conf.HTTPClient,
+	}
+	if conf.Endpoint != "" {
+		awsConf.Endpoint = aws.String(conf.Endpoint)
+	}
+	sess, err = session.NewSession(awsConf)
 	if err != nil {
 		return nil, err
 	}
 	return &Client{
-		s3: s3.New(sess),
-		bucket: bucket,
+		s3:       s3.New(sess),
+		bucket:   bucket,
+		region:   bucketRegion,
+		creds:    creds,
+		maxBytes: conf.MaxObjectBytes,
+		sess:     sess,
+		log:      log,
 	}, nil
 }
 
-func (c *Client) Bucket() (string) {
+// service returns the S3 service for the bucket's region.
+func (c *Client) service() *s3.S3 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.s3
+}
+
+// withRedirect calls do with the S3 service and an option to apply to the
+// request it sends. If the request fails because the bucket is in another
+// region, the client is switched to that region and do is called again.
+func (c *Client) withRedirect(do func(svc *s3.S3, opt request.Option) error) error {
+	var req *request.Request
+	capture := func(r *request.Request) { req = r }
+	err := do(c.service(), capture)
+	if err != nil && req != nil && c.redirected(req) {
+		err = do(c.service(), capture)
+	}
+	return err
+}
+
+// redirected reports whether req was sent to the wrong region, which S3
+// responds to with a redirect (or, for some requests, a 400) naming the
+// bucket's region in a header, switching the client to that region if so.
+func (c *Client) redirected(req *request.Request) bool {
+	if req.HTTPResponse == nil {
+		return false
+	}
+	region := req.HTTPResponse.Header.Get("x-amz-bucket-region")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if region == "" || region == aws.StringValue(req.Config.Region) {
+		return false
+	}
+	if region != c.region {
+		c.log.Printf("Bucket %q is in region %q, not %q; using %q\n", c.bucket, region, c.region, region)
+		c.s3 = s3.New(c.sess, &aws.Config{Region: aws.String(region)})
+		c.region = region
+	}
+	return true
+}
+
+// Credentials returns the credentials of the role assumed, if any, for use
+// by other clients; otherwise, nil, meaning the default credentials.
+func (c *Client) Credentials() *credentials.Credentials {
+	return c.creds
+}
+
+func (c *Client) Bucket() string {
 	return c.bucket
 }
 
+// Region is the region of the bucket.
+func (c *Client) Region() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.region
+}
+
+// Warmup establishes a connection to the bucket's endpoint with a cheap
+// HeadBucket request, alongside that of BucketExists, so another TLS
+// handshake is out of the way for the concurrent Gets. The result of the
+// HeadBucket itself is irrelevant.
+func (c *Client) Warmup(ctx context.Context) error {
+	err := c.withRedirect(func(svc *s3.S3, opt request.Option) error {
+		_, err := svc.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: &c.bucket}, opt)
+		return err
+	})
+	if err != nil {
+		if _, ok := err.(awserr.RequestFailure); ok {
+			// the server responded, so the connection is warm
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// transientError is an error which errors.Is sentinel.ErrTransient.
+type transientError struct {
+	error
+}
+
+func (e transientError) Is(target error) bool {
+	return target == sentinel.ErrTransient
+}
+
+func (e transientError) Unwrap() error {
+	return e.error
+}
+
+// classify maps errors meaning an object isn't there, or can't be seen, to
+// sentinel.ErrNotFound and sentinel.ErrForbidden, and wraps errors worth
+// retrying (server errors, throttling, timeouts) so they match
+// sentinel.ErrTransient. Other errors are returned verbatim.
+func classify(err error) error {
+	if request.IsErrorRetryable(err) || request.IsErrorThrottle(err) {
+		return transientError{err}
+	}
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return err
+	}
+	switch aerr.Code() {
+	case "NoSuchKey", "NoSuchBucket", "NoSuchVersion", "NotFound":
+		return sentinel.ErrNotFound
+	case "AccessDenied", "Forbidden":
+		return sentinel.ErrForbidden
+	case request.CanceledErrorCode:
+		if aerr.OrigErr() == context.DeadlineExceeded {
+			return transientError{err}
+		}
+	}
+	if rf, ok := err.(awserr.RequestFailure); ok {
+		switch code := rf.StatusCode(); {
+		case code == http.StatusNotFound:
+			return sentinel.ErrNotFound
+		case code == http.StatusForbidden:
+			return sentinel.ErrForbidden
+		case code >= http.StatusInternalServerError:
+			return transientError{err}
+		}
+	}
+	return err
+}
+
+// withoutRetries disables the SDK's retries, for requests retried by the
+// caller on sentinel.ErrTransient.
+func withoutRetries(r *request.Request) {
+	r.Retryer = client.NoOpRetryer{}
+}
+
 // Get downloads an object from S3.
 // Intended for small files; object is fully read into memory.
 // sentinel.ErrNotFound and sentinel.ErrForbidden are returned for those cases.
+// Errors worth retrying match sentinel.ErrTransient; they aren't retried.
 // Other errors are returned verbatim.
-func (c *Client) Get(key string) ([]byte, error) {
-	out, err := c.s3.GetObject(&s3.GetObjectInput{
+func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
+	data, _, err := c.GetWithMetadata(ctx, key)
+	return data, err
+}
+
+// Response headers GetWithMetadata includes in the metadata, by their
+// lowercase names, so that the object's integrity can be checked and its
+// version logged.
+var responseHeaders = []string{
+	"content-encoding",
+	"content-length",
+	"etag",
+	"x-amz-checksum-sha256",
+	"x-amz-server-side-encryption",
+	"x-amz-server-side-encryption-customer-algorithm",
+	"x-amz-version-id",
+}
+
+// GetWithMetadata is Get, also returning the object's user-defined metadata,
+// with lowercase names and without the "x-amz-meta-" prefix, along with the
+// responseHeaders of the response.
+func (c *Client) GetWithMetadata(ctx context.Context, key string) ([]byte, map[string]string, error) {
+	return c.getObject(ctx, &s3.GetObjectInput{
 		Bucket: &c.bucket,
 		Key:    &key,
 	})
+}
+
+// GetVersion is GetWithMetadata for a particular version of an object in a
+// versioned bucket. A version which doesn't exist is sentinel.ErrNotFound.
+func (c *Client) GetVersion(ctx context.Context, key, versionID string) ([]byte, map[string]string, error) {
+	return c.getObject(ctx, &s3.GetObjectInput{
+		Bucket:    &c.bucket,
+		Key:       &key,
+		VersionId: &versionID,
+	})
+}
+
+func (c *Client) getObject(ctx context.Context, in *s3.GetObjectInput) ([]byte, map[string]string, error) {
+	var req *request.Request
+	var out *s3.GetObjectOutput
+	err := c.withRedirect(func(svc *s3.S3, opt request.Option) error {
+		req, out = svc.GetObjectRequest(in)
+		req.SetContext(ctx)
+		req.ApplyOptions(withoutRetries, opt)
+		// S3 only returns the checksum of objects uploaded with one if asked.
+		req.HTTPRequest.Header.Set("x-amz-checksum-mode", "ENABLED")
+		return req.Send()
+	})
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case "NoSuchKey":
-				return nil, sentinel.ErrNotFound
-			case "Forbidden":
-				return nil, sentinel.ErrForbidden
-			default:
-				return nil, aerr
-			}
-		} else {
-			return nil, err
-		}
+		return nil, nil, classify(err)
 	}
 	defer out.Body.Close()
+	if size := aws.Int64Value(out.ContentLength); c.maxBytes > 0 && size > c.maxBytes {
+		return nil, nil, tooLarge(size, c.maxBytes)
+	}
+	meta := make(map[string]string, len(out.Metadata)+len(responseHeaders))
+	for name, value := range out.Metadata {
+		meta[strings.ToLower(name)] = aws.StringValue(value)
+	}
+	for _, name := range responseHeaders {
+		if value := req.HTTPResponse.Header.Get(name); value != "" {
+			meta[name] = value
+		}
+	}
 	// we probably should return io.Reader or io.ReadCloser rather than []byte,
 	// maybe somebody should refactor that (and all the tests etc) one day.
-	return ioutil.ReadAll(out.Body)
+	var body io.Reader = out.Body
+	if c.maxBytes > 0 {
+		// in case Content-Length was missing or wrong.
+		body = io.LimitReader(body, c.maxBytes+1)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err == io.ErrUnexpectedEOF {
+		// the connection was lost part way through.
+		err = transientError{err}
+	}
+	if c.maxBytes > 0 && int64(len(data)) > c.maxBytes {
+		return nil, nil, tooLarge(int64(len(data)), c.maxBytes)
+	}
+	return data, meta, err
+}
+
+// tooLarge returns an error matching sentinel.ErrTooLarge for an object of
+// size bytes, or at least that many if it wasn't read in full.
+func tooLarge(size, max int64) error {
+	return fmt.Errorf("%w: %d bytes, more than the limit of %d bytes", sentinel.ErrTooLarge, size, max)
+}
+
+// List returns the keys directly under prefix, not descending past the next
+// "/" delimiter.
+func (c *Client) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := c.withRedirect(func(svc *s3.S3, opt request.Option) error {
+		keys = nil
+		return svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket:    &c.bucket,
+			Prefix:    &prefix,
+			Delimiter: aws.String("/"),
+		}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				if key := aws.StringValue(obj.Key); !strings.HasSuffix(key, "/") {
+					keys = append(keys, key)
+				}
+			}
+			return true
+		}, opt)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// IsPublic returns whether the object's ACL grants read access to all users
+// (or all authenticated AWS users, which is much the same thing).
+func (c *Client) IsPublic(ctx context.Context, key string) (bool, error) {
+	var out *s3.GetObjectAclOutput
+	err := c.withRedirect(func(svc *s3.S3, opt request.Option) (err error) {
+		out, err = svc.GetObjectAclWithContext(ctx, &s3.GetObjectAclInput{
+			Bucket: &c.bucket,
+			Key:    &key,
+		}, opt)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return grantsPublicRead(out.Grants), nil
+}
+
+// IsBucketPublic returns whether the bucket's ACL grants read access to all
+// users (or all authenticated AWS users).
+func (c *Client) IsBucketPublic(ctx context.Context) (bool, error) {
+	var out *s3.GetBucketAclOutput
+	err := c.withRedirect(func(svc *s3.S3, opt request.Option) (err error) {
+		out, err = svc.GetBucketAclWithContext(ctx, &s3.GetBucketAclInput{
+			Bucket: &c.bucket,
+		}, opt)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return grantsPublicRead(out.Grants), nil
+}
+
+// BucketEncryption returns the bucket's default server-side encryption
+// algorithm, e.g. "aws:kms", or "" if it has none.
+func (c *Client) BucketEncryption(ctx context.Context) (string, error) {
+	var out *s3.GetBucketEncryptionOutput
+	err := c.withRedirect(func(svc *s3.S3, opt request.Option) (err error) {
+		out, err = svc.GetBucketEncryptionWithContext(ctx, &s3.GetBucketEncryptionInput{
+			Bucket: &c.bucket,
+		}, opt)
+		return err
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "ServerSideEncryptionConfigurationNotFoundError" {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	if conf := out.ServerSideEncryptionConfiguration; conf != nil {
+		for _, rule := range conf.Rules {
+			if d := rule.ApplyServerSideEncryptionByDefault; d != nil && aws.StringValue(d.SSEAlgorithm) != "" {
+				return aws.StringValue(d.SSEAlgorithm), nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// grantsPublicRead returns whether any of grants gives read access to all
+// users (or all authenticated AWS users).
+func grantsPublicRead(grants []*s3.Grant) bool {
+	for _, grant := range grants {
+		if grant.Grantee == nil {
+			continue
+		}
+		switch aws.StringValue(grant.Grantee.URI) {
+		case groupAllUsers, groupAuthenticatedUsers:
+		default:
+			continue
+		}
+		switch aws.StringValue(grant.Permission) {
+		case s3.PermissionRead, s3.PermissionFullControl:
+			return true
+		}
+	}
+	return false
 }
 
 // BucketExists returns whether the bucket exists.
@@ -98,7 +540,11 @@ func (c *Client) Get(key string) ([]byte, error) {
 // 404 Not Found and 403 Forbidden return false without error.
 // Other errors result in false with an error.
 func (c *Client) BucketExists() (bool, error) {
-	if _, err := c.s3.HeadBucket(&s3.HeadBucketInput{Bucket: &c.bucket}); err != nil {
+	err := c.withRedirect(func(svc *s3.S3, opt request.Option) error {
+		_, err := svc.HeadBucketWithContext(aws.BackgroundContext(), &s3.HeadBucketInput{Bucket: &c.bucket}, opt)
+		return err
+	})
+	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
 			// https://github.com/aws/aws-sdk-go/issues/2593#issuecomment-491436818
@@ -0,0 +1,471 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sentinel"
+)
+
+// testClient returns a Client for bucket "bkt" on a server using handler,
+// and a function to clean up after it.
+func testClient(t *testing.T, handler http.HandlerFunc) (*Client, *httptest.Server, func()) {
+	return testClientWithConfig(t, handler, Config{})
+}
+
+// testClientWithConfig is testClient with conf, other than its endpoint.
+func testClientWithConfig(t *testing.T, handler http.HandlerFunc, conf Config) (*Client, *httptest.Server, func()) {
+	server := httptest.NewServer(handler)
+	env := map[string]string{
+		envDefaultRegion:        "ap-southeast-2",
+		"AWS_ACCESS_KEY_ID":     "AKIAEXAMPLE",
+		"AWS_SECRET_ACCESS_KEY": "example",
+	}
+	restore := make(map[string]string, len(env))
+	for name, value := range env {
+		restore[name] = os.Getenv(name)
+		os.Setenv(name, value)
+	}
+	cleanup := func() {
+		server.Close()
+		for name, value := range restore {
+			os.Setenv(name, value)
+		}
+	}
+
+	conf.Endpoint = server.URL
+	conf.ForcePathStyle = true
+	c, err := New(log.New(ioutil.Discard, "", 0), "bkt", conf)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return c, server, cleanup
+}
+
+func TestEndpoint(t *testing.T) {
+	var paths []string
+	c, server, cleanup := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Method+" "+r.Host+r.URL.Path)
+		if r.Method == http.MethodGet {
+			w.Write([]byte("secret"))
+		}
+	})
+	defer cleanup()
+
+	if ok, err := c.BucketExists(); !ok || err != nil {
+		t.Errorf("expected bucket to exist, got %v, %v", ok, err)
+	}
+	data, err := c.Get(context.Background(), "pipeline/env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "secret" {
+		t.Errorf("expected %q, got %q", "secret", data)
+	}
+
+	host := server.Listener.Addr().String()
+	expected := []string{"HEAD " + host + "/bkt", "GET " + host + "/bkt/pipeline/env"}
+	if len(paths) != len(expected) || paths[0] != expected[0] || paths[1] != expected[1] {
+		t.Errorf("expected requests %q, got %q", expected, paths)
+	}
+}
+
+func TestHTTPClient(t *testing.T) {
+	var proxied []string
+	httpClient := &http.Client{Transport: &http.Transport{
+		Proxy: func(r *http.Request) (*url.URL, error) {
+			proxied = append(proxied, r.Method+" "+r.URL.Path)
+			return nil, nil
+		},
+	}}
+	c, _, cleanup := testClientWithConfig(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secret"))
+	}, Config{HTTPClient: httpClient})
+	defer cleanup()
+
+	data, err := c.Get(context.Background(), "pipeline/env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "secret" {
+		t.Errorf("expected %q, got %q", "secret", data)
+	}
+	if expected := []string{"GET /bkt/pipeline/env"}; len(proxied) != 1 || proxied[0] != expected[0] {
+		t.Errorf("expected requests %q through the HTTPClient, got %q", expected, proxied)
+	}
+}
+
+func TestGetErrors(t *testing.T) {
+	responses := map[string]struct {
+		status int
+		code   string
+	}{
+		"/bkt/no-such-key":   {http.StatusNotFound, "NoSuchKey"},
+		"/bkt/access-denied": {http.StatusForbidden, "AccessDenied"},
+		"/bkt/bare-404":      {http.StatusNotFound, ""},
+		"/bkt/bare-403":      {http.StatusForbidden, ""},
+		"/bkt/bad-request":   {http.StatusBadRequest, "InvalidRequest"},
+		"/bkt/slow-down":     {http.StatusServiceUnavailable, "SlowDown"},
+		"/bkt/internal":      {http.StatusInternalServerError, "InternalError"},
+		"/bkt/bare-502":      {http.StatusBadGateway, ""},
+	}
+	var gets int
+	c, _, cleanup := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		gets++
+		resp := responses[r.URL.Path]
+		w.WriteHeader(resp.status)
+		if resp.code != "" {
+			w.Write([]byte("<Error><Code>" + resp.code + "</Code><Message>nope</Message></Error>"))
+		}
+	})
+	defer cleanup()
+
+	for key, expected := range map[string]error{
+		"no-such-key":   sentinel.ErrNotFound,
+		"access-denied": sentinel.ErrForbidden,
+		"bare-404":      sentinel.ErrNotFound,
+		"bare-403":      sentinel.ErrForbidden,
+	} {
+		if _, err := c.Get(context.Background(), key); err != expected {
+			t.Errorf("%s: expected %v, got %v", key, expected, err)
+		}
+	}
+	if _, err := c.Get(context.Background(), "bad-request"); err == nil || err == sentinel.ErrNotFound || err == sentinel.ErrForbidden || errors.Is(err, sentinel.ErrTransient) {
+		t.Errorf("bad-request: expected an unclassified error, got %v", err)
+	}
+
+	for _, key := range []string{"slow-down", "internal", "bare-502"} {
+		gets = 0
+		if _, err := c.Get(context.Background(), key); !errors.Is(err, sentinel.ErrTransient) {
+			t.Errorf("%s: expected a transient error, got %v", key, err)
+		}
+		if gets != 1 {
+			t.Errorf("%s: expected the SDK not to retry, got %d requests", key, gets)
+		}
+	}
+}
+
+func TestGetWithMetadata(t *testing.T) {
+	c, _, cleanup := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Amz-Meta-X-Amz-Wrap-Alg", "kms")
+		w.Header().Set("X-Amz-Meta-Owner", "Platform")
+		w.Write([]byte("secret"))
+	})
+	defer cleanup()
+
+	data, meta, err := c.GetWithMetadata(context.Background(), "pipeline/env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "secret" {
+		t.Errorf("expected %q, got %q", "secret", data)
+	}
+	if meta["x-amz-wrap-alg"] != "kms" || meta["owner"] != "Platform" {
+		t.Errorf("unexpected metadata %q", meta)
+	}
+	if meta["content-length"] != "6" {
+		t.Errorf("expected content-length 6, got %q", meta["content-length"])
+	}
+}
+
+func TestGetVersion(t *testing.T) {
+	c, _, cleanup := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if v := r.URL.Query().Get("versionId"); v != "v1" {
+			t.Errorf("expected versionId v1, got %q", v)
+		}
+		w.Header().Set("X-Amz-Version-Id", "v1")
+		w.Write([]byte("secret"))
+	})
+	defer cleanup()
+
+	data, meta, err := c.GetVersion(context.Background(), "pipeline/env", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "secret" || meta["x-amz-version-id"] != "v1" {
+		t.Errorf("expected secret, version v1, got %q, %q", data, meta["x-amz-version-id"])
+	}
+}
+
+func TestRegionRedirect(t *testing.T) {
+	var requests []string
+	c, _, cleanup := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		// the region is part of the credential scope of the signature
+		region := "us-west-2"
+		if !strings.Contains(r.Header.Get("Authorization"), "/"+region+"/s3/") {
+			region = "wrong"
+		}
+		requests = append(requests, r.Method+" "+region)
+		if region == "wrong" {
+			w.Header().Set("x-amz-bucket-region", "us-west-2")
+			w.WriteHeader(http.StatusMovedPermanently)
+			if r.Method == http.MethodGet {
+				w.Write([]byte(`<Error><Code>PermanentRedirect</Code><Message>The bucket you are attempting to access must be addressed using the specified endpoint.</Message></Error>`))
+			}
+			return
+		}
+		w.Write([]byte("secret"))
+	})
+	defer cleanup()
+
+	if exists, err := c.BucketExists(); err != nil || !exists {
+		t.Fatalf("expected the bucket to exist in another region, got %v, %v", exists, err)
+	}
+	if c.Region() != "us-west-2" {
+		t.Errorf("expected the client to switch to us-west-2, got %q", c.Region())
+	}
+	if data, err := c.Get(context.Background(), "pipeline/env"); err != nil || string(data) != "secret" {
+		t.Errorf("expected the object to be got from us-west-2, got %q, %v", data, err)
+	}
+	expected := []string{"HEAD wrong", "HEAD us-west-2", "GET us-west-2"}
+	if strings.Join(requests, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("expected requests %v, got %v", expected, requests)
+	}
+}
+
+func TestGetTruncated(t *testing.T) {
+	c, _, cleanup := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "12")
+		w.Write([]byte("secret"))
+	})
+	defer cleanup()
+
+	if _, err := c.Get(context.Background(), "pipeline/env"); !errors.Is(err, sentinel.ErrTransient) {
+		t.Errorf("expected a transient error for a truncated download, got %v", err)
+	}
+}
+
+// fakeSTS issues credentials for any role.
+type fakeSTS struct {
+	inputs []*sts.AssumeRoleInput
+}
+
+func (f *fakeSTS) AssumeRole(in *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	f.inputs = append(f.inputs, in)
+	return &sts.AssumeRoleOutput{Credentials: &sts.Credentials{
+		AccessKeyId:     aws.String("ASIAROLE"),
+		SecretAccessKey: aws.String("secret"),
+		SessionToken:    aws.String("token"),
+		Expiration:      aws.Time(time.Now().Add(time.Hour)),
+	}}, nil
+}
+
+func TestAssumeRole(t *testing.T) {
+	fake := &fakeSTS{}
+	defer func(f func(client.ConfigProvider) stscreds.AssumeRoler) { newAssumeRoler = f }(newAssumeRoler)
+	newAssumeRoler = func(client.ConfigProvider) stscreds.AssumeRoler { return fake }
+
+	var auth []string
+	c, _, cleanup := testClientWithConfig(t, func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get("Authorization"))
+		w.Write([]byte("secret"))
+	}, Config{
+		AssumeRoleARN: "arn:aws:iam::123456789012:role/SecretsReader",
+		ExternalID:    "buildkite",
+	})
+	defer cleanup()
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.Get(context.Background(), "pipeline/env"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(fake.inputs) != 1 {
+		t.Fatalf("expected the role to be assumed once, got %d", len(fake.inputs))
+	}
+	in := fake.inputs[0]
+	if aws.StringValue(in.RoleArn) != "arn:aws:iam::123456789012:role/SecretsReader" ||
+		aws.StringValue(in.ExternalId) != "buildkite" ||
+		aws.StringValue(in.RoleSessionName) != defaultSessionName {
+		t.Errorf("unexpected AssumeRole input %v", in)
+	}
+	for _, a := range auth {
+		if !strings.Contains(a, "Credential=ASIAROLE/") {
+			t.Errorf("expected request signed with the role's credentials, got %q", a)
+		}
+	}
+}
+
+func TestWebIdentity(t *testing.T) {
+	// The fake STS issues credentials that have already expired, so each
+	// request retrieves them again, reading the token file each time.
+	var tokens []string
+	stsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("Action") != "AssumeRoleWithWebIdentity" ||
+			r.Form.Get("RoleArn") != "arn:aws:iam::123456789012:role/SecretsReader" {
+			t.Errorf("unexpected STS request %v", r.Form)
+		}
+		tokens = append(tokens, r.Form.Get("WebIdentityToken"))
+		fmt.Fprintf(w, `<AssumeRoleWithWebIdentityResponse><AssumeRoleWithWebIdentityResult><Credentials>
+<AccessKeyId>ASIAWEB</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>token</SessionToken>
+<Expiration>%s</Expiration></Credentials></AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResponse>`,
+			time.Now().Add(-time.Minute).UTC().Format(time.RFC3339))
+	}))
+	defer stsServer.Close()
+	defer func(f func(client.ConfigProvider) stsiface.STSAPI) { newWebIdentitySTS = f }(newWebIdentitySTS)
+	newWebIdentitySTS = func(p client.ConfigProvider) stsiface.STSAPI {
+		return sts.New(p, &aws.Config{Endpoint: aws.String(stsServer.URL)})
+	}
+
+	dir, err := ioutil.TempDir("", "web-identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("first"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var auth []string
+	c, _, cleanup := testClientWithConfig(t, func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get("Authorization"))
+		w.Write([]byte("secret"))
+	}, Config{
+		WebIdentityTokenFile: tokenFile,
+		WebIdentityRoleARN:   "arn:aws:iam::123456789012:role/SecretsReader",
+	})
+	defer cleanup()
+
+	if _, err := c.Get(context.Background(), "pipeline/env"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(tokenFile, []byte("second"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(context.Background(), "pipeline/env"); err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 || tokens[0] != "first" || tokens[1] != "second" {
+		t.Errorf("expected the rotated token to be used, got %q", tokens)
+	}
+	for _, a := range auth {
+		if !strings.Contains(a, "Credential=ASIAWEB/") {
+			t.Errorf("expected request signed with the web identity role's credentials, got %q", a)
+		}
+	}
+}
+
+func TestGetTooLarge(t *testing.T) {
+	for _, chunked := range []bool{false, true} {
+		c, _, cleanup := testClientWithConfig(t, func(w http.ResponseWriter, r *http.Request) {
+			if chunked {
+				// no Content-Length, so the body is read up to the limit.
+				w.(http.Flusher).Flush()
+			}
+			w.Write([]byte("0123456789"))
+		}, Config{MaxObjectBytes: 8})
+
+		_, err := c.Get(context.Background(), "pipeline/env")
+		cleanup()
+		if !errors.Is(err, sentinel.ErrTooLarge) {
+			t.Errorf("chunked %v: expected ErrTooLarge, got %v", chunked, err)
+		}
+	}
+}
+
+func TestBucketAudit(t *testing.T) {
+	const (
+		publicACL = `<AccessControlPolicy><AccessControlList><Grant>` +
+			`<Grantee xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:type="Group"><URI>http://acs.amazonaws.com/groups/global/AllUsers</URI></Grantee>` +
+			`<Permission>READ</Permission></Grant></AccessControlList></AccessControlPolicy>`
+		privateACL = `<AccessControlPolicy><AccessControlList><Grant>` +
+			`<Grantee xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:type="CanonicalUser"><ID>owner</ID></Grantee>` +
+			`<Permission>FULL_CONTROL</Permission></Grant></AccessControlList></AccessControlPolicy>`
+		kmsEncryption = `<ServerSideEncryptionConfiguration><Rule><ApplyServerSideEncryptionByDefault>` +
+			`<SSEAlgorithm>aws:kms</SSEAlgorithm></ApplyServerSideEncryptionByDefault></Rule></ServerSideEncryptionConfiguration>`
+		noEncryption = `<Error><Code>ServerSideEncryptionConfigurationNotFoundError</Code>` +
+			`<Message>The server side encryption configuration was not found</Message></Error>`
+	)
+	for _, tc := range []struct {
+		acl, encryption string
+		public          bool
+		algorithm       string
+	}{
+		{publicACL, kmsEncryption, true, "aws:kms"},
+		{privateACL, noEncryption, false, ""},
+	} {
+		c, _, cleanup := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+			switch q := r.URL.Query(); {
+			case q["acl"] != nil:
+				w.Write([]byte(tc.acl))
+			case q["encryption"] != nil && tc.encryption == noEncryption:
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(tc.encryption))
+			case q["encryption"] != nil:
+				w.Write([]byte(tc.encryption))
+			}
+		})
+		public, err := c.IsBucketPublic(context.Background())
+		if err != nil {
+			t.Error(err)
+		} else if public != tc.public {
+			t.Errorf("expected public %v, got %v", tc.public, public)
+		}
+		algorithm, err := c.BucketEncryption(context.Background())
+		if err != nil {
+			t.Error(err)
+		} else if algorithm != tc.algorithm {
+			t.Errorf("expected encryption %q, got %q", tc.algorithm, algorithm)
+		}
+		cleanup()
+	}
+}
+
+func TestContextCancelled(t *testing.T) {
+	c, _, cleanup := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		// hangs until the request is abandoned.
+		<-r.Context().Done()
+	})
+	defer cleanup()
+	for name, call := range map[string]func(context.Context) error{
+		"List": func(ctx context.Context) error {
+			_, err := c.List(ctx, "pipeline/")
+			return err
+		},
+		"IsPublic": func(ctx context.Context) error {
+			_, err := c.IsPublic(ctx, "pipeline/env")
+			return err
+		},
+		"IsBucketPublic": func(ctx context.Context) error {
+			_, err := c.IsBucketPublic(ctx)
+			return err
+		},
+		"BucketEncryption": func(ctx context.Context) error {
+			_, err := c.BucketEncryption(ctx)
+			return err
+		},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		done := make(chan error, 1)
+		go func() { done <- call(ctx) }()
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Errorf("%s: expected an error once cancelled", name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: expected cancelling its context to stop it", name)
+		}
+		cancel()
+	}
+}
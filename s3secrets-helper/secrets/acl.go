@@ -0,0 +1,76 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+)
+
+// BucketAuditor is an optional Client capability to check the configuration
+// of the bucket itself; see Config.AuditBucket.
+type BucketAuditor interface {
+	// IsBucketPublic reports whether the bucket's ACL grants read access to
+	// everyone.
+	IsBucketPublic(ctx context.Context) (bool, error)
+
+	// BucketEncryption returns the bucket's default encryption algorithm,
+	// e.g. "aws:kms", or "" if it has none.
+	BucketEncryption(ctx context.Context) (string, error)
+}
+
+// ACLChecker is an optional Client capability to report whether an object is
+// publicly readable, e.g. via a public-read ACL.
+type ACLChecker interface {
+	IsPublic(ctx context.Context, key string) (bool, error)
+}
+
+// rejectPublic reports whether r must not be used because it is, or might
+// be, publicly readable. It fails closed; an object whose ACL can't be read
+// is rejected too.
+func rejectPublic(ctx context.Context, conf Config, r getResult) bool {
+	if !conf.RejectPublicObjects {
+		return false
+	}
+	public, err := conf.aclCheckers[r.bucket].IsPublic(ctx, r.key)
+	if err != nil {
+		conf.log.Warn(
+			fmt.Sprintf("Refusing to use %s/%s; failed to check its ACL: %v", r.bucket, r.key, err),
+			bucketField(r.bucket), keyField(r.key), errField(err),
+		)
+		return true
+	}
+	if public {
+		conf.log.Warn(
+			fmt.Sprintf("Refusing to use %s/%s; it is publicly readable, so should be considered compromised", r.bucket, r.key),
+			bucketField(r.bucket), keyField(r.key),
+		)
+		return true
+	}
+	return false
+}
+
+// auditBucket warns about misconfiguration of the bucket of c which puts its
+// secrets at risk; see Config.AuditBucket. Failures are only logged.
+func auditBucket(ctx context.Context, conf Config, c Client) {
+	bucket := c.Bucket()
+	auditor, ok := c.(BucketAuditor)
+	if !ok {
+		conf.log.Warn(fmt.Sprintf("Can't audit bucket %q; its Client can't check bucket configuration", bucket), bucketField(bucket))
+		return
+	}
+	if public, err := auditor.IsBucketPublic(ctx); err != nil {
+		conf.log.Warn(fmt.Sprintf("Failed to check the ACL of bucket %q: %v", bucket, err), bucketField(bucket), errField(err))
+	} else if public {
+		conf.log.Warn(
+			fmt.Sprintf("Bucket %q is publicly readable, so the secrets in it should be considered compromised; remove its public ACL grants", bucket),
+			bucketField(bucket),
+		)
+	}
+	if algorithm, err := auditor.BucketEncryption(ctx); err != nil {
+		conf.log.Warn(fmt.Sprintf("Failed to check the encryption of bucket %q: %v", bucket, err), bucketField(bucket), errField(err))
+	} else if algorithm == "" {
+		conf.log.Warn(
+			fmt.Sprintf("Bucket %q doesn't have default encryption; configure it so that secrets are encrypted at rest", bucket),
+			bucketField(bucket),
+		)
+	}
+}
@@ -0,0 +1,115 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// bucketClients returns a Client for each bucket to search, in order; see
+// Config.Buckets.
+func bucketClients(conf Config) ([]Client, error) {
+	if len(conf.Buckets) == 0 {
+		return []Client{conf.Client}, nil
+	}
+	clients := make([]Client, 0, len(conf.Buckets))
+	for _, b := range conf.Buckets {
+		if conf.Client != nil && conf.Client.Bucket() == b {
+			clients = append(clients, conf.Client)
+			continue
+		}
+		if conf.NewClient == nil {
+			return nil, fmt.Errorf("NewClient is required to search bucket %q", b)
+		}
+		c, err := conf.NewClient(b)
+		if err != nil {
+			return nil, fmt.Errorf("creating client for bucket %q: %w", b, err)
+		}
+		clients = append(clients, c)
+	}
+	return clients, nil
+}
+
+// checkBuckets returns the clients whose buckets exist, or an error if none
+// do, or any couldn't be checked.
+func checkBuckets(ctx context.Context, conf Config, clients []Client) ([]Client, error) {
+	var existing []Client
+	for _, c := range clients {
+		if err := checkBucket(ctx, conf, c); err == nil {
+			existing = append(existing, c)
+		} else if len(clients) == 1 || !errors.Is(err, ErrBucketNotFound) {
+			return nil, err
+		}
+	}
+	if len(existing) == 0 {
+		return nil, withKind(ErrBucketNotFound, fmt.Errorf("none of the S3 buckets %s were found", strings.Join(bucketNames(clients), ", ")))
+	}
+	return existing, nil
+}
+
+// checkBucket returns an error unless the client's bucket exists, auditing it
+// if it does and AuditBucket is set. Only a bucket found not to exist is
+// ErrBucketNotFound; failing to check, e.g. a network error, is
+// ErrDownloadFailed, as it may succeed if retried.
+func checkBucket(ctx context.Context, conf Config, c Client) error {
+	bucket := c.Bucket()
+	ok, err := c.BucketExists()
+	if err != nil {
+		conf.log.Warn(fmt.Sprintf("Failed to check bucket %q exists: %v", bucket, err), bucketField(bucket), errField(err))
+		return withKind(ErrDownloadFailed, fmt.Errorf("checking S3 bucket %q exists: %w", bucket, err))
+	}
+	if !ok {
+		conf.log.Warn(fmt.Sprintf("Bucket %q doesn't exist", bucket), bucketField(bucket))
+		return withKind(ErrBucketNotFound, fmt.Errorf("S3 bucket %q not found", bucket))
+	}
+	if conf.AuditBucket {
+		auditBucket(ctx, conf, c)
+	}
+	return nil
+}
+
+func bucketNames(clients []Client) []string {
+	names := make([]string, len(clients))
+	for i, c := range clients {
+		names[i] = c.Bucket()
+	}
+	return names
+}
+
+// getFirst fetches key from the first of clients whose bucket has it. If
+// none do, the result is the first error other than NotFound or Forbidden,
+// if any, so that a failure isn't mistaken for an absent key.
+func getFirst(ctx context.Context, clients []Client, key string) getResult {
+	var first, failed *getResult
+	for _, c := range clients {
+		data, meta, err := getWithMetadata(ctx, c, key)
+		r := getResult{bucket: c.Bucket(), key: key, data: data, meta: meta, err: err}
+		if err == nil {
+			return r
+		}
+		if first == nil {
+			first = &r
+		}
+		if failed == nil && !absent(err) {
+			failed = &r
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if failed != nil {
+		return *failed
+	}
+	return *first
+}
+
+// clientFor returns the client for bucket.
+func clientFor(conf Config, bucket string) Client {
+	for _, c := range conf.clients {
+		if c.Bucket() == bucket {
+			return c
+		}
+	}
+	return conf.Client
+}
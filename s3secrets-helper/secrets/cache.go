@@ -0,0 +1,126 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sentinel"
+)
+
+// Cache holds downloaded secrets across Runs in the same process, so that
+// they're only downloaded once; see Config.Cache. Data is put as downloaded,
+// i.e. before any decryption, along with the object's metadata, which says
+// how it's decrypted.
+type Cache interface {
+	// Get returns a copy of the data cached for key in bucket, if any, as
+	// it's zeroed after use, and its metadata. If Config.CacheNotFound is
+	// set, nil data means the key wasn't found.
+	Get(bucket, key string) ([]byte, map[string]string, bool)
+
+	// Put caches data and its metadata, which it may keep, for key in
+	// bucket.
+	Put(bucket, key string, data []byte, meta map[string]string)
+}
+
+// MemoryCache is a Cache which holds secrets in memory for a TTL.
+type MemoryCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	data    []byte
+	meta    map[string]string
+	expires time.Time
+}
+
+// NewMemoryCache returns a MemoryCache whose entries expire after ttl.
+func NewMemoryCache(ttl time.Duration) *MemoryCache {
+	return &MemoryCache{ttl: ttl, entries: make(map[string]cacheEntry)}
+}
+
+func (m *MemoryCache) Get(bucket, key string) ([]byte, map[string]string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := bucket + "/" + key
+	e, ok := m.entries[id]
+	if !ok {
+		return nil, nil, false
+	}
+	if time.Now().After(e.expires) {
+		zero(e.data)
+		delete(m.entries, id)
+		return nil, nil, false
+	}
+	if e.data == nil {
+		return nil, nil, true
+	}
+	return append([]byte{}, e.data...), copyMetadata(e.meta), true
+}
+
+func (m *MemoryCache) Put(bucket, key string, data []byte, meta map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := bucket + "/" + key
+	if e, ok := m.entries[id]; ok {
+		zero(e.data)
+	}
+	m.entries[id] = cacheEntry{data: data, meta: meta, expires: time.Now().Add(m.ttl)}
+}
+
+// Purge zeroes and removes every entry.
+func (m *MemoryCache) Purge() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, e := range m.entries {
+		zero(e.data)
+		delete(m.entries, id)
+	}
+}
+
+// cacheClient serves Gets from a Cache, putting a copy of what it downloads
+// there.
+type cacheClient struct {
+	Client
+	cache    Cache
+	notFound bool // whether NotFound is cached
+	log      Logger
+}
+
+func (c *cacheClient) Get(ctx context.Context, key string) ([]byte, error) {
+	data, _, err := c.GetWithMetadata(ctx, key)
+	return data, err
+}
+
+func (c *cacheClient) GetWithMetadata(ctx context.Context, key string) ([]byte, map[string]string, error) {
+	if data, meta, ok := c.cache.Get(c.Bucket(), key); ok && data != nil {
+		c.log.Info(fmt.Sprintf("Loaded %s/%s from cache", c.Bucket(), key), bucketField(c.Bucket()), keyField(key))
+		return data, meta, nil
+	} else if ok && c.notFound {
+		return nil, nil, fmt.Errorf("%s/%s (cached): %w", c.Bucket(), key, sentinel.ErrNotFound)
+	}
+	data, meta, err := getWithMetadata(ctx, c.Client, key)
+	switch {
+	case err == nil:
+		c.cache.Put(c.Bucket(), key, append([]byte{}, data...), copyMetadata(meta))
+	case c.notFound && errors.Is(err, sentinel.ErrNotFound):
+		c.cache.Put(c.Bucket(), key, nil, nil)
+	}
+	return data, meta, err
+}
+
+func copyMetadata(meta map[string]string) map[string]string {
+	if meta == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(meta))
+	for k, v := range meta {
+		copied[k] = v
+	}
+	return copied
+}
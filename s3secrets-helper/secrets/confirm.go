@@ -0,0 +1,33 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+)
+
+// Confirmer asks for explicit confirmation, e.g. from a person via a
+// Buildkite block step, before production secrets are applied.
+type Confirmer interface {
+	Confirm(ctx context.Context, description string) (bool, error)
+}
+
+// confirmed reports whether r may be applied according to the Confirmer,
+// if r is one of the ProductionKeys. Like gateAllows, it fails closed.
+func confirmed(ctx context.Context, conf Config, r getResult) bool {
+	if conf.Confirmer == nil || !conf.productionKeys[r.key] {
+		return true
+	}
+	ok, err := conf.Confirmer.Confirm(ctx, fmt.Sprintf("Apply production secret %s/%s", r.bucket, r.key))
+	if err != nil {
+		conf.log.Warn(
+			fmt.Sprintf("Skipping %s/%s; failed to confirm it: %v", r.bucket, r.key, err),
+			bucketField(r.bucket), keyField(r.key), errField(err),
+		)
+		return false
+	}
+	if !ok {
+		conf.log.Info(fmt.Sprintf("Skipping %s/%s; applying it was declined", r.bucket, r.key), bucketField(r.bucket), keyField(r.key))
+		return false
+	}
+	return true
+}
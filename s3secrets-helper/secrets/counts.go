@@ -0,0 +1,52 @@
+package secrets
+
+import (
+	"fmt"
+	"strings"
+)
+
+// appliedCounts tallies the secrets of each type applied by a Run.
+type appliedCounts struct {
+	sshKeys        int
+	envFiles       int
+	gitCredentials int
+
+	envVars   []string // names of the env variables set, for OnEnvLoaded
+	envVarSet map[string]bool
+}
+
+// addEnvVars records the names of the variables set by env, in the order
+// they're first set.
+func (a *appliedCounts) addEnvVars(env []byte) {
+	if a.envVarSet == nil {
+		a.envVarSet = make(map[string]bool)
+	}
+	for _, kv := range parseEnv(env) {
+		if !a.envVarSet[kv[0]] {
+			a.envVarSet[kv[0]] = true
+			a.envVars = append(a.envVars, kv[0])
+		}
+	}
+}
+
+// checkCounts returns an error if the number of secrets of a type applied is
+// outside the bounds configured for it.
+func checkCounts(conf Config) error {
+	for _, c := range []struct {
+		what     string
+		n        int
+		min, max int
+	}{
+		{"SSH keys", conf.applied.sshKeys, conf.MinSSHKeys, conf.MaxSSHKeys},
+		{"env files", conf.applied.envFiles, conf.MinEnvFiles, conf.MaxEnvFiles},
+	} {
+		buckets := strings.Join(bucketNames(conf.clients), ", ")
+		if c.n < c.min {
+			return fmt.Errorf("found %d %s in %s, but at least %d are required", c.n, c.what, buckets, c.min)
+		}
+		if c.max > 0 && c.n > c.max {
+			return fmt.Errorf("found %d %s in %s, but at most %d are allowed", c.n, c.what, buckets, c.max)
+		}
+	}
+	return nil
+}
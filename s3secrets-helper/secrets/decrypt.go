@@ -0,0 +1,33 @@
+package secrets
+
+import "fmt"
+
+// Decryptor decrypts secrets which were encrypted before they were uploaded,
+// e.g. with age or sops; see Config.Decryptor. It's given every secret
+// downloaded, so must return those it doesn't recognise as encrypted as they
+// are. Otherwise, the ciphertext is zeroed once it has been decrypted.
+type Decryptor interface {
+	Decrypt(key string, ciphertext []byte) ([]byte, error)
+}
+
+// decrypt decrypts r with conf.Decryptor, if there is one. Secrets which
+// can't be decrypted are skipped, rather than used as they are.
+func decrypt(conf Config, r getResult) (getResult, bool) {
+	if conf.Decryptor == nil {
+		return r, true
+	}
+	plaintext, err := conf.Decryptor.Decrypt(r.key, r.data)
+	if err != nil {
+		conf.log.Warn(
+			fmt.Sprintf("Skipping %s/%s; failed to decrypt it: %v", r.bucket, r.key, err),
+			bucketField(r.bucket), keyField(r.key), errField(err),
+		)
+		zero(r.data)
+		return r, false
+	}
+	if len(plaintext) == 0 || len(r.data) == 0 || &plaintext[0] != &r.data[0] {
+		zero(r.data)
+	}
+	r.data = plaintext
+	return r, true
+}
@@ -0,0 +1,124 @@
+package secrets
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// orderCategories returns categories in the order they should be applied to
+// satisfy Config.DependsOn; categories are otherwise kept in their given
+// order. Dependency cycles, between keys or between the categories they
+// belong to, are an error.
+func orderCategories(conf Config, categories []*category) ([]*category, error) {
+	if len(conf.DependsOn) == 0 {
+		return categories, nil
+	}
+	if err := checkKeyCycles(conf.DependsOn); err != nil {
+		return nil, err
+	}
+
+	owner := make(map[string]int) // key -> index of its category
+	for i, c := range categories {
+		for _, k := range c.keys {
+			owner[k] = i
+		}
+	}
+
+	// after[i] holds the categories which must be applied after category i.
+	after := make([]map[int]bool, len(categories))
+	blockers := make([]int, len(categories))
+	for key, deps := range conf.DependsOn {
+		i, ok := owner[key]
+		if !ok {
+			conf.log.Warn(fmt.Sprintf("Ignoring dependencies of %s; it isn't a key being checked", key), keyField(key))
+			continue
+		}
+		for _, dep := range deps {
+			j, ok := owner[dep]
+			if !ok {
+				return nil, fmt.Errorf("%s depends on %s, which isn't a key being checked", key, dep)
+			}
+			if i == j {
+				continue // within a category, keys are applied in probe order
+			}
+			if after[j] == nil {
+				after[j] = make(map[int]bool)
+			}
+			if !after[j][i] {
+				after[j][i] = true
+				blockers[i]++
+			}
+		}
+	}
+
+	ordered := make([]*category, 0, len(categories))
+	done := make([]bool, len(categories))
+	for len(ordered) < len(categories) {
+		next := -1
+		for i := range categories {
+			if !done[i] && blockers[i] == 0 {
+				next = i
+				break
+			}
+		}
+		if next == -1 {
+			var names []string
+			for i, c := range categories {
+				if !done[i] {
+					names = append(names, c.name)
+				}
+			}
+			return nil, fmt.Errorf("secret dependencies can't be satisfied; %s depend on each other", strings.Join(names, ", "))
+		}
+		done[next] = true
+		ordered = append(ordered, categories[next])
+		for i := range after[next] {
+			blockers[i]--
+		}
+	}
+	return ordered, nil
+}
+
+// checkKeyCycles returns an error describing a dependency cycle between keys,
+// if there is one.
+func checkKeyCycles(dependsOn map[string][]string) error {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+	var stack []string
+	var visit func(key string) error
+	visit = func(key string) error {
+		switch state[key] {
+		case visiting:
+			return fmt.Errorf("secret dependency cycle: %s -> %s", strings.Join(stack, " -> "), key)
+		case visited:
+			return nil
+		}
+		state[key] = visiting
+		stack = append(stack, key)
+		for _, dep := range dependsOn[key] {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[key] = visited
+		return nil
+	}
+
+	// visit in sorted order so that the reported cycle is deterministic.
+	keys := make([]string, 0, len(dependsOn))
+	for k := range dependsOn {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := visit(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sentinel"
+)
+
+// listing is what was found by listing the bucket root and prefixes of a
+// bucket; see Config.DiscoverKeys.
+type listing struct {
+	// dirs are the directories listed, e.g. "" and "my-pipeline/".
+	dirs map[string]bool
+	keys map[string]bool
+}
+
+// exists reports whether key may exist: it was listed, or it's in a
+// directory which wasn't.
+func (l *listing) exists(key string) bool {
+	return l.keys[key] || !l.dirs[key[:strings.LastIndex(key, "/")+1]]
+}
+
+// listBuckets lists the bucket root and the directory of each prefix in each
+// of clients, which must be Listers, returning the listings by bucket. A
+// directory which can't be listed (e.g. without s3:ListBucket) is left out,
+// so that keys in it are probed for as usual.
+func listBuckets(ctx context.Context, conf Config, clients []Client) (map[string]*listing, error) {
+	dirs := []string{""}
+	seen := map[string]bool{"": true}
+	for _, p := range prefixed(conf, []string{""}) {
+		dir := p[:strings.LastIndex(p, "/")+1]
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	listings := make(map[string]*listing, len(clients))
+	for _, c := range clients {
+		lister, ok := c.(Lister)
+		if !ok {
+			return nil, errors.New("DiscoverKeys requires a Client that can list keys")
+		}
+		l := &listing{dirs: map[string]bool{}, keys: map[string]bool{}}
+		for _, dir := range dirs {
+			keys, err := lister.List(ctx, dir)
+			if err != nil {
+				conf.log.Warn(
+					fmt.Sprintf("Failed to list %s/%s, so probing for keys in it instead: %v", c.Bucket(), dir, err),
+					bucketField(c.Bucket()), Field{"prefix", dir}, errField(err),
+				)
+				continue
+			}
+			l.dirs[dir] = true
+			for _, k := range keys {
+				l.keys[k] = true
+			}
+		}
+		listings[c.Bucket()] = l
+	}
+	return listings, nil
+}
+
+// discoveryClient doesn't get keys which weren't found by listing their
+// directory, so that absent keys aren't requested at all; see DiscoverKeys.
+// Pinned keys are always got, as the version pinned may not be the latest.
+type discoveryClient struct {
+	Client
+	listing *listing
+	pinned  map[string]string
+}
+
+func (c *discoveryClient) Get(ctx context.Context, key string) ([]byte, error) {
+	data, _, err := c.GetWithMetadata(ctx, key)
+	return data, err
+}
+
+func (c *discoveryClient) GetWithMetadata(ctx context.Context, key string) ([]byte, map[string]string, error) {
+	if _, pinned := c.pinned[key]; !pinned && !c.listing.exists(key) {
+		return nil, nil, fmt.Errorf("%s/%s wasn't listed: %w", c.Bucket(), key, sentinel.ErrNotFound)
+	}
+	return getWithMetadata(ctx, c.Client, key)
+}
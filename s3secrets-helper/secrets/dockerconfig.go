@@ -0,0 +1,111 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+var defaultDockerConfigNames = []string{"docker-config.json"}
+
+func dockerConfigCandidates(conf Config) []string {
+	return dedupeKeys(normalizeKeys(conf, rootAndPrefixed(conf, defaultDockerConfigNames)))
+}
+
+// mergeDockerConfig merges the docker config src into dst, whose registries
+// in "auths" it overrides one by one. Its other settings replace dst's.
+func mergeDockerConfig(dst, src map[string]json.RawMessage) error {
+	for k, v := range src {
+		if k != "auths" || dst[k] == nil {
+			dst[k] = v
+			continue
+		}
+		var auths, srcAuths map[string]json.RawMessage
+		if err := json.Unmarshal(dst[k], &auths); err != nil {
+			return fmt.Errorf("auths: %w", err)
+		}
+		if err := json.Unmarshal(v, &srcAuths); err != nil {
+			return fmt.Errorf("auths: %w", err)
+		}
+		for registry, auth := range srcAuths {
+			auths[registry] = auth
+		}
+		merged, err := json.Marshal(auths)
+		if err != nil {
+			return err
+		}
+		dst[k] = merged
+	}
+	return nil
+}
+
+// handleDockerConfig merges each docker-config.json found into the docker
+// config at DockerConfigPath, so docker can pull from private registries.
+// Those found later, i.e. the more specific, override the registries of
+// earlier ones, and the config already at DockerConfigPath.
+func handleDockerConfig(ctx context.Context, conf Config, results <-chan getResult) error {
+	log := conf.log
+	config := map[string]json.RawMessage{}
+	existing, err := ioutil.ReadFile(conf.DockerConfigPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("reading docker config: %w", err)
+	}
+	if len(existing) > 0 {
+		if err := json.Unmarshal(existing, &config); err != nil {
+			return fmt.Errorf("reading docker config %s: %w", conf.DockerConfigPath, err)
+		}
+	}
+	zero(existing)
+
+	found := false
+	for r := range results {
+		if r.err != nil {
+			if !absent(r.err) {
+				log.Warn(
+					fmt.Sprintf("Failed to download docker config %s/%s: %v", r.bucket, r.key, r.err),
+					typeField(CategoryDockerConfig), bucketField(r.bucket), keyField(r.key), errField(r.err),
+				)
+			}
+			continue
+		}
+		r, ok := prepare(ctx, conf, CategoryDockerConfig, r)
+		if !ok {
+			continue
+		}
+		var src map[string]json.RawMessage
+		err := json.Unmarshal(r.data, &src)
+		if err == nil {
+			err = mergeDockerConfig(config, src)
+		}
+		zero(r.data)
+		if err != nil {
+			// the error could quote the secret, so it isn't logged.
+			log.Warn(
+				fmt.Sprintf("Skipping %s/%s; it isn't a valid docker config", r.bucket, r.key),
+				typeField(CategoryDockerConfig), bucketField(r.bucket), keyField(r.key),
+			)
+			continue
+		}
+		msg := fmt.Sprintf("Adding docker config %s/%s to %s", r.bucket, r.key, conf.DockerConfigPath)
+		if conf.DryRun {
+			msg = fmt.Sprintf("(dry-run) would add docker config %s/%s to %s", r.bucket, r.key, conf.DockerConfigPath)
+		}
+		log.Info(msg, typeField(CategoryDockerConfig), bucketField(r.bucket), keyField(r.key), Field{"dry_run", conf.DryRun})
+		found = true
+		conf.results.apply(CategoryDockerConfig, r.bucket, r.key)
+	}
+	if !found || conf.DryRun {
+		return nil
+	}
+	data, err := json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		return err
+	}
+	defer zero(data)
+	if err := writeFile(conf.DockerConfigPath, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("writing docker config: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package secrets
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// EnvFormat is the format of env files; see Config.EnvFormat.
+type EnvFormat string
+
+const (
+	// EnvFormatRaw env files are output verbatim, so must be in the format
+	// EnvSink expects. This is the default.
+	EnvFormatRaw EnvFormat = "raw"
+
+	// EnvFormatDotenv env files are parsed as dotenv files, with comments,
+	// "export" and quoted values, and output as NAME='value' lines.
+	EnvFormatDotenv EnvFormat = "dotenv"
+)
+
+// dotenvEscapes are the escape sequences understood in double-quoted values.
+var dotenvEscapes = map[byte]byte{
+	'n': '\n', 'r': '\r', 't': '\t', '"': '"', '\\': '\\', '$': '$', '`': '`',
+}
+
+// formatEnv converts an env file from conf.EnvFormat to the format EnvSink
+// expects. If it is converted, data is zeroed. A parse error names the line
+// number, but not its contents, which may be secret.
+func formatEnv(conf Config, data []byte) ([]byte, error) {
+	switch conf.EnvFormat {
+	case "", EnvFormatRaw:
+		return data, nil
+	case EnvFormatDotenv:
+	default:
+		return nil, fmt.Errorf("unknown env format %q", conf.EnvFormat)
+	}
+	defer zero(data)
+	vars, err := parseDotenv(data)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	for _, kv := range vars {
+		fmt.Fprintf(&out, "%s=%s\n", kv[0], shellQuote(kv[1]))
+	}
+	return out.Bytes(), nil
+}
+
+// parseDotenv returns the variables assigned by a dotenv file, in order.
+func parseDotenv(data []byte) ([][2]string, error) {
+	var vars [][2]string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "export ") {
+			line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+		}
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: expected NAME=value", n)
+		}
+		name := strings.TrimSpace(line[:i])
+		if !regexpEnvName.MatchString(name) {
+			return nil, fmt.Errorf("line %d: invalid variable name", n)
+		}
+		value, err := parseDotenvValue(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", n, name, err)
+		}
+		vars = append(vars, [2]string{name, value})
+	}
+	return vars, scanner.Err()
+}
+
+// parseDotenvValue parses a value, which may be single-quoted (literally),
+// double-quoted (with backslash escapes), or unquoted, and may be followed by
+// a comment.
+func parseDotenvValue(v string) (string, error) {
+	if v == "" {
+		return "", nil
+	}
+	var value strings.Builder
+	var rest string
+	switch quote := v[0]; quote {
+	case '\'':
+		end := strings.IndexByte(v[1:], '\'')
+		if end < 0 {
+			return "", errors.New("unterminated single quote")
+		}
+		value.WriteString(v[1 : end+1])
+		rest = v[end+2:]
+	case '"':
+		i := 1
+		for ; i < len(v) && v[i] != '"'; i++ {
+			if v[i] != '\\' {
+				value.WriteByte(v[i])
+				continue
+			}
+			if i++; i == len(v) {
+				break
+			}
+			if c, ok := dotenvEscapes[v[i]]; ok {
+				value.WriteByte(c)
+			} else {
+				value.WriteByte('\\')
+				value.WriteByte(v[i])
+			}
+		}
+		if i >= len(v) {
+			return "", errors.New("unterminated double quote")
+		}
+		rest = v[i+1:]
+	default:
+		// an unquoted value ends at a comment.
+		if i := strings.Index(v, " #"); i >= 0 {
+			v = v[:i]
+		}
+		return strings.TrimSpace(v), nil
+	}
+	if rest = strings.TrimSpace(rest); rest != "" && !strings.HasPrefix(rest, "#") {
+		return "", errors.New("unexpected characters after closing quote")
+	}
+	return value.String(), nil
+}
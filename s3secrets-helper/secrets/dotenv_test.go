@@ -0,0 +1,64 @@
+package secrets
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDotenv(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		input    string
+		expected [][2]string
+		err      string
+	}{
+		{"plain", "A=one", [][2]string{{"A", "one"}}, ""},
+		{"export", "export A=one", [][2]string{{"A", "one"}}, ""},
+		{"comments and blank lines", "# comment\n\nA=one\n  # indented\n", [][2]string{{"A", "one"}}, ""},
+		{"spaces around =", "A = one", [][2]string{{"A", "one"}}, ""},
+		{"empty", "A=", [][2]string{{"A", ""}}, ""},
+		{"inline comment", "A=one # comment", [][2]string{{"A", "one"}}, ""},
+		{"hash in unquoted value", "A=one#two", [][2]string{{"A", "one#two"}}, ""},
+		{"double quoted", `A="value with spaces"`, [][2]string{{"A", "value with spaces"}}, ""},
+		{"double quoted escapes", `A="a\"b\\c\nd\te\$f"`, [][2]string{{"A", "a\"b\\c\nd\te$f"}}, ""},
+		{"double quoted unknown escape", `A="a\qb"`, [][2]string{{"A", `a\qb`}}, ""},
+		{"double quoted hash", `A="one # two" # comment`, [][2]string{{"A", "one # two"}}, ""},
+		{"single quoted", `A='it is $literal \n'`, [][2]string{{"A", `it is $literal \n`}}, ""},
+		{"single quoted double quote", `A='say "hi"'`, [][2]string{{"A", `say "hi"`}}, ""},
+		{"double quoted single quote", `A="it's"`, [][2]string{{"A", "it's"}}, ""},
+		{"several", "A=1\nexport B='2'\nC=\"3\"", [][2]string{{"A", "1"}, {"B", "2"}, {"C", "3"}}, ""},
+		{"no =", "A=1\nnonsense", nil, "line 2: expected NAME=value"},
+		{"invalid name", "1A=one", nil, "line 1: invalid variable name"},
+		{"unterminated double quote", "\nA=\"one", nil, "line 2: A: unterminated double quote"},
+		{"escaped closing quote", `A="one\"`, nil, "line 1: A: unterminated double quote"},
+		{"unterminated single quote", "A='one", nil, "line 1: A: unterminated single quote"},
+		{"trailing characters", `A="one"two`, nil, "line 1: A: unexpected characters after closing quote"},
+	} {
+		vars, err := parseDotenv([]byte(tc.input))
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: expected error %q, got %v", tc.name, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		} else if !reflect.DeepEqual(tc.expected, vars) {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.expected, vars)
+		}
+	}
+}
+
+func TestFormatEnvDotenv(t *testing.T) {
+	out, err := formatEnv(Config{EnvFormat: EnvFormatDotenv}, []byte(`export A="it's here"`+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `A='it'\''s here'` + "\n"; string(out) != expected {
+		t.Errorf("expected %q, got %q", expected, out)
+	}
+	if _, err := formatEnv(Config{EnvFormat: "yaml"}, nil); err == nil || !strings.Contains(err.Error(), "yaml") {
+		t.Errorf("expected error for unknown format, got %v", err)
+	}
+}
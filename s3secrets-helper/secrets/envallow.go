@@ -0,0 +1,94 @@
+package secrets
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// envAllowlist tracks which of Config.EnvAllowlist were found in env files.
+type envAllowlist struct {
+	allowed map[string]bool
+	found   map[string]bool
+}
+
+func newEnvAllowlist(conf Config) *envAllowlist {
+	if len(conf.EnvAllowlist) == 0 {
+		return nil
+	}
+	a := &envAllowlist{allowed: make(map[string]bool), found: make(map[string]bool)}
+	for _, name := range conf.EnvAllowlist {
+		a.allowed[name] = true
+	}
+	return a
+}
+
+// filter returns the assignments of allowed variables in env file r's data,
+// zeroing data. As an env file is evaluated by the shell, one which doesn't
+// parse as plain assignments could set variables which aren't allowed, so is
+// skipped as a whole. If a is nil, everything is allowed and data is returned
+// as is.
+func (a *envAllowlist) filter(conf Config, r getResult, data []byte) []byte {
+	if a == nil {
+		return data
+	}
+	defer zero(data)
+	assignments, err := parseEnvAssignments(data)
+	if err != nil {
+		conf.log.Warn(
+			fmt.Sprintf("Skipping env %s/%s; %v, so the env allowlist can't be applied", r.bucket, r.key, err),
+			typeField(CategoryEnv), bucketField(r.bucket), keyField(r.key), errField(err),
+		)
+		return nil
+	}
+	var out bytes.Buffer
+	for _, v := range assignments {
+		if !a.allowed[v.name] {
+			conf.log.Debug(
+				fmt.Sprintf("Skipping %s from env %s/%s; it isn't in the allowlist", v.name, r.bucket, r.key),
+				typeField(CategoryEnv), bucketField(r.bucket), keyField(r.key), Field{"name", v.name},
+			)
+			continue
+		}
+		a.found[v.name] = true
+		out.Write(data[v.start:v.end])
+		if data[v.end-1] != '\n' {
+			out.WriteByte('\n')
+		}
+	}
+	return out.Bytes()
+}
+
+// logMissing logs each allowed variable which wasn't in any env file.
+func (a *envAllowlist) logMissing(conf Config) {
+	if a == nil {
+		return
+	}
+	for _, name := range conf.EnvAllowlist {
+		if !a.found[name] {
+			conf.log.Info(
+				fmt.Sprintf("%s is in the env allowlist, but isn't in any env file", name),
+				typeField(CategoryEnv), Field{"name", name},
+			)
+		}
+	}
+}
+
+// envLineName returns the name of the variable assigned by a line of an env
+// file, or "" if it doesn't assign one.
+func envLineName(line string) string {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "#") {
+		return ""
+	}
+	line = strings.TrimPrefix(line, "export ")
+	i := strings.IndexByte(line, '=')
+	if i <= 0 {
+		return ""
+	}
+	name := strings.TrimSpace(line[:i])
+	if !regexpEnvName.MatchString(name) {
+		return ""
+	}
+	return name
+}
@@ -0,0 +1,189 @@
+package secrets
+
+import (
+	"errors"
+	"fmt"
+)
+
+// envAssignment is a NAME=value statement of an env file.
+type envAssignment struct {
+	name       string
+	start, end int // the statement's bytes, including its newline
+}
+
+// parseEnvAssignments returns the assignments of an env file, in order. The
+// file may only hold blank lines, comments, and [export ]NAME=value
+// statements, one per line, though a quoted value may span lines. A value
+// may be quoted and refer to $NAME or ${NAME}, but no other shell syntax is
+// allowed, as anything which could run a command or assign another variable,
+// e.g. "A=1; PATH=/tmp", would defeat filtering env files by name. An error
+// names the line, but not its contents, which may be secret.
+func parseEnvAssignments(data []byte) ([]envAssignment, error) {
+	var assignments []envAssignment
+	i, line := 0, 1
+	for i < len(data) {
+		start := i
+		i = skipEnvBlanks(data, i)
+		switch {
+		case i == len(data):
+			continue
+		case data[i] == '\n':
+			i++
+			line++
+			continue
+		case data[i] == '#':
+			i = skipEnvComment(data, i)
+			continue
+		}
+		if hasEnvPrefix(data[i:], "export ") {
+			i = skipEnvBlanks(data, i+len("export "))
+		}
+		j := i
+		for j < len(data) && isEnvNameByte(data[j]) {
+			j++
+		}
+		name := string(data[i:j])
+		if j == len(data) || data[j] != '=' || !regexpEnvName.MatchString(name) {
+			return nil, fmt.Errorf("line %d: expected NAME=value", line)
+		}
+		n := line
+		var err error
+		if i, line, err = scanEnvValue(data, j+1, line); err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", n, name, err)
+		}
+		if i = skipEnvBlanks(data, i); i < len(data) && data[i] == '#' {
+			i = skipEnvComment(data, i)
+		}
+		if i < len(data) {
+			if data[i] != '\n' {
+				return nil, fmt.Errorf("line %d: %s: unexpected characters after the value", line, name)
+			}
+			i++
+			line++
+		}
+		assignments = append(assignments, envAssignment{name: name, start: start, end: i})
+	}
+	return assignments, nil
+}
+
+// scanEnvValue returns the index just past the value starting at data[i],
+// and the line it ends on.
+func scanEnvValue(data []byte, i, line int) (int, int, error) {
+	for i < len(data) {
+		switch c := data[i]; {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			return i, line, nil
+		case c == '\'':
+			i++
+			for i < len(data) && data[i] != '\'' {
+				if data[i] == '\n' {
+					line++
+				}
+				i++
+			}
+			if i == len(data) {
+				return i, line, errors.New("unterminated single quote")
+			}
+			i++
+		case c == '"':
+			i++
+			for i < len(data) && data[i] != '"' {
+				switch data[i] {
+				case '\\':
+					i++
+				case '`':
+					return i, line, errors.New("unsupported shell syntax")
+				case '$':
+					n, ok := scanEnvReference(data, i)
+					if !ok {
+						return i, line, errors.New("unsupported shell syntax")
+					}
+					i = n - 1
+				}
+				if i < len(data) && data[i] == '\n' {
+					line++
+				}
+				i++
+			}
+			if i >= len(data) {
+				return i, line, errors.New("unterminated double quote")
+			}
+			i++
+		case c == '\\':
+			// a backslash before a newline would join the next line to this
+			// statement.
+			if i+1 == len(data) || data[i+1] == '\n' || data[i+1] == '\r' {
+				return i, line, errors.New("unsupported shell syntax")
+			}
+			i += 2
+		case c == '$':
+			n, ok := scanEnvReference(data, i)
+			if !ok {
+				return i, line, errors.New("unsupported shell syntax")
+			}
+			i = n
+		case isEnvMetachar(c):
+			return i, line, errors.New("unsupported shell syntax")
+		default:
+			i++
+		}
+	}
+	return i, line, nil
+}
+
+// scanEnvReference returns the index just past the $NAME or ${NAME} at
+// data[i], or false if it's any other expansion.
+func scanEnvReference(data []byte, i int) (int, bool) {
+	i++
+	braced := i < len(data) && data[i] == '{'
+	if braced {
+		i++
+	}
+	start := i
+	for i < len(data) && isEnvNameByte(data[i]) {
+		i++
+	}
+	if !regexpEnvName.Match(data[start:i]) {
+		return i, false
+	}
+	if braced {
+		if i == len(data) || data[i] != '}' {
+			return i, false
+		}
+		i++
+	}
+	return i, true
+}
+
+func skipEnvBlanks(data []byte, i int) int {
+	for i < len(data) && (data[i] == ' ' || data[i] == '\t' || data[i] == '\r') {
+		i++
+	}
+	return i
+}
+
+// skipEnvComment returns the index of the end of the line holding the
+// comment at data[i].
+func skipEnvComment(data []byte, i int) int {
+	for i < len(data) && data[i] != '\n' {
+		i++
+	}
+	return i
+}
+
+func hasEnvPrefix(data []byte, prefix string) bool {
+	return len(data) >= len(prefix) && string(data[:len(prefix)]) == prefix
+}
+
+func isEnvNameByte(c byte) bool {
+	return c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9'
+}
+
+// isEnvMetachar reports whether c, unquoted, would end a simple assignment.
+func isEnvMetachar(c byte) bool {
+	switch c {
+	case ';', '&', '|', '<', '>', '(', ')', '`':
+		return true
+	}
+	return false
+}
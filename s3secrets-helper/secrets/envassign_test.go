@@ -0,0 +1,60 @@
+package secrets
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseEnvAssignments(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		input    string
+		expected []string
+		err      string
+	}{
+		{"plain", "A=one\n", []string{"A=one\n"}, ""},
+		{"no trailing newline", "A=one", []string{"A=one"}, ""},
+		{"export", "export A=one\n", []string{"export A=one\n"}, ""},
+		{"comments and blank lines", "# comment\n\nA=one # trailing\n  # indented\n", []string{"A=one # trailing\n"}, ""},
+		{"empty", "A=\nB=\n", []string{"A=\n", "B=\n"}, ""},
+		{"crlf", "A=one\r\nB=two\r\n", []string{"A=one\r\n", "B=two\r\n"}, ""},
+		{"quoted", `A='one two' B="three $C ${D}"` + "\n", nil, "line 1: A: unexpected characters after the value"},
+		{"single quoted", "A='one two'\n", []string{"A='one two'\n"}, ""},
+		{"double quoted", `A="one $B ${C} \" \$(d)"` + "\n", []string{`A="one $B ${C} \" \$(d)"` + "\n"}, ""},
+		{"shellQuote", `A='it'\''s'` + "\n", []string{`A='it'\''s'` + "\n"}, ""},
+		{"reference", "PATH=/tmp/evil:$PATH\n", []string{"PATH=/tmp/evil:$PATH\n"}, ""},
+		{"multi-line", "A=\"-----BEGIN\nB=two\n-----END\"\nC=three\n", []string{"A=\"-----BEGIN\nB=two\n-----END\"\n", "C=three\n"}, ""},
+		{"append", "PATH+=:/tmp/evil\n", nil, "line 1: expected NAME=value"},
+		{"semicolon", "A=1; PATH=/tmp/evil\n", nil, "line 1: A: unsupported shell syntax"},
+		{"two assignments", "A=1 LD_PRELOAD=/x.so\n", nil, "line 1: A: unexpected characters after the value"},
+		{"declare", "declare -x PATH=/evil\n", nil, "line 1: expected NAME=value"},
+		{"command", "echo hi\n", nil, "line 1: expected NAME=value"},
+		{"command substitution", "A=$(PATH=/evil)\n", nil, "line 1: A: unsupported shell syntax"},
+		{"quoted command substitution", "A=\"$(id)\"\n", nil, "line 1: A: unsupported shell syntax"},
+		{"backticks", "A=\"`id`\"\n", nil, "line 1: A: unsupported shell syntax"},
+		{"default expansion", "A=${PATH:=/evil}\n", nil, "line 1: A: unsupported shell syntax"},
+		{"and", "A=1&&PATH=/evil\n", nil, "line 1: A: unsupported shell syntax"},
+		{"continuation", "A=1\\\n;PATH=/evil\n", nil, "line 1: A: unsupported shell syntax"},
+		{"unterminated", "\nA='one\n", nil, "line 2: A: unterminated single quote"},
+		{"after multi-line", "A='one\ntwo'\nB=1;C=2\n", nil, "line 3: B: unsupported shell syntax"},
+	} {
+		assignments, err := parseEnvAssignments([]byte(tc.input))
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: expected error %q, got %v", tc.name, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+			continue
+		}
+		var got []string
+		for _, v := range assignments {
+			got = append(got, tc.input[v.start:v.end])
+		}
+		if !reflect.DeepEqual(tc.expected, got) {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.expected, got)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package secrets
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+)
+
+// DefaultEnvDenylist are variables which could be used to hijack a build if a
+// secrets bucket were compromised; see Config.EnvDenylist.
+var DefaultEnvDenylist = []string{"BUILDKITE_*", "PATH", "LD_PRELOAD", "LD_LIBRARY_PATH"}
+
+// checkEnvDenylist returns an error if any pattern of Config.EnvDenylist is
+// malformed.
+func checkEnvDenylist(conf Config) error {
+	for _, pattern := range conf.EnvDenylist {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("env denylist pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// envDenied returns the pattern of Config.EnvDenylist matching name, if any.
+func envDenied(conf Config, name string) (string, bool) {
+	for _, pattern := range conf.EnvDenylist {
+		if ok, _ := path.Match(pattern, name); ok {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// filterEnvDenylist returns env file r's data without the assignments of
+// denied variables, warning of each. As an env file is evaluated by the
+// shell, one which doesn't parse as plain assignments is loaded as it is with
+// a warning that the denylist can't be fully enforced, unless it looks like
+// it assigns a denied variable, in which case it's refused as a whole. data
+// is zeroed if anything is removed.
+func filterEnvDenylist(conf Config, r getResult, data []byte) []byte {
+	if len(conf.EnvDenylist) == 0 {
+		return data
+	}
+	assignments, err := parseEnvAssignments(data)
+	if err != nil {
+		if name, pattern, ok := scanEnvDenied(conf, data); ok {
+			conf.log.Warn(
+				fmt.Sprintf("Refusing env %s/%s; it appears to set %s, which matches %q in the env denylist, and %v, so it can't be removed alone", r.bucket, r.key, name, pattern, err),
+				typeField(CategoryEnv), bucketField(r.bucket), keyField(r.key), Field{"name", name}, Field{"pattern", pattern}, errField(err),
+			)
+			zero(data)
+			return nil
+		}
+		conf.log.Warn(
+			fmt.Sprintf("Loading env %s/%s without fully enforcing the env denylist; %v, so variables it sets indirectly aren't checked", r.bucket, r.key, err),
+			typeField(CategoryEnv), bucketField(r.bucket), keyField(r.key), errField(err),
+		)
+		return data
+	}
+	var out bytes.Buffer
+	denied, from := false, 0
+	for _, v := range assignments {
+		pattern, ok := envDenied(conf, v.name)
+		if !ok {
+			continue
+		}
+		denied = true
+		out.Write(data[from:v.start])
+		from = v.end
+		conf.log.Warn(
+			fmt.Sprintf("Refusing to set %s from env %s/%s; it matches %q in the env denylist", v.name, r.bucket, r.key, pattern),
+			typeField(CategoryEnv), bucketField(r.bucket), keyField(r.key), Field{"name", v.name}, Field{"pattern", pattern},
+		)
+	}
+	if !denied {
+		return data
+	}
+	out.Write(data[from:])
+	zero(data)
+	return out.Bytes()
+}
+
+// scanEnvDenied returns the first denied name in data which is followed by
+// "=", "+=" or ":=", as in an assignment anywhere in a shell script, e.g.
+// "A=1; PATH=/tmp" or "${PATH:=/tmp}", and the pattern it matches.
+func scanEnvDenied(conf Config, data []byte) (string, string, bool) {
+	for i := 0; i < len(data); i++ {
+		if !isEnvNameByte(data[i]) || i > 0 && isEnvNameByte(data[i-1]) {
+			continue
+		}
+		j := i
+		for j < len(data) && isEnvNameByte(data[j]) {
+			j++
+		}
+		name := string(data[i:j])
+		if j < len(data) && (data[j] == '+' || data[j] == ':') {
+			j++
+		}
+		if j < len(data) && data[j] == '=' && regexpEnvName.MatchString(name) {
+			if pattern, ok := envDenied(conf, name); ok {
+				return name, pattern, true
+			}
+		}
+		i = j - 1
+	}
+	return "", "", false
+}
@@ -0,0 +1,88 @@
+package secrets
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Kinds of change reported for each variable when EnvDiffSink is set.
+const (
+	envChangeNew      = "new"
+	envChangeOverride = "override (value changes)"
+	envChangeNoop     = "no-op (same value)"
+)
+
+// parseEnv returns the variables assigned by an env file, in order, as
+// "NAME=value" pairs. It understands the common subset of shell syntax env
+// files use: comments, "export", and single or double quoted values.
+func parseEnv(data []byte) [][2]string {
+	var vars [][2]string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		i := strings.IndexByte(line, '=')
+		if i <= 0 {
+			continue
+		}
+		name, value := strings.TrimSpace(line[:i]), line[i+1:]
+		if !regexpEnvName.MatchString(name) {
+			continue
+		}
+		vars = append(vars, [2]string{name, unquoteEnvValue(value)})
+	}
+	return vars
+}
+
+func unquoteEnvValue(v string) string {
+	if len(v) < 2 {
+		return v
+	}
+	switch {
+	case v[0] == '"' && v[len(v)-1] == '"':
+		return strings.NewReplacer(`\"`, `"`, `\\`, `\`, `\$`, `$`).Replace(v[1 : len(v)-1])
+	case v[0] == '\'' && v[len(v)-1] == '\'':
+		// shellQuote escapes ' as '\''
+		return strings.Replace(v[1:len(v)-1], `'\''`, `'`, -1)
+	}
+	return v
+}
+
+// writeEnvDiff reports, per variable assigned by env, whether it is new to
+// the environment, overrides its value, or sets the value it already has.
+// Values are never written.
+func writeEnvDiff(conf Config, env []byte) error {
+	environ := conf.Environ
+	if environ == nil {
+		environ = os.Environ()
+	}
+	current := make(map[string]string, len(environ))
+	for _, kv := range environ {
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			current[kv[:i]] = kv[i+1:]
+		}
+	}
+
+	for _, kv := range parseEnv(env) {
+		name, value := kv[0], kv[1]
+		change := envChangeNew
+		if old, ok := current[name]; ok {
+			if old == value {
+				change = envChangeNoop
+			} else {
+				change = envChangeOverride
+			}
+		}
+		current[name] = value // later assignments compare against earlier ones
+		if _, err := fmt.Fprintf(conf.EnvDiffSink, "%s: %s\n", name, change); err != nil {
+			return fmt.Errorf("writing env diff: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// runEnvFile is run, except that if conf.EnvFilePath is set, output to
+// EnvSink is buffered and only written to EnvFilePath once run succeeds, so
+// that the file is never left partially written.
+func runEnvFile(ctx context.Context, conf Config, leases *leases) error {
+	if conf.EnvFilePath == "" {
+		return run(ctx, conf, leases)
+	}
+	if conf.EnvSink != nil {
+		return errors.New("EnvSink and EnvFilePath can't both be set")
+	}
+	var buf bytes.Buffer
+	conf.EnvSink = &buf
+	defer func() { zero(buf.Bytes()) }()
+	if err := run(ctx, conf, leases); err != nil {
+		return err
+	}
+	if conf.DryRun {
+		return nil
+	}
+	return writeFileAtomic(conf.EnvFilePath, buf.Bytes())
+}
+
+// writeFileAtomic replaces path with data, by writing it to a temporary file
+// in the same directory and renaming that over path. If it fails, path is
+// left as it was.
+func writeFileAtomic(path string, data []byte) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if err := f.Chmod(0600); err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,83 @@
+package secrets
+
+import (
+	"fmt"
+	"path"
+)
+
+// EnvFilenameStrategy controls what happens when both "env" and
+// "environment" files exist alongside each other.
+type EnvFilenameStrategy string
+
+const (
+	// EnvFilenameMergeAll loads both, "env" then "environment". This is the
+	// default.
+	EnvFilenameMergeAll EnvFilenameStrategy = "merge-all"
+
+	// EnvFilenamePreferEnv loads only "env".
+	EnvFilenamePreferEnv EnvFilenameStrategy = "prefer-env"
+
+	// EnvFilenamePreferEnvironment loads only "environment".
+	EnvFilenamePreferEnvironment EnvFilenameStrategy = "prefer-environment"
+
+	// EnvFilenameErrorOnBoth fails when both exist.
+	EnvFilenameErrorOnBoth EnvFilenameStrategy = "error-on-both"
+)
+
+// collect reads all results from the channel.
+func collect(results <-chan getResult) []getResult {
+	var collected []getResult
+	for r := range results {
+		collected = append(collected, r)
+	}
+	return collected
+}
+
+// resolveEnvFilenames applies Config.EnvFilenameStrategy to env results,
+// returning those to be loaded.
+func resolveEnvFilenames(conf Config, results []getResult) ([]getResult, error) {
+	var drop, keep string
+	switch conf.EnvFilenameStrategy {
+	case "", EnvFilenameMergeAll:
+		return results, nil
+	case EnvFilenamePreferEnv:
+		drop, keep = "environment", "env"
+	case EnvFilenamePreferEnvironment:
+		drop, keep = "env", "environment"
+	case EnvFilenameErrorOnBoth:
+	default:
+		return nil, fmt.Errorf("unknown env filename strategy %q", conf.EnvFilenameStrategy)
+	}
+
+	// found maps directory to the base names of env files found in it.
+	found := make(map[string]map[string]bool)
+	for _, r := range results {
+		if r.err != nil {
+			continue
+		}
+		dir, base := path.Split(r.key)
+		if found[dir] == nil {
+			found[dir] = make(map[string]bool)
+		}
+		found[dir][normalizeKey(base)] = true
+	}
+
+	var resolved []getResult
+	for _, r := range results {
+		dir, base := path.Split(r.key)
+		if r.err == nil && found[dir]["env"] && found[dir]["environment"] {
+			if drop == "" {
+				return nil, fmt.Errorf("both %s/%senv and %s/%senvironment exist; remove one of them", r.bucket, dir, r.bucket, dir)
+			}
+			if normalizeKey(base) == drop {
+				conf.log.Info(
+					fmt.Sprintf("Skipping %s/%s in favour of %s/%s%s", r.bucket, r.key, r.bucket, dir, keep),
+					typeField(CategoryEnv), bucketField(r.bucket), keyField(r.key),
+				)
+				continue
+			}
+		}
+		resolved = append(resolved, r)
+	}
+	return resolved, nil
+}
@@ -0,0 +1,63 @@
+package secrets
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// envFile is an env file to be written once the precedence of the variables
+// it sets is known.
+type envFile struct {
+	source string // bucket/key
+	data   []byte // as written
+	raw    []byte // as downloaded, zeroed along with data
+}
+
+// resolveEnvPrecedence returns the env files concatenated, without the
+// assignments of variables which a later file overrides, so that each
+// variable is set once. Files are in the order they're checked, so those
+// within the prefix override those at the root of the bucket, and
+// EnvPrefix fragments override both. Each override is warned about.
+// Assignments are found with parseEnvAssignments, so a value may span lines;
+// files it can't parse, which use other shell syntax, are left to the shell
+// as they are. Assignments overridden within the same file are also left to
+// the shell.
+func resolveEnvPrecedence(conf Config, files []envFile) []byte {
+	assignments := make([][]envAssignment, len(files))
+	last := make(map[string]int) // variable name -> index of the last file setting it
+	for i, f := range files {
+		var err error
+		if assignments[i], err = parseEnvAssignments(f.data); err != nil {
+			conf.log.Debug(
+				fmt.Sprintf("Not resolving the precedence of variables in %s; %v", f.source, err),
+				typeField(CategoryEnv), Field{"source", f.source}, errField(err),
+			)
+			continue
+		}
+		for _, v := range assignments[i] {
+			last[v.name] = i
+		}
+	}
+
+	var out bytes.Buffer
+	for i, f := range files {
+		warned := make(map[string]bool)
+		from := 0
+		for _, v := range assignments[i] {
+			if last[v.name] == i {
+				continue
+			}
+			out.Write(f.data[from:v.start])
+			from = v.end
+			if !warned[v.name] {
+				warned[v.name] = true
+				conf.log.Warn(
+					fmt.Sprintf("%s in %s is overridden by %s", v.name, f.source, files[last[v.name]].source),
+					typeField(CategoryEnv), Field{"name", v.name}, Field{"source", f.source}, Field{"overridden_by", files[last[v.name]].source},
+				)
+			}
+		}
+		out.Write(f.data[from:])
+	}
+	return out.Bytes()
+}
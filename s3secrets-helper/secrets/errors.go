@@ -0,0 +1,41 @@
+package secrets
+
+import "errors"
+
+// Classes of error returned by Run, which callers can match with errors.Is,
+// e.g. to choose an exit code.
+var (
+	// ErrBucketNotFound is a bucket which doesn't exist, or can't be seen;
+	// most likely a misconfiguration.
+	ErrBucketNotFound = errors.New("bucket not found")
+
+	// ErrAgentFailed is ssh-agent failing to start, or to add a key.
+	ErrAgentFailed = errors.New("ssh-agent failed")
+
+	// ErrDownloadFailed is a secret which couldn't be downloaded, other than
+	// because it doesn't exist; it may succeed if retried.
+	ErrDownloadFailed = errors.New("download failed")
+)
+
+// kindError is an error which also matches kind, one of the classes of
+// error above, without changing its message.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func withKind(kind, err error) error {
+	return &kindError{kind: kind, err: err}
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
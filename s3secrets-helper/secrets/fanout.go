@@ -0,0 +1,150 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// DestinationKind is where a fanned out secret is written; see Destination.
+type DestinationKind string
+
+const (
+	// DestinationEnv writes the secret, as an env file, to the env output
+	// (EnvSink or EnvDestPath).
+	DestinationEnv DestinationKind = "env"
+
+	// DestinationFile writes the secret to Path atomically, with Mode,
+	// creating its directory if needed.
+	DestinationFile DestinationKind = "file"
+
+	// DestinationProcessEnv parses the secret as an env file and sets the
+	// variables in this process's environment.
+	DestinationProcessEnv DestinationKind = "process-env"
+)
+
+// Destination is one place a secret is written to; see Config.SecretFanout.
+type Destination struct {
+	Kind DestinationKind
+	Path string      // for DestinationFile
+	Mode os.FileMode // for DestinationFile; if zero, readable only by the owner
+}
+
+// fanoutKeys returns the keys of conf.SecretFanout in a stable order.
+func fanoutKeys(conf Config) []string {
+	keys := make([]string, 0, len(conf.SecretFanout))
+	for k := range conf.SecretFanout {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// withoutFanout removes keys which are fanned out from the keys of each
+// category, so they're only downloaded and applied once.
+func withoutFanout(conf Config, categories []*category) {
+	for _, c := range categories {
+		keys := c.keys[:0:0]
+		for _, k := range c.keys {
+			if _, ok := conf.SecretFanout[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		c.keys = keys
+	}
+}
+
+// handleFanout writes each secret to all of its destinations concurrently.
+func handleFanout(ctx context.Context, conf Config, results <-chan getResult) error {
+	log := conf.log
+	for r := range results {
+		if r.err != nil {
+			if !absent(r.err) {
+				log.Warn(
+					fmt.Sprintf("Failed to download %s/%s: %v", r.bucket, r.key, r.err),
+					typeField(CategoryFanout), bucketField(r.bucket), keyField(r.key), errField(r.err),
+				)
+			}
+			continue
+		}
+		r, ok := prepare(ctx, conf, CategoryFanout, r)
+		if !ok {
+			continue
+		}
+		dests := conf.SecretFanout[r.key]
+		if conf.DryRun {
+			log.Info(
+				fmt.Sprintf("(dry-run) would write %s/%s to %d destinations", r.bucket, r.key, len(dests)),
+				typeField(CategoryFanout), bucketField(r.bucket), keyField(r.key), bytesField(len(r.data)), Field{"dry_run", true},
+			)
+			zero(r.data)
+			conf.results.apply(CategoryFanout, r.bucket, r.key)
+			continue
+		}
+		log.Info(
+			fmt.Sprintf("Writing %s/%s to %d destinations", r.bucket, r.key, len(dests)),
+			typeField(CategoryFanout), bucketField(r.bucket), keyField(r.key), bytesField(len(r.data)),
+		)
+
+		var wg sync.WaitGroup
+		errs := make([]error, len(dests))
+		for i, d := range dests {
+			wg.Add(1)
+			go func(i int, d Destination) {
+				defer wg.Done()
+				errs[i] = writeDestination(conf.envDest, d, r.data)
+			}(i, d)
+		}
+		wg.Wait()
+		zero(r.data)
+		for i, err := range errs {
+			if err != nil {
+				return fmt.Errorf("writing %s to %s destination: %w", r.key, dests[i].Kind, err)
+			}
+		}
+		conf.results.apply(CategoryFanout, r.bucket, r.key)
+	}
+	return nil
+}
+
+func writeDestination(env io.Writer, d Destination, data []byte) error {
+	switch d.Kind {
+	case DestinationEnv:
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			data = append(data[:len(data):len(data)], '\n')
+			defer zero(data)
+		}
+		_, err := env.Write(data)
+		return err
+	case DestinationFile:
+		return writeFile(d.Path, data, d.Mode)
+	case DestinationProcessEnv:
+		for _, kv := range parseEnv(data) {
+			if err := os.Setenv(kv[0], kv[1]); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown destination kind %q", d.Kind)
+	}
+}
+
+// writeFile replaces path with data, atomically, with mode, or 0600 if it's
+// zero. Its directory is created if needed, readable only by the owner.
+func writeFile(path string, data []byte, mode os.FileMode) error {
+	if mode == 0 {
+		mode = 0600
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return err
+	}
+	return os.Chmod(path, mode)
+}
@@ -0,0 +1,38 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+)
+
+// FeatureGate decides whether feature flags are enabled, e.g. backed by a
+// feature flag service, for gradually rolling out new secrets.
+type FeatureGate interface {
+	Enabled(ctx context.Context, flag string) (bool, error)
+}
+
+// gateAllows reports whether r may be applied according to the FeatureGate
+// and the feature flag it is tagged with, if any. It fails closed; if the
+// gate can't decide, the secret isn't applied.
+func gateAllows(ctx context.Context, conf Config, r getResult) bool {
+	flag, tagged := conf.FeatureFlags[r.key]
+	if !tagged || conf.FeatureGate == nil {
+		return true
+	}
+	enabled, err := conf.FeatureGate.Enabled(ctx, flag)
+	if err != nil {
+		conf.log.Warn(
+			fmt.Sprintf("Skipping %s/%s; failed to check feature flag %q: %v", r.bucket, r.key, flag, err),
+			bucketField(r.bucket), keyField(r.key), Field{"flag", flag}, errField(err),
+		)
+		return false
+	}
+	if !enabled {
+		conf.log.Info(
+			fmt.Sprintf("Skipping %s/%s; feature flag %q is disabled", r.bucket, r.key, flag),
+			bucketField(r.bucket), keyField(r.key), Field{"flag", flag},
+		)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,73 @@
+package secrets
+
+import "context"
+
+// priorityOrder returns keys in order of precedence for FirstMatchOnly: an env
+// file loaded later overrides those before it, as does a later source of
+// git-credentials with GitCredentialLastWins, so those are reversed. Other
+// types of secret are already in order of precedence.
+func priorityOrder(conf Config, secretType string, keys []string) []string {
+	switch {
+	case secretType == CategoryEnv,
+		secretType == CategoryGitCredentials && conf.GitCredentialPolicy == GitCredentialLastWins:
+	default:
+		return keys
+	}
+	reversed := make([]string, len(keys))
+	for i, k := range keys {
+		reversed[len(keys)-1-i] = k
+	}
+	return reversed
+}
+
+// firstMatch passes results on to out until the first secret found, then
+// cancels the remaining downloads, dropping their results. Only the git-token
+// alongside a git-username found first is also passed on, as the two are
+// used together. cancel cancels the downloads, and ctx stops results being
+// passed on, e.g. if the handler fails.
+func firstMatch(ctx context.Context, conf Config, cancel context.CancelFunc, results <-chan getResult, out chan<- getResult) {
+	defer close(out)
+	defer cancel()
+	send := func(r getResult) {
+		select {
+		case out <- r:
+		case <-ctx.Done():
+			zero(r.data)
+		}
+	}
+	var first getResult
+	found := false
+	for r := range results {
+		switch {
+		case !found:
+			send(r)
+			if r.err == nil {
+				first, found = getResult{bucket: r.bucket, key: r.key}, true
+				if !isGitUsername(conf, r) {
+					cancel()
+				}
+			}
+		case r.err == nil && isGitTokenFor(conf, first, r):
+			send(r)
+			cancel()
+		default:
+			zero(r.data)
+		}
+	}
+}
+
+func isGitUsername(conf Config, r getResult) bool {
+	_, name := splitKey(conf, r.key)
+	return name == gitUsernameName
+}
+
+// isGitTokenFor reports whether r is the git-token alongside the git-username
+// of username.
+func isGitTokenFor(conf Config, username, r getResult) bool {
+	if !isGitUsername(conf, username) || r.bucket != username.bucket {
+		return false
+	}
+	dir, name := splitKey(conf, r.key)
+	usernameDir, _ := splitKey(conf, username.key)
+	return name == gitTokenName && dir == usernameDir
+}
@@ -0,0 +1,149 @@
+package secrets
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sentinel"
+)
+
+// inFlightClient records the most Gets in flight at once, and the most
+// goroutines seen during a Get.
+type inFlightClient struct {
+	mu         sync.Mutex
+	inFlight   int
+	max        int
+	goroutines int
+}
+
+func (c *inFlightClient) Bucket() string              { return "bkt" }
+func (c *inFlightClient) BucketExists() (bool, error) { return true, nil }
+func (c *inFlightClient) Get(ctx context.Context, key string) ([]byte, error) {
+	c.mu.Lock()
+	c.inFlight++
+	if c.inFlight > c.max {
+		c.max = c.inFlight
+	}
+	if n := runtime.NumGoroutine(); n > c.goroutines {
+		c.goroutines = n
+	}
+	c.mu.Unlock()
+	time.Sleep(time.Millisecond)
+	c.mu.Lock()
+	c.inFlight--
+	c.mu.Unlock()
+	return []byte(key), nil
+}
+
+func keysN(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	return keys
+}
+
+func TestGetAllConcurrency(t *testing.T) {
+	keys := keysN(50)
+	for _, concurrency := range []int{1, 4, 0} {
+		c := &inFlightClient{}
+		results := make(chan getResult)
+		go GetAll(context.Background(), c, "bkt", keys, concurrency, results)
+		var i int
+		for r := range results {
+			if r.key != keys[i] || string(r.data) != keys[i] {
+				t.Errorf("concurrency %d: expected result %d to be %s, got %s", concurrency, i, keys[i], r.key)
+			}
+			i++
+		}
+		if i != len(keys) {
+			t.Errorf("concurrency %d: expected %d results, got %d", concurrency, len(keys), i)
+		}
+		limit := concurrency
+		if limit == 0 {
+			limit = defaultConcurrency
+		}
+		if c.max > limit {
+			t.Errorf("concurrency %d: expected at most %d fetches in flight, got %d", concurrency, limit, c.max)
+		}
+	}
+}
+
+func BenchmarkGetAll(b *testing.B) {
+	keys := keysN(100)
+	for _, concurrency := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("concurrency-%d", concurrency), func(b *testing.B) {
+			var max, goroutines int
+			for n := 0; n < b.N; n++ {
+				c := &inFlightClient{}
+				results := make(chan getResult)
+				go GetAll(context.Background(), c, "bkt", keys, concurrency, results)
+				for range results {
+				}
+				if c.max > max {
+					max = c.max
+				}
+				if c.goroutines > goroutines {
+					goroutines = c.goroutines
+				}
+			}
+			b.ReportMetric(float64(max), "max-in-flight")
+			b.ReportMetric(float64(goroutines), "max-goroutines")
+		})
+	}
+}
+
+// metaClient returns fixed data and metadata for every key.
+type metaClient struct {
+	data []byte
+	meta map[string]string
+}
+
+func (c *metaClient) Bucket() string              { return "bkt" }
+func (c *metaClient) BucketExists() (bool, error) { return true, nil }
+func (c *metaClient) Get(ctx context.Context, key string) ([]byte, error) {
+	return append([]byte(nil), c.data...), nil
+}
+func (c *metaClient) GetWithMetadata(ctx context.Context, key string) ([]byte, map[string]string, error) {
+	data, err := c.Get(ctx, key)
+	return data, c.meta, err
+}
+
+func TestGetAllIntegrity(t *testing.T) {
+	sum := md5.Sum([]byte("secret"))
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	for _, tc := range []struct {
+		name string
+		data string
+		meta map[string]string
+		ok   bool
+	}{
+		{"no metadata", "secret", nil, true},
+		{"length matches", "secret", map[string]string{"content-length": "6"}, true},
+		{"truncated", "sec", map[string]string{"content-length": "6"}, false},
+		{"etag matches", "secret", map[string]string{"etag": etag}, true},
+		{"etag mismatch", "secrex", map[string]string{"etag": etag}, false},
+		{"multipart etag", "secrex", map[string]string{"etag": `"0123-2"`}, true},
+		{"kms etag", "secrex", map[string]string{"etag": etag, "x-amz-server-side-encryption": "aws:kms"}, true},
+		{"checksum matches", "secret", map[string]string{"x-amz-checksum-sha256": "K7gNU3sdo+OL0wNhqoVWhr3g6s1xYv72ol/pe/Unols="}, true},
+		{"checksum mismatch", "secrex", map[string]string{"x-amz-checksum-sha256": "K7gNU3sdo+OL0wNhqoVWhr3g6s1xYv72ol/pe/Unols="}, false},
+	} {
+		results := make(chan getResult)
+		go GetAll(context.Background(), &metaClient{[]byte(tc.data), tc.meta}, "bkt", []string{"key"}, 0, results)
+		r := <-results
+		drain(results)
+		var ierr *IntegrityError
+		if tc.ok && r.err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, r.err)
+		} else if !tc.ok && (!errors.As(r.err, &ierr) || !errors.Is(r.err, sentinel.ErrTransient)) {
+			t.Errorf("%s: expected a transient IntegrityError, got %v", tc.name, r.err)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+)
+
+// GPGAgent imports private keys into gpg, whose gpg-agent then holds them
+// for signing; see Config.GPGAgent.
+type GPGAgent interface {
+	Import(key []byte) error
+}
+
+var defaultGPGKeyNames = []string{"gpg_key"}
+
+// gpgKeyCandidates puts the most specific prefix's key first, so it's
+// imported first, and gpg signs with it by default.
+func gpgKeyCandidates(conf Config) []string {
+	ps := prefixes(conf)
+	var keys []string
+	for i := len(ps) - 1; i >= 0; i-- {
+		for _, n := range defaultGPGKeyNames {
+			keys = append(keys, candidateKey(conf, ps[i], n))
+		}
+	}
+	for _, n := range defaultGPGKeyNames {
+		keys = append(keys, caseKey(conf, n))
+	}
+	return dedupeKeys(normalizeKeys(conf, keys))
+}
+
+// handleGPGKeys imports each gpg_key found into GPGAgent. Keys gpg rejects
+// are skipped with a warning, so one bad key doesn't fail the build.
+func handleGPGKeys(ctx context.Context, conf Config, results <-chan getResult) error {
+	log := conf.log
+	for r := range results {
+		if r.err != nil {
+			if !absent(r.err) {
+				log.Warn(
+					fmt.Sprintf("Failed to download gpg key %s/%s: %v", r.bucket, r.key, r.err),
+					typeField(CategoryGPGKey), bucketField(r.bucket), keyField(r.key), errField(r.err),
+				)
+			}
+			continue
+		}
+		r, ok := prepare(ctx, conf, CategoryGPGKey, r)
+		if !ok {
+			continue
+		}
+		if conf.DryRun {
+			log.Info(
+				fmt.Sprintf("(dry-run) would import %s/%s (%d bytes) into gpg", r.bucket, r.key, len(r.data)),
+				typeField(CategoryGPGKey), bucketField(r.bucket), keyField(r.key), bytesField(len(r.data)), Field{"dry_run", true},
+			)
+			zero(r.data)
+			conf.results.apply(CategoryGPGKey, r.bucket, r.key)
+			continue
+		}
+		log.Info(
+			fmt.Sprintf("Importing %s/%s (%d bytes) into gpg", r.bucket, r.key, len(r.data)),
+			typeField(CategoryGPGKey), bucketField(r.bucket), keyField(r.key), bytesField(len(r.data)),
+		)
+		err := conf.GPGAgent.Import(r.data)
+		zero(r.data)
+		if err != nil {
+			log.Warn(
+				fmt.Sprintf("Skipping %s/%s; gpg rejected it: %v", r.bucket, r.key, err),
+				typeField(CategoryGPGKey), bucketField(r.bucket), keyField(r.key), errField(err),
+			)
+			continue
+		}
+		conf.results.apply(CategoryGPGKey, r.bucket, r.key)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package secrets
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sentinel"
+)
+
+const metaContentEncoding = "content-encoding"
+
+// gunzipClient decompresses gzipped secrets, recognised by their
+// Content-Encoding or their leading bytes, so that large ones can be stored
+// compressed. Others are returned as they are. The decompressed size is
+// limited to max, if positive, so that a small object can't decompress to
+// one too large to hold in memory.
+type gunzipClient struct {
+	Client
+	max int64
+}
+
+func (c *gunzipClient) Get(ctx context.Context, key string) ([]byte, error) {
+	data, _, err := c.GetWithMetadata(ctx, key)
+	return data, err
+}
+
+func (c *gunzipClient) GetWithMetadata(ctx context.Context, key string) ([]byte, map[string]string, error) {
+	data, meta, err := getWithMetadata(ctx, c.Client, key)
+	if err != nil || !(meta[metaContentEncoding] == "gzip" || bytes.HasPrefix(data, gzipMagic)) {
+		return data, meta, err
+	}
+	decompressed, err := gunzip(data, c.max)
+	zero(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return decompressed, meta, nil
+}
+
+// gunzip decompresses data, failing with sentinel.ErrTooLarge if max is
+// positive and it decompresses to more than max bytes.
+func gunzip(data []byte, max int64) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("gzip: %w", err)
+	}
+	var r io.Reader = zr
+	if max > 0 {
+		r = io.LimitReader(zr, max+1)
+	}
+	decompressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		zero(decompressed)
+		return nil, fmt.Errorf("gzip: %w", err)
+	}
+	if size := int64(len(decompressed)); max > 0 && size > max {
+		zero(decompressed)
+		return nil, fmt.Errorf("%w: more than the limit of %d bytes once decompressed", sentinel.ErrTooLarge, max)
+	}
+	return decompressed, nil
+}
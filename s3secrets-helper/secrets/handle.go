@@ -0,0 +1,200 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// handleCategories runs the handler of each category, then its loaded hook.
+// The handlers run concurrently, so that one type of secret isn't held up by
+// the downloads of another, and the first to fail cancels the rest. The
+// hooks are still called one at a time, in category order. Each
+// writes its output and logs to its own buffers, which are copied to the
+// real destinations in category order once all are done, so that the output
+// is as if they'd run one at a time. If DependsOn is set, they do run one at
+// a time, in order, as applying some secrets relies on others having been
+// applied. If DeterministicOutput is set, each category is also fetched
+// and collected in full just before it's handled, so that nothing else logs
+// while it is.
+func handleCategories(ctx context.Context, cancel context.CancelFunc, conf Config, categories []*category) error {
+	if len(conf.DependsOn) > 0 || conf.DeterministicOutput {
+		for _, c := range categories {
+			if conf.DeterministicOutput {
+				fetchAll(ctx, conf, c)
+			}
+			if err := handleCategory(ctx, conf, c, nil, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	outputs := make([]categoryOutput, len(categories))
+	defer func() {
+		for i := range outputs {
+			outputs[i].zero()
+		}
+	}()
+	var (
+		wg    sync.WaitGroup
+		once  sync.Once
+		first error
+	)
+	// each category's hook is called once the previous category's has been.
+	hooked := make([]chan struct{}, len(categories))
+	for i, c := range categories {
+		hooked[i] = make(chan struct{})
+		var prev <-chan struct{}
+		if i > 0 {
+			prev = hooked[i-1]
+		}
+		wg.Add(1)
+		go func(c *category, out *categoryOutput, prev <-chan struct{}, done chan<- struct{}) {
+			defer wg.Done()
+			if err := handleCategory(ctx, out.redirect(conf), c, prev, done); err != nil {
+				once.Do(func() {
+					first = err
+					cancel()
+				})
+			}
+		}(c, &outputs[i], prev, hooked[i])
+	}
+	wg.Wait()
+	// logs are replayed even if a handler failed, so the failure is explained.
+	for i := range outputs {
+		outputs[i].log.replay(conf.log)
+	}
+	if first != nil {
+		return first
+	}
+	for i, c := range categories {
+		if err := outputs[i].flush(conf); err != nil {
+			return fmt.Errorf("writing %s: %w", c.name, err)
+		}
+	}
+	return nil
+}
+
+// fetchAll fetches c's keys, replacing c.results with a closed channel
+// holding all of its results.
+func fetchAll(ctx context.Context, conf Config, c *category) {
+	fetch(ctx, conf, c)
+	collected := collect(c.results)
+	results := make(chan getResult, len(collected))
+	for _, r := range collected {
+		results <- r
+	}
+	close(results)
+	c.results = results
+}
+
+// handleCategory runs the handler of c, then its loaded hook once prev, if
+// set, is closed, closing done, if set, if the hook succeeds.
+func handleCategory(ctx context.Context, conf Config, c *category, prev <-chan struct{}, done chan<- struct{}) error {
+	if err := c.handle(ctx, conf, c.results); err != nil {
+		return err
+	}
+	if prev != nil {
+		select {
+		case <-prev:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if c.loaded != nil {
+		if err := c.loaded(conf); err != nil {
+			return err
+		}
+	}
+	if done != nil {
+		close(done)
+	}
+	return nil
+}
+
+// categoryOutput buffers what a category's handler writes to each
+// destination, and logs.
+type categoryOutput struct {
+	sink, env, git bytes.Buffer
+	log            bufferedLogger
+}
+
+// redirect returns conf with its destinations and logger replaced by o's
+// buffers.
+func (o *categoryOutput) redirect(conf Config) Config {
+	conf.envSink = &lockedWriter{w: &o.sink}
+	conf.envDest = &lockedWriter{w: &o.env}
+	conf.gitDest = &lockedWriter{w: &o.git}
+	conf.log = &o.log
+	return conf
+}
+
+// flush writes o's buffers to conf's destinations.
+func (o *categoryOutput) flush(conf Config) error {
+	for _, f := range []struct {
+		buf *bytes.Buffer
+		dst io.Writer
+	}{
+		{&o.sink, conf.envSink},
+		{&o.env, conf.envDest},
+		{&o.git, conf.gitDest},
+	} {
+		if f.buf.Len() == 0 {
+			continue
+		}
+		if _, err := f.dst.Write(f.buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *categoryOutput) zero() {
+	zero(o.sink.Bytes())
+	zero(o.env.Bytes())
+	zero(o.git.Bytes())
+}
+
+// bufferedLogger holds log events until they're replayed to another Logger.
+// Redaction is left to that Logger, so events are redacted of every secret
+// downloaded by the time they're replayed.
+type bufferedLogger struct {
+	mu     sync.Mutex
+	events []logEvent
+}
+
+type logEvent struct {
+	level  string
+	msg    string
+	fields []Field
+}
+
+func (b *bufferedLogger) add(level, msg string, fields []Field) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.events = append(b.events, logEvent{level, msg, fields})
+}
+
+func (b *bufferedLogger) Debug(msg string, fields ...Field) { b.add("debug", msg, fields) }
+func (b *bufferedLogger) Info(msg string, fields ...Field)  { b.add("info", msg, fields) }
+func (b *bufferedLogger) Warn(msg string, fields ...Field)  { b.add("warn", msg, fields) }
+
+// replay logs the events held to l, and forgets them.
+func (b *bufferedLogger) replay(l Logger) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, e := range b.events {
+		switch e.level {
+		case "debug":
+			l.Debug(e.msg, e.fields...)
+		case "info":
+			l.Info(e.msg, e.fields...)
+		case "warn":
+			l.Warn(e.msg, e.fields...)
+		}
+	}
+	b.events = nil
+}
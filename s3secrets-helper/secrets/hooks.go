@@ -0,0 +1,36 @@
+package secrets
+
+import "fmt"
+
+// sshKeysLoaded calls Config.OnSSHKeysLoaded, if set.
+func sshKeysLoaded(conf Config) error {
+	if conf.OnSSHKeysLoaded == nil {
+		return nil
+	}
+	if err := conf.OnSSHKeysLoaded(conf.applied.sshKeys); err != nil {
+		return fmt.Errorf("OnSSHKeysLoaded: %w", err)
+	}
+	return nil
+}
+
+// envLoaded calls Config.OnEnvLoaded, if set.
+func envLoaded(conf Config) error {
+	if conf.OnEnvLoaded == nil {
+		return nil
+	}
+	if err := conf.OnEnvLoaded(append([]string(nil), conf.applied.envVars...)); err != nil {
+		return fmt.Errorf("OnEnvLoaded: %w", err)
+	}
+	return nil
+}
+
+// gitCredentialsLoaded calls Config.OnGitCredentialsLoaded, if set.
+func gitCredentialsLoaded(conf Config) error {
+	if conf.OnGitCredentialsLoaded == nil {
+		return nil
+	}
+	if err := conf.OnGitCredentialsLoaded(conf.applied.gitCredentials); err != nil {
+		return fmt.Errorf("OnGitCredentialsLoaded: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// maxIncludeDepth limits how deeply env files may #include each other.
+const maxIncludeDepth = 5
+
+// regexpInclude matches an env file line like: #include base-env
+var regexpInclude = regexp.MustCompile(`^#include[ \t]+(\S+)[ \t]*\r?\n?$`)
+
+// expandIncludes replaces each "#include <key>" line of an env file with the
+// contents of that key, relative to the including key's directory.
+// Includes are expanded recursively; stack holds the keys being expanded, for
+// cycle detection. A missing include is warned about and skipped.
+func expandIncludes(ctx context.Context, conf Config, r getResult, stack []string) ([]byte, error) {
+	if !bytes.Contains(r.data, []byte("#include")) {
+		return r.data, nil
+	}
+	for _, k := range stack {
+		if k == r.key {
+			return nil, fmt.Errorf("env include cycle: %s -> %s", strings.Join(stack, " -> "), r.key)
+		}
+	}
+	if len(stack) >= maxIncludeDepth {
+		return nil, fmt.Errorf("env include depth exceeds %d at %s/%s", maxIncludeDepth, r.bucket, r.key)
+	}
+	stack = append(stack, r.key)
+
+	var out bytes.Buffer
+	for _, line := range bytes.SplitAfter(r.data, []byte("\n")) {
+		match := regexpInclude.FindSubmatch(line)
+		if match == nil {
+			out.Write(line)
+			continue
+		}
+		key := path.Join(path.Dir(r.key), string(match[1]))
+		data, err := clientFor(conf, r.bucket).Get(ctx, key)
+		if err != nil {
+			conf.log.Warn(
+				fmt.Sprintf("Failed to include %s/%s in %s/%s: %v", r.bucket, key, r.bucket, r.key, err),
+				typeField(CategoryEnv), bucketField(r.bucket), keyField(key), Field{"included_in", r.key}, errField(err),
+			)
+			continue
+		}
+		included := getResult{bucket: r.bucket, key: key, data: data}
+		if rejectPublic(ctx, conf, included) {
+			continue
+		}
+		conf.redactor.add(CategoryEnv, data)
+		expanded, err := expandIncludes(ctx, conf, included, stack)
+		if err != nil {
+			return nil, err
+		}
+		conf.log.Info(
+			fmt.Sprintf("Including %s/%s (%d bytes) in %s/%s", r.bucket, key, len(data), r.bucket, r.key),
+			typeField(CategoryEnv), bucketField(r.bucket), keyField(key), bytesField(len(data)), Field{"included_in", r.key},
+		)
+		out.Write(expanded)
+		if len(expanded) > 0 && expanded[len(expanded)-1] != '\n' {
+			out.WriteByte('\n')
+		}
+		zero(expanded)
+		zero(data)
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,92 @@
+package secrets
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sentinel"
+)
+
+// Metadata, as returned by a MetadataGetter, describing the object as
+// stored, against which the downloaded data is verified.
+const (
+	metaContentLength  = "content-length"
+	metaETag           = "etag"
+	metaChecksumSHA256 = "x-amz-checksum-sha256"
+	metaSSE            = "x-amz-server-side-encryption"
+	metaSSECustomer    = "x-amz-server-side-encryption-customer-algorithm"
+)
+
+// IntegrityError is returned when downloaded data doesn't match the object
+// as stored, e.g. because the download was truncated. It is transient; it
+// matches sentinel.ErrTransient, so the download is retried.
+type IntegrityError struct {
+	Key    string
+	Reason string
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("%s failed integrity check: %s", e.Key, e.Reason)
+}
+
+func (e *IntegrityError) Is(target error) bool {
+	return target == sentinel.ErrTransient
+}
+
+// verifyIntegrity checks data against the length, checksum and ETag in meta,
+// as far as they are known. A SHA-256 checksum is preferred; the ETag is only
+// an MD5 of the data for objects uploaded in one part without KMS or
+// customer-provided key encryption, otherwise only the length is compared.
+func verifyIntegrity(key string, data []byte, meta map[string]string) error {
+	if s, ok := meta[metaContentLength]; ok {
+		if n, err := strconv.Atoi(s); err == nil && n != len(data) {
+			return &IntegrityError{Key: key, Reason: fmt.Sprintf("got %d bytes, expected %d", len(data), n)}
+		}
+	}
+	// a checksum with a "-N" suffix is a checksum of the parts' checksums.
+	if sum := meta[metaChecksumSHA256]; sum != "" && !strings.Contains(sum, "-") {
+		actual := sha256.Sum256(data)
+		if base64.StdEncoding.EncodeToString(actual[:]) != sum {
+			return &IntegrityError{Key: key, Reason: "SHA-256 checksum mismatch"}
+		}
+		return nil
+	}
+	etag := strings.Trim(meta[metaETag], `"`)
+	sse := meta[metaSSE]
+	if len(etag) != md5.Size*2 || (sse != "" && sse != "AES256") || meta[metaSSECustomer] != "" {
+		return nil
+	}
+	actual := md5.Sum(data)
+	if !strings.EqualFold(hex.EncodeToString(actual[:]), etag) {
+		return &IntegrityError{Key: key, Reason: "ETag mismatch"}
+	}
+	return nil
+}
+
+// integrityClient verifies each download; see verifyIntegrity.
+type integrityClient struct {
+	Client
+}
+
+func (c *integrityClient) Get(ctx context.Context, key string) ([]byte, error) {
+	data, _, err := c.GetWithMetadata(ctx, key)
+	return data, err
+}
+
+func (c *integrityClient) GetWithMetadata(ctx context.Context, key string) ([]byte, map[string]string, error) {
+	data, meta, err := getWithMetadata(ctx, c.Client, key)
+	if err != nil {
+		return data, meta, err
+	}
+	if err := verifyIntegrity(key, data, meta); err != nil {
+		zero(data)
+		return nil, nil, err
+	}
+	return data, meta, nil
+}
@@ -0,0 +1,146 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultEnvJSONBundle is the bundle key, within the prefix, used when
+// Config.EnvJSONBundle is unset.
+const defaultEnvJSONBundle = "secrets.json"
+
+var (
+	regexpEnvName      = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	regexpJSONPathPart = regexp.MustCompile(`^([^\[\]]*)((?:\[\d+\])*)$`)
+	regexpJSONPathIdx  = regexp.MustCompile(`\[(\d+)\]`)
+)
+
+func envJSONBundleKey(conf Config) string {
+	if conf.EnvJSONBundle != "" {
+		return conf.EnvJSONBundle
+	}
+	return candidateKey(conf, conf.Prefix, defaultEnvJSONBundle)
+}
+
+// handleEnvJSON extracts env vars from a JSON bundle according to
+// Config.EnvJSONExtract, writing them in name order.
+func handleEnvJSON(ctx context.Context, conf Config, results <-chan getResult) error {
+	log := conf.log
+	for r := range results {
+		if r.err != nil {
+			if !absent(r.err) {
+				log.Warn(
+					fmt.Sprintf("Failed to download env JSON bundle from %s/%s: %v", r.bucket, r.key, r.err),
+					typeField(CategoryEnv), bucketField(r.bucket), keyField(r.key), errField(r.err),
+				)
+			} else {
+				log.Warn(fmt.Sprintf("Env JSON bundle %s/%s not found", r.bucket, r.key), typeField(CategoryEnv), bucketField(r.bucket), keyField(r.key))
+			}
+			continue
+		}
+		r, ok := prepare(ctx, conf, CategoryEnv, r)
+		if !ok {
+			continue
+		}
+		var bundle interface{}
+		err := json.Unmarshal(r.data, &bundle)
+		zero(r.data)
+		if err != nil {
+			log.Warn(
+				fmt.Sprintf("Failed to parse env JSON bundle %s/%s: %v", r.bucket, r.key, err),
+				typeField(CategoryEnv), bucketField(r.bucket), keyField(r.key), errField(err),
+			)
+			continue
+		}
+
+		names := make([]string, 0, len(conf.EnvJSONExtract))
+		for name := range conf.EnvJSONExtract {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var env bytes.Buffer
+		loaded := 0
+		for _, name := range names {
+			path := conf.EnvJSONExtract[name]
+			if !regexpEnvName.MatchString(name) {
+				return fmt.Errorf("invalid env var name %q for JSON path %q", name, path)
+			}
+			value, err := extractJSONPath(bundle, path)
+			if err != nil {
+				log.Warn(
+					fmt.Sprintf("Skipping %s from %s/%s: %v", name, r.bucket, r.key, err),
+					typeField(CategoryEnv), bucketField(r.bucket), keyField(r.key), Field{"name", name}, errField(err),
+				)
+				continue
+			}
+			conf.redactor.add(CategoryEnv, []byte(value))
+			fmt.Fprintf(&env, "%s=%s\n", name, shellQuote(value))
+			loaded++
+		}
+		log.Info(
+			fmt.Sprintf("%s %d env vars from JSON bundle %s/%s", loading(conf), loaded, r.bucket, r.key),
+			typeField(CategoryEnv), bucketField(r.bucket), keyField(r.key), Field{"vars", loaded}, Field{"dry_run", conf.DryRun},
+		)
+		_, err = env.WriteTo(conf.envDest)
+		zero(env.Bytes())
+		if err != nil {
+			return fmt.Errorf("writing env from JSON bundle: %w", err)
+		}
+		conf.results.apply(CategoryEnv, r.bucket, r.key)
+	}
+	return nil
+}
+
+// extractJSONPath returns the value at a JSONPath-style path, such as
+// "$.db.users[0].password", from decoded JSON. Strings are returned as is,
+// other values as JSON.
+func extractJSONPath(doc interface{}, path string) (string, error) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	node := doc
+	if path != "" {
+		for _, part := range strings.Split(path, ".") {
+			match := regexpJSONPathPart.FindStringSubmatch(part)
+			if match == nil {
+				return "", fmt.Errorf("invalid JSON path segment %q", part)
+			}
+			if field := match[1]; field != "" {
+				obj, ok := node.(map[string]interface{})
+				if !ok {
+					return "", fmt.Errorf("%q: not an object", field)
+				}
+				if node, ok = obj[field]; !ok {
+					return "", fmt.Errorf("%q: not found", field)
+				}
+			}
+			for _, idx := range regexpJSONPathIdx.FindAllStringSubmatch(match[2], -1) {
+				i, _ := strconv.Atoi(idx[1])
+				arr, ok := node.([]interface{})
+				if !ok || i >= len(arr) {
+					return "", fmt.Errorf("%q: index %d not found", part, i)
+				}
+				node = arr[i]
+			}
+		}
+	}
+	switch v := node.(type) {
+	case nil:
+		return "", fmt.Errorf("%q is null", path)
+	case string:
+		return v, nil
+	default:
+		b, err := json.Marshal(v)
+		return string(b), err
+	}
+}
+
+// shellQuote single-quotes s for the shell which evaluates the env output.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
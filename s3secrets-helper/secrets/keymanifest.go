@@ -0,0 +1,282 @@
+package secrets
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// keyManifestName is the name of the key manifest within a prefix; see
+// Config.KeyManifest.
+const keyManifestName = "manifest.yaml"
+
+// keyManifestFile is the type, in a key manifest, of a secret written to a
+// file, like a DestinationFile of SecretFanout.
+const keyManifestFile = "file"
+
+// keyManifest declares the keys to download, and what each is, e.g.
+//
+//	secrets:
+//	  - key: deploy_key
+//	    type: ssh-key
+//	  - key: env
+//	    type: env
+//	  - key: certs/ca.pem
+//	    type: file
+//	    path: certs/ca.pem
+//	    mode: "0644"
+//
+// Keys are relative to the manifest's directory, and mustn't leave it. Paths
+// of files are relative to Config.KeyManifestFileDir, and mustn't leave it
+// either, so that whoever can write the manifest can't overwrite any file the
+// agent can. Only this subset of YAML is understood: a list of mappings of
+// scalars.
+type keyManifest struct {
+	bucket, key string
+	entries     []keyManifestEntry
+}
+
+// keyManifestEntry is a secret declared by a keyManifest.
+type keyManifestEntry struct {
+	key        string
+	secretType string // CategorySSHKey, CategoryEnv, CategoryGitCredentials or keyManifestFile
+	path       string // for keyManifestFile, relative to Config.KeyManifestFileDir
+	mode       os.FileMode
+}
+
+// keys returns the keys of the given type, in the order declared.
+func (m *keyManifest) keys(secretType string) []string {
+	var keys []string
+	for _, e := range m.entries {
+		if e.secretType == secretType {
+			keys = append(keys, e.key)
+		}
+	}
+	return keys
+}
+
+// declaredKeys returns the keys of secretType declared by the key manifest if
+// one was found, or else probed.
+func declaredKeys(conf Config, secretType string, probed []string) []string {
+	if conf.keyManifest == nil {
+		return probed
+	}
+	return dedupeKeys(conf.keyManifest.keys(secretType))
+}
+
+// withManifestFiles returns SecretFanout with a DestinationFile added for each
+// file declared by the key manifest, under KeyManifestFileDir.
+func withManifestFiles(conf Config) map[string][]Destination {
+	if conf.keyManifest == nil {
+		return conf.SecretFanout
+	}
+	fanout := make(map[string][]Destination, len(conf.SecretFanout))
+	for k, dests := range conf.SecretFanout {
+		fanout[k] = dests
+	}
+	for _, e := range conf.keyManifest.entries {
+		if e.secretType == keyManifestFile {
+			dests := append([]Destination(nil), fanout[e.key]...)
+			fanout[e.key] = append(dests, Destination{
+				Kind: DestinationFile,
+				Path: filepath.Join(conf.KeyManifestFileDir, filepath.FromSlash(e.path)),
+				Mode: e.mode,
+			})
+		}
+	}
+	return fanout
+}
+
+// findKeyManifest returns the key manifest of the most specific prefix, from
+// the first of clients which has it, or nil if there's none. The clients are
+// wrapped like those of every other key, so the manifest is downloaded with
+// the same limits, retries and pinned versions. A manifest which exists but
+// can't be downloaded or parsed is an error, rather than silently probing
+// for other secrets, as is one declaring files if KeyManifestFileDir isn't
+// set.
+func findKeyManifest(ctx context.Context, conf Config, clients []Client, leases *leases) (*keyManifest, error) {
+	wrapped := make([]Client, len(clients))
+	for i, c := range clients {
+		wrapped[i] = wrapClient(conf, c, i, leases, nil)
+	}
+	candidates := prefixed(conf, []string{keyManifestName})
+	for i := len(candidates) - 1; i >= 0; i-- {
+		key := candidates[i]
+		for _, c := range wrapped {
+			data, err := c.Get(ctx, key)
+			if absent(err) {
+				continue
+			}
+			if err != nil {
+				return nil, withKind(ErrDownloadFailed, fmt.Errorf("downloading key manifest %s/%s: %w", c.Bucket(), key, err))
+			}
+			m, err := parseKeyManifest(data, path.Dir(key))
+			if err != nil {
+				return nil, fmt.Errorf("parsing key manifest %s/%s: %w", c.Bucket(), key, err)
+			}
+			if conf.KeyManifestFileDir == "" && len(m.keys(keyManifestFile)) > 0 {
+				return nil, fmt.Errorf("key manifest %s/%s declares files, but KeyManifestFileDir isn't set", c.Bucket(), key)
+			}
+			m.bucket, m.key = c.Bucket(), key
+			return m, nil
+		}
+	}
+	return nil, nil
+}
+
+// parseKeyManifest parses a key manifest whose keys are relative to dir.
+func parseKeyManifest(data []byte, dir string) (*keyManifest, error) {
+	m := &keyManifest{}
+	var entry *keyManifestEntry
+	inSecrets := false
+	// indent is that of the fields of the current entry.
+	indent := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: indented with a tab", n)
+		}
+		lineIndent := len(line) - len(trimmed)
+		switch {
+		case lineIndent == 0 && trimmed == "secrets:" && !inSecrets:
+			inSecrets = true
+			continue
+		case !inSecrets:
+			return nil, fmt.Errorf("line %d: expected secrets:", n)
+		case trimmed == "-" || strings.HasPrefix(trimmed, "- "):
+			m.entries = append(m.entries, keyManifestEntry{})
+			entry = &m.entries[len(m.entries)-1]
+			rest := strings.TrimLeft(strings.TrimPrefix(trimmed, "-"), " ")
+			if rest == "" {
+				// the fields start on the next line.
+				indent = -1
+				continue
+			}
+			indent = len(line) - len(rest)
+			trimmed = rest
+		case entry == nil || indent >= 0 && lineIndent != indent:
+			return nil, fmt.Errorf("line %d: expected a list of secrets", n)
+		case indent < 0:
+			indent = lineIndent
+		}
+		if err := entry.set(trimmed); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for i := range m.entries {
+		e := &m.entries[i]
+		switch {
+		case e.key == "":
+			return nil, fmt.Errorf("secret %d has no key", i+1)
+		case e.secretType == "":
+			return nil, fmt.Errorf("%s has no type", e.key)
+		case e.secretType == keyManifestFile && e.path == "":
+			return nil, fmt.Errorf("%s is a file, but has no path", e.key)
+		case e.secretType != keyManifestFile && (e.path != "" || e.mode != 0):
+			return nil, fmt.Errorf("%s has a path or mode, but isn't a file", e.key)
+		case leavesDir(e.key):
+			return nil, fmt.Errorf("%s is outside the manifest's directory", e.key)
+		case e.path != "" && leavesDir(filepath.FromSlash(e.path)):
+			return nil, fmt.Errorf("%s's path %s is outside the key manifest file directory", e.key, e.path)
+		}
+		e.key = path.Join(dir, e.key)
+	}
+	return m, nil
+}
+
+// leavesDir reports whether the relative path p is absolute, or leaves its
+// directory with "..".
+func leavesDir(p string) bool {
+	p = filepath.Clean(p)
+	return filepath.IsAbs(p) || path.IsAbs(filepath.ToSlash(p)) || filepath.VolumeName(p) != "" ||
+		p == ".." || strings.HasPrefix(p, ".."+string(filepath.Separator))
+}
+
+// set sets the field of e assigned by field, e.g. "type: env".
+func (e *keyManifestEntry) set(field string) error {
+	i := strings.Index(field, ":")
+	if i < 0 {
+		return errors.New("expected field: value")
+	}
+	name := field[:i]
+	value, err := parseYAMLScalar(strings.TrimSpace(field[i+1:]))
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	switch name {
+	case "key":
+		e.key = value
+	case "type":
+		switch value {
+		case CategorySSHKey, CategoryEnv, CategoryGitCredentials, keyManifestFile:
+			e.secretType = value
+		default:
+			return fmt.Errorf("type %q isn't one of %s, %s, %s or %s", value, CategorySSHKey, CategoryEnv, CategoryGitCredentials, keyManifestFile)
+		}
+	case "path":
+		e.path = value
+	case "mode":
+		mode, err := strconv.ParseUint(value, 8, 32)
+		if err != nil || mode > 0777 {
+			return fmt.Errorf("mode %q isn't an octal file mode", value)
+		}
+		e.mode = os.FileMode(mode)
+	default:
+		return fmt.Errorf("unknown field %q", name)
+	}
+	return nil
+}
+
+// parseYAMLScalar returns the value of a plain, single quoted or double
+// quoted YAML scalar, less any trailing comment.
+func parseYAMLScalar(s string) (string, error) {
+	var value string
+	var rest string
+	switch {
+	case strings.HasPrefix(s, `"`):
+		end := 1
+		for ; end < len(s) && s[end] != '"'; end++ {
+			if s[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(s) {
+			return "", errors.New("unterminated double quote")
+		}
+		v, err := strconv.Unquote(s[:end+1])
+		if err != nil {
+			return "", err
+		}
+		value, rest = v, s[end+1:]
+	case strings.HasPrefix(s, "'"):
+		end := strings.Index(strings.ReplaceAll(s[1:], "''", "  "), "'")
+		if end < 0 {
+			return "", errors.New("unterminated single quote")
+		}
+		value, rest = strings.ReplaceAll(s[1:end+1], "''", "'"), s[end+2:]
+	default:
+		if i := strings.Index(s, " #"); i >= 0 {
+			s = s[:i]
+		}
+		return strings.TrimSpace(s), nil
+	}
+	if rest = strings.TrimSpace(rest); rest != "" && !strings.HasPrefix(rest, "#") {
+		return "", errors.New("unexpected characters after closing quote")
+	}
+	return value, nil
+}
@@ -0,0 +1,66 @@
+package secrets
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseKeyManifest(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		input    string
+		expected []keyManifestEntry
+		err      string
+	}{
+		{
+			"all types",
+			"secrets:\n  - key: deploy_key\n    type: ssh-key\n  - key: env\n    type: env\n  - key: git-credentials\n    type: git-credentials\n  - key: certs/ca.pem\n    type: file\n    path: ssl/ca.pem\n    mode: \"0644\"\n",
+			[]keyManifestEntry{
+				{key: "pipeline/deploy_key", secretType: CategorySSHKey},
+				{key: "pipeline/env", secretType: CategoryEnv},
+				{key: "pipeline/git-credentials", secretType: CategoryGitCredentials},
+				{key: "pipeline/certs/ca.pem", secretType: keyManifestFile, path: "ssl/ca.pem", mode: 0644},
+			},
+			"",
+		},
+		{
+			"comments and quoting",
+			"# secrets for the pipeline\nsecrets:\n- type: env # the usual\n  key: 'shared/it''s env'\n\n-\n  key: \"a \\\"b\\\"\"\n  type: env\n",
+			[]keyManifestEntry{
+				{key: "pipeline/shared/it's env", secretType: CategoryEnv},
+				{key: `pipeline/a "b"`, secretType: CategoryEnv},
+			},
+			"",
+		},
+		{"empty", "secrets:\n", nil, ""},
+		{"no secrets", "keys:\n  - key: env\n", nil, "line 1: expected secrets:"},
+		{"misindented", "secrets:\n  - key: env\n      type: env\n", nil, "line 3: expected a list of secrets"},
+		{"unknown field", "secrets:\n  - key: env\n    kind: env\n", nil, `line 3: unknown field "kind"`},
+		{"unknown type", "secrets:\n  - key: env\n    type: npmrc\n", nil, `line 3: type "npmrc" isn't one of ssh-key, env, git-credentials or file`},
+		{"bad mode", "secrets:\n  - key: env\n    mode: rw\n", nil, `line 3: mode "rw" isn't an octal file mode`},
+		{"unterminated quote", "secrets:\n  - key: 'env\n", nil, "line 2: key: unterminated single quote"},
+		{"trailing characters", "secrets:\n  - key: \"env\" x\n", nil, "line 2: key: unexpected characters after closing quote"},
+		{"no key", "secrets:\n  - type: env\n", nil, "secret 1 has no key"},
+		{"no type", "secrets:\n  - key: env\n", nil, "env has no type"},
+		{"file without path", "secrets:\n  - key: ca.pem\n    type: file\n", nil, "ca.pem is a file, but has no path"},
+		{"path of env", "secrets:\n  - key: env\n    type: env\n    path: /tmp/env\n", nil, "env has a path or mode, but isn't a file"},
+		{"key outside prefix", "secrets:\n  - key: ../shared/env\n    type: env\n", nil, "../shared/env is outside the manifest's directory"},
+		{"key escaping prefix", "secrets:\n  - key: certs/../../env\n    type: env\n", nil, "certs/../../env is outside the manifest's directory"},
+		{"absolute key", "secrets:\n  - key: /env\n    type: env\n", nil, "/env is outside the manifest's directory"},
+		{"absolute path", "secrets:\n  - key: rc\n    type: file\n    path: /root/.bashrc\n", nil, "rc's path /root/.bashrc is outside the key manifest file directory"},
+		{"path escaping dir", "secrets:\n  - key: rc\n    type: file\n    path: ssl/../../.ssh/authorized_keys\n", nil, "rc's path ssl/../../.ssh/authorized_keys is outside the key manifest file directory"},
+	} {
+		m, err := parseKeyManifest([]byte(tc.input), "pipeline")
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: expected error %q, got %v", tc.name, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		} else if !reflect.DeepEqual(tc.expected, m.entries) {
+			t.Errorf("%s: expected %+v, got %+v", tc.name, tc.expected, m.entries)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Lister is an optional Client capability to list the keys directly under a
+// prefix, i.e. not descending past the next "/".
+type Lister interface {
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// normalizeKey trims surrounding whitespace (including non-breaking spaces)
+// and normalizes unicode to NFC, so that keys which look identical compare
+// equal.
+func normalizeKey(key string) string {
+	return norm.NFC.String(strings.TrimSpace(key))
+}
+
+// normalizePath applies normalizeKey to each "/"-separated segment of key.
+func normalizePath(key string) string {
+	segments := strings.Split(key, "/")
+	for i, s := range segments {
+		segments[i] = normalizeKey(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// keySeparator returns Config.KeySeparator, or "/" if it's unset.
+func keySeparator(conf Config) string {
+	if conf.KeySeparator != "" {
+		return conf.KeySeparator
+	}
+	return "/"
+}
+
+// caseKey returns key lowercased if Config.LowercaseKeys is set.
+func caseKey(conf Config, key string) string {
+	if conf.LowercaseKeys {
+		return strings.ToLower(key)
+	}
+	return key
+}
+
+// candidateKey returns the key probed for name within prefix.
+func candidateKey(conf Config, prefix, name string) string {
+	return caseKey(conf, prefix+keySeparator(conf)+name)
+}
+
+// splitKey splits key after its last KeySeparator, into the prefix
+// (including the separator) and the name.
+func splitKey(conf Config, key string) (prefix, name string) {
+	sep := keySeparator(conf)
+	i := strings.LastIndex(key, sep)
+	if i < 0 {
+		return "", key
+	}
+	return key[:i+len(sep)], key[i+len(sep):]
+}
+
+// discoverKeys lists the bucket root and prefixes, returning a map of
+// normalized key to actual key. It returns nil if key normalization is
+// disabled or the Client can't list.
+func discoverKeys(ctx context.Context, conf Config) map[string]string {
+	if !conf.NormalizeKeys {
+		return nil
+	}
+	lister, ok := conf.Client.(Lister)
+	if !ok {
+		return nil
+	}
+	discovered := make(map[string]string)
+	for _, prefix := range append([]string{""}, prefixed(conf, []string{""})...) {
+		keys, err := lister.List(ctx, prefix)
+		if err != nil {
+			conf.log.Warn(
+				fmt.Sprintf("Failed to list %s/%s: %v", conf.Client.Bucket(), prefix, err),
+				bucketField(conf.Client.Bucket()), Field{"prefix", prefix}, errField(err),
+			)
+			continue
+		}
+		for _, k := range keys {
+			discovered[normalizePath(k)] = k
+		}
+	}
+	return discovered
+}
+
+// normalizeKeys applies normalizeKey to each of keys when Config.NormalizeKeys
+// is set, and substitutes the actual key for any discovered key that
+// normalizes to the same value.
+func normalizeKeys(conf Config, keys []string) []string {
+	if !conf.NormalizeKeys {
+		return keys
+	}
+	normalized := make([]string, len(keys))
+	for i, k := range keys {
+		n := normalizePath(k)
+		if actual, ok := conf.discovered[n]; ok {
+			n = actual
+		}
+		normalized[i] = n
+	}
+	return normalized
+}
+
+// listEnvFragments lists the keys under EnvPrefix in each of clients, which
+// must be Listers, returning them sorted so that fragments apply in lexical
+// order.
+func listEnvFragments(ctx context.Context, conf Config, clients []Client) ([]string, error) {
+	return listPrefix(ctx, clients, conf.EnvPrefix, "EnvPrefix")
+}
+
+// listSSHKeys lists the keys under SSHKeyPrefix in each of clients, which
+// must be Listers, in sorted order. Passphrases of encrypted keys are left
+// out; they're fetched along with their keys.
+func listSSHKeys(ctx context.Context, conf Config, clients []Client) ([]string, error) {
+	listed, err := listPrefix(ctx, clients, conf.SSHKeyPrefix, "SSHKeyPrefix")
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, k := range listed {
+		if !strings.HasSuffix(k, passphraseSuffix) {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+// listPrefix lists the keys under prefix, the value of the named option, in
+// each of clients, which must be Listers. A key found in more than one
+// bucket is listed once; it is fetched from the first bucket that has it
+// like any other key. If prefix is empty, there are none.
+func listPrefix(ctx context.Context, clients []Client, prefix, option string) ([]string, error) {
+	if prefix == "" {
+		return nil, nil
+	}
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+	seen := make(map[string]bool)
+	var keys []string
+	for _, c := range clients {
+		lister, ok := c.(Lister)
+		if !ok {
+			return nil, fmt.Errorf("%s requires a Client that can list keys", option)
+		}
+		listed, err := lister.List(ctx, prefix)
+		if err != nil {
+			return nil, fmt.Errorf("listing %s/%s: %w", c.Bucket(), prefix, err)
+		}
+		for _, k := range listed {
+			// directory placeholders, as created by the S3 console.
+			if strings.HasSuffix(k, "/") || seen[k] {
+				continue
+			}
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// withEncryptedSuffix follows each of keys with it plus
+// Config.EncryptedKeySuffix, if that's set.
+func withEncryptedSuffix(conf Config, keys []string) []string {
+	if conf.EncryptedKeySuffix == "" {
+		return keys
+	}
+	suffixed := make([]string, 0, 2*len(keys))
+	for _, k := range keys {
+		suffixed = append(suffixed, k, k+conf.EncryptedKeySuffix)
+	}
+	return suffixed
+}
@@ -0,0 +1,112 @@
+package secrets
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// Metadata of objects encrypted by the S3 encryption client, with a data key
+// encrypted by KMS.
+const (
+	metaEnvelopeKey  = "x-amz-key-v2"
+	metaEnvelopeIV   = "x-amz-iv"
+	metaEnvelopeAlg  = "x-amz-cek-alg"
+	metaEnvelopeWrap = "x-amz-wrap-alg"
+	metaEnvelopeDesc = "x-amz-matdesc"
+
+	envelopeAlgGCM = "AES/GCM/NoPadding"
+)
+
+// KMSDecrypter decrypts data encrypted by KMS, e.g. with the AWS KMS Decrypt
+// API. If keyID is set, the data must have been encrypted with that key.
+type KMSDecrypter interface {
+	Decrypt(ctx context.Context, keyID string, ciphertext []byte, encryptionContext map[string]string) ([]byte, error)
+}
+
+// decryptEnvelope decrypts r if its metadata marks it as KMS envelope
+// encrypted, or else with KMS directly if Config.KMSDecrypt is set. Secrets
+// which can't be decrypted are skipped.
+func decryptEnvelope(ctx context.Context, conf Config, r getResult) (getResult, bool) {
+	wrap := r.meta[metaEnvelopeWrap]
+	if r.meta[metaEnvelopeKey] == "" || (wrap != "kms" && wrap != "kms+context") {
+		if conf.KMSDecrypt {
+			return decryptCiphertext(ctx, conf, r)
+		}
+		return r, true
+	}
+	if conf.KMS == nil {
+		conf.log.Warn(
+			fmt.Sprintf("Skipping %s/%s; it is KMS envelope encrypted, but no KMS decrypter is configured", r.bucket, r.key),
+			bucketField(r.bucket), keyField(r.key),
+		)
+		zero(r.data)
+		return r, false
+	}
+	plaintext, err := openEnvelope(ctx, conf, r)
+	zero(r.data)
+	if err != nil {
+		conf.log.Warn(
+			fmt.Sprintf("Skipping %s/%s; failed to decrypt it: %v", r.bucket, r.key, err),
+			bucketField(r.bucket), keyField(r.key), errField(err),
+		)
+		return r, false
+	}
+	r.data = plaintext
+	return r, true
+}
+
+func openEnvelope(ctx context.Context, conf Config, r getResult) ([]byte, error) {
+	if alg := r.meta[metaEnvelopeAlg]; alg != envelopeAlgGCM {
+		return nil, fmt.Errorf("unsupported content encryption algorithm %q", alg)
+	}
+	encryptedKey, err := base64.StdEncoding.DecodeString(r.meta[metaEnvelopeKey])
+	if err != nil {
+		return nil, fmt.Errorf("decoding data key: %w", err)
+	}
+	iv, err := base64.StdEncoding.DecodeString(r.meta[metaEnvelopeIV])
+	if err != nil {
+		return nil, fmt.Errorf("decoding IV: %w", err)
+	}
+	var encryptionContext map[string]string
+	if desc := r.meta[metaEnvelopeDesc]; desc != "" {
+		if err := json.Unmarshal([]byte(desc), &encryptionContext); err != nil {
+			return nil, fmt.Errorf("decoding material description: %w", err)
+		}
+	}
+
+	key, err := conf.KMS.Decrypt(ctx, conf.KMSKeyID, encryptedKey, encryptionContext)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting data key: %w", err)
+	}
+	defer zero(key)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, iv, r.data, nil)
+}
+
+// decryptCiphertext decrypts r, which must be a ciphertext blob from the KMS
+// Encrypt API, with no encryption context. Secrets which can't be decrypted
+// are skipped.
+func decryptCiphertext(ctx context.Context, conf Config, r getResult) (getResult, bool) {
+	plaintext, err := conf.KMS.Decrypt(ctx, conf.KMSKeyID, r.data, nil)
+	zero(r.data)
+	if err != nil {
+		conf.log.Warn(
+			fmt.Sprintf("Skipping %s/%s; failed to decrypt it with KMS: %v", r.bucket, r.key, err),
+			bucketField(r.bucket), keyField(r.key), errField(err),
+		)
+		return r, false
+	}
+	r.data = plaintext
+	return r, true
+}
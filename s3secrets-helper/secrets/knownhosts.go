@@ -0,0 +1,116 @@
+package secrets
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var defaultKnownHostsNames = []string{"known_hosts"}
+
+func knownHostsCandidates(conf Config) []string {
+	return dedupeKeys(normalizeKeys(conf, rootAndPrefixed(conf, defaultKnownHostsNames)))
+}
+
+// knownHostsLines returns the non-empty, non-comment lines of a known_hosts
+// file, without surrounding whitespace.
+func knownHostsLines(data []byte) []string {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := string(bytes.TrimSpace(scanner.Bytes()))
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// handleKnownHosts appends the host keys in each known_hosts found to
+// KnownHostsPath, skipping those it already has, so that git trusts the
+// hosts it connects to with the SSH keys.
+func handleKnownHosts(ctx context.Context, conf Config, results <-chan getResult) error {
+	log := conf.log
+	existing, err := ioutil.ReadFile(conf.KnownHostsPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("reading known_hosts: %w", err)
+	}
+	seen := make(map[string]bool)
+	for _, line := range knownHostsLines(existing) {
+		seen[line] = true
+	}
+
+	var added []string
+	for r := range results {
+		if r.err != nil {
+			if !absent(r.err) {
+				log.Warn(
+					fmt.Sprintf("Failed to download known_hosts %s/%s: %v", r.bucket, r.key, r.err),
+					typeField(CategoryKnownHosts), bucketField(r.bucket), keyField(r.key), errField(r.err),
+				)
+			}
+			continue
+		}
+		r, ok := prepare(ctx, conf, CategoryKnownHosts, r)
+		if !ok {
+			continue
+		}
+		var lines []string
+		for _, line := range knownHostsLines(r.data) {
+			if !seen[line] {
+				seen[line] = true
+				lines = append(lines, line)
+			}
+		}
+		zero(r.data)
+		msg := fmt.Sprintf("Adding %d host keys from %s/%s to %s", len(lines), r.bucket, r.key, conf.KnownHostsPath)
+		if conf.DryRun {
+			msg = fmt.Sprintf("(dry-run) would add %d host keys from %s/%s to %s", len(lines), r.bucket, r.key, conf.KnownHostsPath)
+		}
+		log.Info(
+			msg,
+			typeField(CategoryKnownHosts), bucketField(r.bucket), keyField(r.key),
+			Field{"host_keys", len(lines)}, Field{"dry_run", conf.DryRun},
+		)
+		added = append(added, lines...)
+		conf.results.apply(CategoryKnownHosts, r.bucket, r.key)
+	}
+	if len(added) == 0 || conf.DryRun {
+		return nil
+	}
+	if err := appendKnownHosts(conf.KnownHostsPath, existing, added); err != nil {
+		return fmt.Errorf("writing known_hosts: %w", err)
+	}
+	return nil
+}
+
+// appendKnownHosts appends lines to the known_hosts file at path, which has
+// the existing content, creating it and its directory as ssh would if
+// needed.
+func appendKnownHosts(path string, existing []byte, lines []string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if len(existing) > 0 && existing[len(existing)-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+	for _, line := range lines {
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,67 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+)
+
+var defaultKubeconfigNames = []string{"kubeconfig"}
+
+// kubeconfigCandidates are within each prefix only, as a kubeconfig at the
+// root of the bucket would give every pipeline access to its clusters.
+func kubeconfigCandidates(conf Config) []string {
+	return dedupeKeys(normalizeKeys(conf, prefixed(conf, defaultKubeconfigNames)))
+}
+
+// handleKubeconfig writes the kubeconfig found in the most specific prefix
+// to KubeconfigPath, readable only by the owner. Kubeconfigs can't be
+// concatenated like env files, so those in less specific prefixes are
+// ignored.
+func handleKubeconfig(ctx context.Context, conf Config, results <-chan getResult) error {
+	log := conf.log
+	var kubeconfig *getResult
+	defer func() {
+		if kubeconfig != nil {
+			zero(kubeconfig.data)
+		}
+	}()
+	for r := range results {
+		if r.err != nil {
+			if !absent(r.err) {
+				log.Warn(
+					fmt.Sprintf("Failed to download kubeconfig %s/%s: %v", r.bucket, r.key, r.err),
+					typeField(CategoryKubeconfig), bucketField(r.bucket), keyField(r.key), errField(r.err),
+				)
+			}
+			continue
+		}
+		r, ok := prepare(ctx, conf, CategoryKubeconfig, r)
+		if !ok {
+			continue
+		}
+		if kubeconfig != nil {
+			log.Info(
+				fmt.Sprintf("Ignoring kubeconfig %s/%s; %s/%s overrides it", kubeconfig.bucket, kubeconfig.key, r.bucket, r.key),
+				typeField(CategoryKubeconfig), bucketField(kubeconfig.bucket), keyField(kubeconfig.key),
+			)
+			zero(kubeconfig.data)
+		}
+		kubeconfig = &r
+	}
+	if kubeconfig == nil {
+		return nil
+	}
+	r := *kubeconfig
+	msg := fmt.Sprintf("Writing kubeconfig %s/%s to %s", r.bucket, r.key, conf.KubeconfigPath)
+	if conf.DryRun {
+		msg = fmt.Sprintf("(dry-run) would write kubeconfig %s/%s to %s", r.bucket, r.key, conf.KubeconfigPath)
+	}
+	log.Info(msg, typeField(CategoryKubeconfig), bucketField(r.bucket), keyField(r.key), bytesField(len(r.data)), Field{"dry_run", conf.DryRun})
+	if !conf.DryRun {
+		if err := writeFile(conf.KubeconfigPath, r.data, 0600); err != nil {
+			return fmt.Errorf("writing kubeconfig: %w", err)
+		}
+	}
+	conf.results.apply(CategoryKubeconfig, r.bucket, r.key)
+	return nil
+}
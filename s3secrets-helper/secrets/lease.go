@@ -0,0 +1,74 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Leaser acquires dynamic secrets (e.g. short-lived database credentials)
+// which must be returned when the build ends.
+type Leaser interface {
+	// Acquire returns the secret content for key, and an ID to revoke it by.
+	Acquire(ctx context.Context, key string) ([]byte, string, error)
+
+	// Revoke returns a lease previously acquired.
+	Revoke(ctx context.Context, leaseID string) error
+}
+
+// Cleanup is returned by Run to revoke any leases acquired; it should be
+// called (e.g. deferred, or from a trap) when the build ends.
+type Cleanup func() error
+
+// leases records acquired lease IDs for later revocation.
+type leases struct {
+	leaser Leaser
+	mu     sync.Mutex
+	ids    []string
+}
+
+func (l *leases) add(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ids = append(l.ids, id)
+}
+
+// revoke revokes all leases, in reverse order of acquisition. All leases are
+// attempted; the first error is returned.
+func (l *leases) revoke(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var firstErr error
+	for i := len(l.ids) - 1; i >= 0; i-- {
+		if err := l.leaser.Revoke(ctx, l.ids[i]); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("revoking lease %s: %w", l.ids[i], err)
+		}
+	}
+	l.ids = nil
+	return firstErr
+}
+
+// leasingClient acquires designated keys from a Leaser rather than
+// downloading them from S3.
+type leasingClient struct {
+	Client
+	keys   map[string]bool
+	leases *leases
+}
+
+func (c *leasingClient) Get(ctx context.Context, key string) ([]byte, error) {
+	data, _, err := c.GetWithMetadata(ctx, key)
+	return data, err
+}
+
+func (c *leasingClient) GetWithMetadata(ctx context.Context, key string) ([]byte, map[string]string, error) {
+	if !c.keys[key] {
+		return getWithMetadata(ctx, c.Client, key)
+	}
+	data, id, err := c.leases.leaser.Acquire(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.leases.add(id)
+	return data, nil, nil
+}
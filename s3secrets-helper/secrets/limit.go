@@ -0,0 +1,35 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sentinel"
+)
+
+// DefaultMaxSecretBytes is the size of the largest secret downloaded if
+// Config.MaxSecretBytes isn't set; secrets are small, and anything larger is
+// more likely a mistake, e.g. an archive uploaded to the wrong key.
+const DefaultMaxSecretBytes = 1 << 20
+
+// limitClient rejects downloads larger than a limit; see MaxSecretBytes.
+// The Client should enforce the limit itself too, so that an oversized
+// object isn't read into memory at all.
+type limitClient struct {
+	Client
+	max int64
+}
+
+func (c *limitClient) Get(ctx context.Context, key string) ([]byte, error) {
+	data, _, err := c.GetWithMetadata(ctx, key)
+	return data, err
+}
+
+func (c *limitClient) GetWithMetadata(ctx context.Context, key string) ([]byte, map[string]string, error) {
+	data, meta, err := getWithMetadata(ctx, c.Client, key)
+	if size := int64(len(data)); size > c.max {
+		zero(data)
+		return nil, nil, fmt.Errorf("%w: %d bytes, more than the limit of %d bytes", sentinel.ErrTooLarge, size, c.max)
+	}
+	return data, meta, err
+}
@@ -0,0 +1,133 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+)
+
+// LogFormat is the format of log output; see Config.LogFormat.
+type LogFormat string
+
+const (
+	// LogFormatText is Buildkite log output, for people. This is the default.
+	LogFormatText LogFormat = "text"
+
+	// LogFormatJSON is a JSON object per line, for machines. Each has
+	// "level" ("debug", "info" or "warning") and "msg" (as in LogFormatText), and
+	// fields such as "bucket", "key", "bytes" and "type".
+	LogFormatJSON LogFormat = "json"
+)
+
+// Logger receives log events. Each has a message for people, which includes
+// the values of the fields describing it for machines.
+type Logger interface {
+	// Debug events are only logged if Config.Debug is set.
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+}
+
+// Field is a named value describing a log event.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func bucketField(bucket string) Field { return Field{"bucket", bucket} }
+func keyField(key string) Field       { return Field{"key", key} }
+func bytesField(n int) Field          { return Field{"bytes", n} }
+func typeField(category string) Field { return Field{"type", category} }
+func errField(err error) Field        { return Field{"error", err.Error()} }
+
+// newLogger returns the Logger for conf.LogFormat, writing to conf.Logger,
+// which has been wrapped by w unless that's nil.
+func newLogger(conf Config, w *redactingWriter) (Logger, error) {
+	switch conf.LogFormat {
+	case "", LogFormatText:
+		return textLogger{conf.Logger, conf.Debug}, nil
+	case LogFormatJSON:
+		if w == nil {
+			return &jsonLogger{w: conf.Logger.Writer(), debug: conf.Debug}, nil
+		}
+		return &jsonLogger{w: w.w, redact: w.redact, debug: conf.Debug}, nil
+	}
+	return textLogger{conf.Logger, conf.Debug}, fmt.Errorf("unknown log format %q", conf.LogFormat)
+}
+
+// textLogger logs messages only; warnings are expanded by Buildkite ("+++")
+// and flagged with an emoji.
+type textLogger struct {
+	l     *log.Logger
+	debug bool
+}
+
+func (t textLogger) Debug(msg string, fields ...Field) {
+	if t.debug {
+		t.l.Print(msg)
+	}
+}
+
+func (t textLogger) Info(msg string, fields ...Field) {
+	t.l.Print(msg)
+}
+
+func (t textLogger) Warn(msg string, fields ...Field) {
+	t.l.Print("+++ :warning: " + msg)
+}
+
+// jsonLogger logs each event as a line of JSON. Strings are redacted before
+// they are encoded, as escaping could hide them from redaction afterwards.
+type jsonLogger struct {
+	w      io.Writer
+	redact func([]byte) []byte
+	debug  bool
+
+	mu sync.Mutex
+}
+
+func (j *jsonLogger) Debug(msg string, fields ...Field) {
+	if j.debug {
+		j.log("debug", msg, fields)
+	}
+}
+
+func (j *jsonLogger) Info(msg string, fields ...Field) {
+	j.log("info", msg, fields)
+}
+
+func (j *jsonLogger) Warn(msg string, fields ...Field) {
+	j.log("warning", msg, fields)
+}
+
+func (j *jsonLogger) log(level, msg string, fields []Field) {
+	var line bytes.Buffer
+	line.WriteString(`{"level":`)
+	j.encode(&line, level)
+	line.WriteString(`,"msg":`)
+	j.encode(&line, msg)
+	for _, f := range fields {
+		line.WriteByte(',')
+		j.encode(&line, f.Key)
+		line.WriteByte(':')
+		j.encode(&line, f.Value)
+	}
+	line.WriteString("}\n")
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.w.Write(line.Bytes())
+}
+
+func (j *jsonLogger) encode(buf *bytes.Buffer, v interface{}) {
+	if s, ok := v.(string); ok && j.redact != nil {
+		v = string(j.redact([]byte(s)))
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
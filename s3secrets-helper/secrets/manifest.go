@@ -0,0 +1,64 @@
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Manifest lists the secrets a Run loaded, for a record of exactly what each
+// build was given; see Config.ManifestSink. It never includes their values.
+type Manifest struct {
+	// DryRun is set if nothing was actually loaded, and Secrets are those
+	// which would have been.
+	DryRun  bool            `json:"dry_run,omitempty"`
+	Secrets []ManifestEntry `json:"secrets"`
+}
+
+// ManifestEntry describes a secret that was loaded.
+type ManifestEntry struct {
+	Type      string `json:"type"` // e.g. CategorySSHKey
+	Bucket    string `json:"bucket"`
+	Key       string `json:"key"`
+	VersionID string `json:"version_id,omitempty"`
+
+	// Bytes and SHA256 are the size and hex-encoded hash of the object as
+	// downloaded, before any decryption.
+	Bytes  int    `json:"bytes"`
+	SHA256 string `json:"sha256"`
+}
+
+// manifest returns the Manifest of the secrets applied so far, ordered by
+// type, bucket and key.
+func (r *resultRecorder) manifest(dryRun bool) Manifest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m := Manifest{DryRun: dryRun, Secrets: make([]ManifestEntry, 0, len(r.order))}
+	for _, e := range r.order {
+		info := r.objects[e.Bucket+"/"+e.Key]
+		e.VersionID, e.Bytes, e.SHA256 = info.versionID, info.bytes, info.sha256
+		m.Secrets = append(m.Secrets, e)
+	}
+	sort.SliceStable(m.Secrets, func(i, j int) bool {
+		a, b := m.Secrets[i], m.Secrets[j]
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		if a.Bucket != b.Bucket {
+			return a.Bucket < b.Bucket
+		}
+		return a.Key < b.Key
+	})
+	return m
+}
+
+// writeManifest writes the Manifest to ManifestSink, if set.
+func writeManifest(conf Config) error {
+	if conf.ManifestSink == nil {
+		return nil
+	}
+	if err := json.NewEncoder(conf.ManifestSink).Encode(conf.results.manifest(conf.DryRun)); err != nil {
+		return fmt.Errorf("writing manifest: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Metrics observes downloads, e.g. to report them to statsd or Prometheus;
+// see Config.Metrics.
+type Metrics interface {
+	// ObserveDownload is called once for each attempt to download a key from
+	// a bucket, with the type of secret (e.g. CategorySSHKey), the number of
+	// bytes downloaded, and how long it took, including any retries. err is
+	// nil if the key was found.
+	ObserveDownload(secretType, key string, bytes int, dur time.Duration, err error)
+}
+
+// nopMetrics is the default Metrics, which ignores everything.
+type nopMetrics struct{}
+
+func (nopMetrics) ObserveDownload(string, string, int, time.Duration, error) {}
+
+// metricsClient reports each Get to Metrics, and records its outcome for
+// Config.Result and Config.Stats.
+type metricsClient struct {
+	Client
+	metrics    Metrics
+	results    *resultRecorder
+	stats      *Stats
+	secretType string
+}
+
+func (c *metricsClient) Get(ctx context.Context, key string) ([]byte, error) {
+	data, _, err := c.GetWithMetadata(ctx, key)
+	return data, err
+}
+
+func (c *metricsClient) GetWithMetadata(ctx context.Context, key string) ([]byte, map[string]string, error) {
+	start := time.Now()
+	data, meta, err := getWithMetadata(ctx, c.Client, key)
+	if errors.Is(err, context.Canceled) && ctx.Err() != nil {
+		// abandoned, e.g. after FirstMatchOnly found a match, so it has no
+		// outcome to record.
+		return data, meta, err
+	}
+	c.metrics.ObserveDownload(c.secretType, key, len(data), time.Since(start), err)
+	c.results.download(c.secretType, c.Bucket(), key, data, meta, err)
+	c.stats.observe(c.secretType, len(data), err)
+	return data, meta, err
+}
+
+// observed returns conf.clients, reporting downloads of secretType to
+// conf.Metrics, conf.Result and conf.Stats.
+func observed(conf Config, secretType string) []Client {
+	clients := make([]Client, len(conf.clients))
+	for i, c := range conf.clients {
+		clients[i] = &metricsClient{Client: c, metrics: conf.Metrics, results: conf.results, stats: conf.Stats, secretType: secretType}
+	}
+	return clients
+}
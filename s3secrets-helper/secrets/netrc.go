@@ -0,0 +1,72 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+)
+
+var defaultNetrcNames = []string{"netrc"}
+
+// netrcCandidates are within each prefix only, like kubeconfigCandidates.
+func netrcCandidates(conf Config) []string {
+	return dedupeKeys(normalizeKeys(conf, prefixed(conf, defaultNetrcNames)))
+}
+
+// handleNetrc writes the netrc files found to NetrcPath, readable only by
+// the owner. Tools use the first entry for a machine, so the most specific
+// prefix's is written first.
+func handleNetrc(ctx context.Context, conf Config, results <-chan getResult) error {
+	log := conf.log
+	var found [][]byte
+	defer func() {
+		for _, data := range found {
+			zero(data)
+		}
+	}()
+	for r := range results {
+		if r.err != nil {
+			if !absent(r.err) {
+				log.Warn(
+					fmt.Sprintf("Failed to download netrc %s/%s: %v", r.bucket, r.key, r.err),
+					typeField(CategoryNetrc), bucketField(r.bucket), keyField(r.key), errField(r.err),
+				)
+			}
+			continue
+		}
+		r, ok := prepare(ctx, conf, CategoryNetrc, r)
+		if !ok {
+			continue
+		}
+		if bytes.IndexByte(r.data, 0) >= 0 {
+			log.Warn(
+				fmt.Sprintf("Skipping netrc %s/%s; it looks like a binary file rather than netrc", r.bucket, r.key),
+				typeField(CategoryNetrc), bucketField(r.bucket), keyField(r.key),
+			)
+			zero(r.data)
+			continue
+		}
+		msg := fmt.Sprintf("Adding netrc %s/%s to %s", r.bucket, r.key, conf.NetrcPath)
+		if conf.DryRun {
+			msg = fmt.Sprintf("(dry-run) would add netrc %s/%s to %s", r.bucket, r.key, conf.NetrcPath)
+		}
+		log.Info(msg, typeField(CategoryNetrc), bucketField(r.bucket), keyField(r.key), bytesField(len(r.data)), Field{"dry_run", conf.DryRun})
+		found = append(found, r.data)
+		conf.results.apply(CategoryNetrc, r.bucket, r.key)
+	}
+	if len(found) == 0 || conf.DryRun {
+		return nil
+	}
+	var netrc bytes.Buffer
+	defer func() { zero(netrc.Bytes()) }()
+	for i := len(found) - 1; i >= 0; i-- {
+		netrc.Write(found[i])
+		if data := found[i]; len(data) > 0 && data[len(data)-1] != '\n' {
+			netrc.WriteByte('\n')
+		}
+	}
+	if err := writeFile(conf.NetrcPath, netrc.Bytes(), 0600); err != nil {
+		return fmt.Errorf("writing netrc: %w", err)
+	}
+	return nil
+}
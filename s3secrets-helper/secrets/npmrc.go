@@ -0,0 +1,73 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+)
+
+var defaultNPMRCNames = []string{"npmrc"}
+
+// defaultNPMRCMode is the mode of NPMRCPath if NPMRCMode isn't set, as it
+// usually holds registry tokens.
+const defaultNPMRCMode os.FileMode = 0600
+
+func npmrcCandidates(conf Config) []string {
+	return dedupeKeys(normalizeKeys(conf, rootAndPrefixed(conf, defaultNPMRCNames)))
+}
+
+// handleNPMRC writes the npmrc objects found to NPMRCPath, one after another,
+// so a pipeline's settings override those at the root of the bucket, as npm
+// uses the last of each. Like env files, binary files are skipped.
+func handleNPMRC(ctx context.Context, conf Config, results <-chan getResult) error {
+	log := conf.log
+	var npmrc bytes.Buffer
+	defer func() { zero(npmrc.Bytes()) }()
+	found := false
+	for r := range results {
+		if r.err != nil {
+			if !absent(r.err) {
+				log.Warn(
+					fmt.Sprintf("Failed to download npmrc from %s/%s: %v", r.bucket, r.key, r.err),
+					typeField(CategoryNPMRC), bucketField(r.bucket), keyField(r.key), errField(r.err),
+				)
+			}
+			continue
+		}
+		r, ok := prepare(ctx, conf, CategoryNPMRC, r)
+		if !ok {
+			continue
+		}
+		if (conf.RejectBinaryEnv && isBinary(r.data)) || bytes.IndexByte(r.data, 0) >= 0 {
+			log.Warn(
+				fmt.Sprintf("Skipping npmrc %s/%s; it looks like a binary file rather than npmrc", r.bucket, r.key),
+				typeField(CategoryNPMRC), bucketField(r.bucket), keyField(r.key),
+			)
+			zero(r.data)
+			continue
+		}
+		log.Info(
+			fmt.Sprintf("%s %s/%s (%d bytes) of npmrc", loading(conf), r.bucket, r.key, len(r.data)),
+			typeField(CategoryNPMRC), bucketField(r.bucket), keyField(r.key), bytesField(len(r.data)), Field{"dry_run", conf.DryRun},
+		)
+		npmrc.Write(r.data)
+		if len(r.data) > 0 && r.data[len(r.data)-1] != '\n' {
+			npmrc.WriteByte('\n')
+		}
+		zero(r.data)
+		found = true
+		conf.results.apply(CategoryNPMRC, r.bucket, r.key)
+	}
+	if !found || conf.DryRun {
+		return nil
+	}
+	mode := conf.NPMRCMode
+	if mode == 0 {
+		mode = defaultNPMRCMode
+	}
+	if err := writeFile(conf.NPMRCPath, npmrc.Bytes(), mode); err != nil {
+		return fmt.Errorf("writing npmrc: %w", err)
+	}
+	return nil
+}
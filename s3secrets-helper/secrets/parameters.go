@@ -0,0 +1,56 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ParameterStore gets parameters from a store such as AWS SSM Parameter
+// Store; see Config.ParameterStore.
+type ParameterStore interface {
+	// GetParametersByPath returns the values of the parameters directly
+	// under path, decrypted if they're encrypted, by their full names.
+	GetParametersByPath(ctx context.Context, path string) (map[string]string, error)
+}
+
+// getParameterEnv returns the parameters under Config.ParameterPath as an
+// env file, each named by the last segment of its name, in name order.
+// Parameters whose names aren't valid variable names are skipped.
+func getParameterEnv(ctx context.Context, conf Config) (envFile, bool, error) {
+	source := "parameters " + conf.ParameterPath
+	params, err := conf.ParameterStore.GetParametersByPath(ctx, conf.ParameterPath)
+	if err != nil {
+		return envFile{}, false, fmt.Errorf("getting %s: %w", source, err)
+	}
+	if len(params) == 0 {
+		conf.log.Info(fmt.Sprintf("No parameters found under %s", conf.ParameterPath), typeField(CategoryEnv), Field{"path", conf.ParameterPath})
+		return envFile{}, false, nil
+	}
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var data strings.Builder
+	for _, name := range names {
+		env := path.Base(name)
+		if !regexpEnvName.MatchString(env) {
+			conf.log.Warn(
+				fmt.Sprintf("Skipping parameter %s; %s isn't a valid env variable name", name, env),
+				typeField(CategoryEnv), Field{"parameter", name},
+			)
+			continue
+		}
+		fmt.Fprintf(&data, "%s=%s\n", env, shellQuote(params[name]))
+	}
+	conf.log.Info(
+		fmt.Sprintf("%s %d parameters under %s as env", loading(conf), len(names), conf.ParameterPath),
+		typeField(CategoryEnv), Field{"path", conf.ParameterPath}, Field{"dry_run", conf.DryRun},
+	)
+	b := []byte(data.String())
+	conf.redactor.add(CategoryEnv, b)
+	return envFile{source: source, data: b}, true, nil
+}
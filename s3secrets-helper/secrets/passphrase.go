@@ -0,0 +1,73 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// EncryptedAdder is an optional Agent capability to add a key encrypted with
+// a passphrase.
+type EncryptedAdder interface {
+	AddEncrypted(key, passphrase []byte) error
+}
+
+// passphraseSuffix is appended to the key of an encrypted SSH key to find the
+// object holding its passphrase.
+const passphraseSuffix = ".passphrase"
+
+// opensshMagic begins the body of a key in the OpenSSH format.
+var opensshMagic = []byte("openssh-key-v1\x00")
+
+// isPrivateKey reports whether key is a PEM private key, in the OpenSSH
+// format or another, e.g. "RSA PRIVATE KEY".
+func isPrivateKey(key []byte) bool {
+	block, _ := pem.Decode(key)
+	return block != nil && strings.HasSuffix(block.Type, "PRIVATE KEY")
+}
+
+// isEncryptedKey reports whether key is a PEM private key encrypted with a
+// passphrase, in either the OpenSSH format or a legacy or PKCS#8 one.
+func isEncryptedKey(key []byte) bool {
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return false
+	}
+	switch block.Type {
+	case "ENCRYPTED PRIVATE KEY":
+		return true
+	case "OPENSSH PRIVATE KEY":
+		// the magic is followed by the cipher name, a length-prefixed string
+		// which is "none" for an unencrypted key.
+		body := bytes.TrimPrefix(block.Bytes, opensshMagic)
+		if len(body) == len(block.Bytes) || len(body) < 4 {
+			return false
+		}
+		n := int(body[0])<<24 | int(body[1])<<16 | int(body[2])<<8 | int(body[3])
+		return len(body) >= 4+n && string(body[4:4+n]) != "none"
+	}
+	return block.Headers["Proc-Type"] == "4,ENCRYPTED"
+}
+
+// errNoPassphrase is returned by passphraseFor when the passphrase object
+// for an encrypted key doesn't exist.
+var errNoPassphrase = errors.New("no passphrase")
+
+// passphraseFor fetches the passphrase of the encrypted SSH key r from the
+// same bucket, without any trailing newline.
+func passphraseFor(ctx context.Context, conf Config, r getResult) ([]byte, error) {
+	if _, ok := conf.SSHAgent.(EncryptedAdder); !ok && !constrained(conf) {
+		return nil, errors.New("SSHAgent can't add keys encrypted with a passphrase")
+	}
+	data, err := clientFor(conf, r.bucket).Get(ctx, r.key+passphraseSuffix)
+	if absent(err) {
+		return nil, errNoPassphrase
+	} else if err != nil {
+		return nil, withKind(ErrDownloadFailed, fmt.Errorf("downloading passphrase: %w", err))
+	}
+	conf.redactor.add(CategorySSHKey, data)
+	return bytes.TrimRight(data, "\r\n"), nil
+}
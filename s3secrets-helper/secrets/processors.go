@@ -0,0 +1,117 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+)
+
+// Categories of secret, as passed to a SecretProcessor in SecretMeta.
+const (
+	CategorySSHKey         = "ssh-key"
+	CategoryEnv            = "env"
+	CategoryGitCredentials = "git-credentials"
+	CategoryFanout         = "fanout"
+	CategoryKnownHosts     = "known-hosts"
+	CategoryGPGKey         = "gpg-key"
+	CategoryDockerConfig   = "docker-config"
+	CategoryNPMRC          = "npmrc"
+	CategoryKubeconfig     = "kubeconfig"
+	CategoryNetrc          = "netrc"
+)
+
+// SecretMeta describes a downloaded secret.
+type SecretMeta struct {
+	Category string
+	Bucket   string
+	Key      string
+}
+
+// SecretProcessor transforms or validates a downloaded secret before it is
+// applied; see Config.Pipeline.
+type SecretProcessor interface {
+	Process(ctx context.Context, meta SecretMeta, data []byte) ([]byte, error)
+}
+
+// SecretProcessorFunc adapts a function to a SecretProcessor.
+type SecretProcessorFunc func(ctx context.Context, meta SecretMeta, data []byte) ([]byte, error)
+
+// Process calls f.
+func (f SecretProcessorFunc) Process(ctx context.Context, meta SecretMeta, data []byte) ([]byte, error) {
+	return f(ctx, meta, data)
+}
+
+// gzipMagic is the header of gzip data.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// GzipDecompress decompresses gzip data; other data is passed through
+// unchanged.
+func GzipDecompress() SecretProcessor {
+	return SecretProcessorFunc(func(ctx context.Context, meta SecretMeta, data []byte) ([]byte, error) {
+		if !bytes.HasPrefix(data, gzipMagic) {
+			return data, nil
+		}
+		return gunzip(data, 0)
+	})
+}
+
+// DecryptFunc decrypts ciphertext.
+type DecryptFunc func(ctx context.Context, ciphertext []byte) ([]byte, error)
+
+// Decrypt decrypts data with f.
+func Decrypt(f DecryptFunc) SecretProcessor {
+	return SecretProcessorFunc(func(ctx context.Context, meta SecretMeta, data []byte) ([]byte, error) {
+		plaintext, err := f(ctx, data)
+		if err != nil {
+			return nil, fmt.Errorf("decrypt: %w", err)
+		}
+		return plaintext, nil
+	})
+}
+
+// RedactScan fails if data matches any of patterns, e.g. to refuse an env
+// file which contains a private key.
+func RedactScan(patterns ...*regexp.Regexp) SecretProcessor {
+	return SecretProcessorFunc(func(ctx context.Context, meta SecretMeta, data []byte) ([]byte, error) {
+		for _, p := range patterns {
+			if p.Match(data) {
+				return nil, fmt.Errorf("content matches %q", p)
+			}
+		}
+		return data, nil
+	})
+}
+
+// process applies Config.Pipeline to r, returning the processed result. If a
+// processor fails, the remaining processors are skipped, a warning is logged,
+// and false is returned; the secret must not be used.
+func process(ctx context.Context, conf Config, category string, r getResult) (getResult, bool) {
+	meta := SecretMeta{Category: category, Bucket: r.bucket, Key: r.key}
+	for _, p := range conf.Pipeline {
+		data, err := p.Process(ctx, meta, r.data)
+		if err != nil {
+			conf.log.Warn(
+				fmt.Sprintf("Failed to process %s/%s: %v", r.bucket, r.key, err),
+				typeField(category), bucketField(r.bucket), keyField(r.key), errField(err),
+			)
+			zero(r.data)
+			return r, false
+		}
+		if !sameArray(data, r.data) {
+			zero(r.data)
+		}
+		r.data = data
+	}
+	return r, true
+}
+
+// sameArray reports whether a and b are slices of the same underlying array,
+// e.g. b is a[3:]. Slices which were re-sliced with a smaller capacity are
+// not detected.
+func sameArray(a, b []byte) bool {
+	if cap(a) == 0 || cap(b) == 0 {
+		return false
+	}
+	return &a[:cap(a)][cap(a)-1] == &b[:cap(b)][cap(b)-1]
+}
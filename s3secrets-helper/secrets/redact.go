@@ -0,0 +1,134 @@
+package secrets
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// redacted replaces anything redacted from logs.
+const redacted = "[REDACTED]"
+
+// minRedactLen is the shortest secret value which is redacted; shorter ones
+// (e.g. "1", "true") would redact innocuous text.
+const minRedactLen = 6
+
+// Redactor scrubs sensitive text from a line of log output; see
+// Config.Redactor.
+type Redactor interface {
+	Redact(line []byte) []byte
+}
+
+// RedactPatterns returns a Redactor which replaces matches of any of patterns.
+func RedactPatterns(patterns ...*regexp.Regexp) Redactor {
+	return patternRedactor(patterns)
+}
+
+type patternRedactor []*regexp.Regexp
+
+func (p patternRedactor) Redact(line []byte) []byte {
+	for _, re := range p {
+		line = re.ReplaceAllLiteral(line, []byte(redacted))
+	}
+	return line
+}
+
+// builtinRedactions are always redacted: PEM headers and footers, and AWS
+// access key IDs.
+var builtinRedactions = RedactPatterns(
+	regexp.MustCompile(`-----(BEGIN|END) [A-Z0-9 ]+-----`),
+	regexp.MustCompile(`\b(AKIA|ASIA)[A-Z0-9]{16}\b`),
+)
+
+// redactingWriter redacts the values of secrets downloaded so far, as well
+// as builtinRedactions and those of Config.Redactor, from log output.
+type redactingWriter struct {
+	w     io.Writer
+	extra Redactor
+
+	mu      sync.Mutex
+	secrets [][]byte // longest first, so that overlapping values are redacted whole
+}
+
+// redactLogger returns a Logger like conf.Logger which redacts its output,
+// and the writer doing so.
+func redactLogger(conf Config) (*log.Logger, *redactingWriter) {
+	w := &redactingWriter{w: conf.Logger.Writer(), extra: conf.Redactor}
+	return log.New(w, conf.Logger.Prefix(), conf.Logger.Flags()), w
+}
+
+func (w *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := w.w.Write(w.redact(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// redact returns a copy of p with everything to be redacted replaced.
+func (w *redactingWriter) redact(p []byte) []byte {
+	line := append([]byte(nil), p...)
+	w.mu.Lock()
+	for _, s := range w.secrets {
+		line = bytes.Replace(line, s, []byte(redacted), -1)
+	}
+	w.mu.Unlock()
+	line = builtinRedactions.Redact(line)
+	if w.extra != nil {
+		line = w.extra.Redact(line)
+	}
+	return line
+}
+
+// add registers the content of a secret for redaction: the whole, each line,
+// and for env files, each value.
+func (w *redactingWriter) add(category string, data []byte) {
+	values := [][]byte{bytes.TrimSpace(data)}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		values = append(values, bytes.TrimSpace(line))
+	}
+	if category == CategoryEnv {
+		for _, kv := range parseEnv(data) {
+			values = append(values, []byte(kv[1]))
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, v := range values {
+		if len(v) >= minRedactLen {
+			w.secrets = append(w.secrets, append([]byte(nil), v...))
+		}
+	}
+	sort.SliceStable(w.secrets, func(i, j int) bool { return len(w.secrets[i]) > len(w.secrets[j]) })
+}
+
+// close zeroes the secrets held for redaction.
+func (w *redactingWriter) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, s := range w.secrets {
+		zero(s)
+	}
+	w.secrets = nil
+}
+
+// registerRedactions writes the names of the variables set by env to
+// Config.RedactionSink, if RegisterRedactions is set and env is applied.
+func registerRedactions(conf Config, env []byte) error {
+	if !conf.RegisterRedactions || conf.DryRun || conf.EnvDiffSink != nil {
+		return nil
+	}
+	var names bytes.Buffer
+	seen := make(map[string]bool)
+	for _, kv := range parseEnv(env) {
+		if !seen[kv[0]] {
+			seen[kv[0]] = true
+			names.WriteString(kv[0] + "\n")
+		}
+	}
+	_, err := names.WriteTo(conf.RedactionSink)
+	return err
+}
@@ -0,0 +1,79 @@
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// repoPrefixRoot is the root under which repo-scoped secrets live; see
+// PrefixFromRepo.
+const repoPrefixRoot = "repos"
+
+// effectivePrefix returns the prefix secrets are probed under: Prefix, or
+// one derived from Repo if PrefixFromRepo is set.
+func effectivePrefix(conf Config) (string, error) {
+	if !conf.PrefixFromRepo {
+		return conf.Prefix, nil
+	}
+	id, err := repoIdentifier(conf.Repo)
+	if err != nil {
+		return "", err
+	}
+	return repoPrefixRoot + "/" + id, nil
+}
+
+// resolvePrefixes sets conf.Prefixes to the prefixes secrets are probed
+// under, from the most general to the most specific, and conf.Prefix to the
+// most specific of them, e.g. for the JSON bundle.
+func resolvePrefixes(conf *Config) error {
+	if len(conf.Prefixes) > 0 {
+		if conf.Prefix != "" || conf.PrefixFromRepo {
+			return errors.New("Prefixes can't be set with Prefix or PrefixFromRepo")
+		}
+		// a repeated prefix keeps its first, more general, place.
+		conf.Prefixes = dedupeKeys(append([]string(nil), conf.Prefixes...))
+		conf.Prefix = conf.Prefixes[len(conf.Prefixes)-1]
+		return nil
+	}
+	prefix, err := effectivePrefix(*conf)
+	if err != nil {
+		return err
+	}
+	conf.Prefix, conf.Prefixes = prefix, []string{prefix}
+	return nil
+}
+
+// prefixes returns conf.Prefixes, or conf.Prefix if they haven't been
+// resolved.
+func prefixes(conf Config) []string {
+	if len(conf.Prefixes) > 0 {
+		return conf.Prefixes
+	}
+	return []string{conf.Prefix}
+}
+
+// repoIdentifier normalizes a git remote, in URL form (e.g.
+// "https://github.com/acme/app.git") or scp-like form (e.g.
+// "git@github.com:acme/app.git"), to "host/path", e.g. "github.com/acme/app".
+func repoIdentifier(repo string) (string, error) {
+	var host, path string
+	if strings.Contains(repo, "://") {
+		u, err := url.Parse(repo)
+		if err != nil {
+			return "", fmt.Errorf("parsing repo %q: %w", repo, err)
+		}
+		host, path = u.Hostname(), u.Path
+	} else if i := strings.Index(repo, ":"); i > 0 {
+		host, path = repo[:i], repo[i+1:]
+		if at := strings.LastIndex(host, "@"); at >= 0 {
+			host = host[at+1:]
+		}
+	}
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	if host == "" || path == "" {
+		return "", fmt.Errorf("can't derive a prefix from repo %q", repo)
+	}
+	return strings.ToLower(host) + "/" + path, nil
+}
@@ -0,0 +1,122 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sentinel"
+)
+
+// consistencyRetryDelay is the delay before the first retry of a required
+// key which wasn't found; it doubles for each subsequent retry.
+var consistencyRetryDelay = 100 * time.Millisecond
+
+// requiredKeys tracks which of the required keys weren't found in any of
+// the buckets.
+type requiredKeys struct {
+	keys    map[string]bool
+	buckets []string
+	log     Logger
+
+	mu      sync.Mutex
+	missing map[string]int // the number of buckets each key wasn't found in
+}
+
+// requiredClient retries NotFound for required keys, to absorb the lag
+// before newly uploaded objects are readable, and records any which are
+// still missing.
+type requiredClient struct {
+	Client
+	req     *requiredKeys
+	retries int
+}
+
+func (c *requiredClient) Get(ctx context.Context, key string) ([]byte, error) {
+	data, _, err := c.GetWithMetadata(ctx, key)
+	return data, err
+}
+
+func (c *requiredClient) GetWithMetadata(ctx context.Context, key string) ([]byte, map[string]string, error) {
+	data, meta, err := getWithMetadata(ctx, c.Client, key)
+	if !c.req.keys[key] {
+		return data, meta, err
+	}
+	delay := consistencyRetryDelay
+	for i := 0; i < c.retries && errors.Is(err, sentinel.ErrNotFound); i++ {
+		c.req.log.Info(
+			fmt.Sprintf("Required secret %s/%s not found, retrying in %v", c.Bucket(), key, delay),
+			bucketField(c.Bucket()), keyField(key),
+		)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+		delay *= 2
+		data, meta, err = getWithMetadata(ctx, c.Client, key)
+	}
+	if errors.Is(err, sentinel.ErrNotFound) {
+		c.req.mu.Lock()
+		c.req.missing[key]++
+		c.req.mu.Unlock()
+	}
+	return data, meta, err
+}
+
+// wrap returns c, which is the client for the bucket at index i, enforcing
+// the required keys. Consistency retries are only made in the last bucket;
+// until then, a key which isn't found is looked for in the next.
+func (r *requiredKeys) wrap(c Client, i int, conf Config) Client {
+	retries := 0
+	if i == len(r.buckets)-1 {
+		retries = conf.ConsistencyRetry
+	}
+	return &requiredClient{Client: c, req: r, retries: retries}
+}
+
+// checkMissing returns an error naming any required keys which weren't found
+// in any bucket.
+func (r *requiredKeys) checkMissing() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var missing []string
+	for k, n := range r.missing {
+		if n >= len(r.buckets) {
+			missing = append(missing, k)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	return fmt.Errorf("required secrets not found in %s: %s", strings.Join(r.buckets, ", "), strings.Join(missing, ", "))
+}
+
+// newRequiredKeys returns a tracker for conf.RequiredKeys, which must all be
+// among the keys of the categories, in buckets.
+func newRequiredKeys(conf Config, categories []*category, buckets []string) (*requiredKeys, error) {
+	probed := make(map[string]bool)
+	for _, c := range categories {
+		for _, k := range c.keys {
+			probed[k] = true
+		}
+	}
+	keys := make(map[string]bool, len(conf.RequiredKeys))
+	for _, k := range conf.RequiredKeys {
+		if !probed[k] {
+			return nil, fmt.Errorf("required secret %s isn't a key being checked", k)
+		}
+		keys[k] = true
+	}
+	return &requiredKeys{
+		keys:    keys,
+		buckets: buckets,
+		log:     conf.log,
+		missing: make(map[string]int),
+	}, nil
+}
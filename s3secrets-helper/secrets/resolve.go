@@ -0,0 +1,103 @@
+package secrets
+
+import "fmt"
+
+// ResolvedConfig is the effective configuration Run acts on, after defaults
+// are applied.
+type ResolvedConfig struct {
+	Bucket string
+
+	// Prefix is the most specific of Prefixes.
+	Prefix   string
+	Prefixes []string
+
+	// Keys probed for each type of secret, in order.
+	SSHKeys        []string
+	EnvFiles       []string
+	GitCredentials []string
+	KnownHosts     []string // if KnownHostsPath is set
+	GPGKeys        []string // if GPGAgent is set
+	DockerConfigs  []string // if DockerConfigPath is set
+	NPMRCs         []string // if NPMRCPath is set
+	Kubeconfigs    []string // if KubeconfigPath is set
+	Netrcs         []string // if NetrcPath is set
+
+	// EnvJSONBundle is the key of the JSON bundle, if EnvJSONExtract is set.
+	EnvJSONBundle string
+
+	EnvFilenameStrategy EnvFilenameStrategy
+	GitCredentialPolicy GitCredentialPolicy
+	OverlapBucketCheck  bool
+	RejectPublicObjects bool
+	NormalizeKeys       bool
+	StripBOM            bool
+}
+
+// Resolve returns the effective configuration, including the exact keys that
+// will be probed for each type of secret. It makes no requests; keys which
+// would be matched by NormalizeKeys against listed keys aren't reflected.
+func (conf Config) Resolve() (ResolvedConfig, error) {
+	if err := resolvePrefixes(&conf); err != nil {
+		return ResolvedConfig{}, err
+	}
+
+	resolved := ResolvedConfig{
+		Bucket:              conf.Bucket,
+		Prefix:              conf.Prefix,
+		Prefixes:            conf.Prefixes,
+		SSHKeys:             sshKeyCandidates(conf),
+		EnvFiles:            envCandidates(conf),
+		GitCredentials:      append(gitCredentialCandidates(conf), gitCredentialPairCandidates(conf)...),
+		EnvFilenameStrategy: conf.EnvFilenameStrategy,
+		GitCredentialPolicy: conf.GitCredentialPolicy,
+		OverlapBucketCheck:  conf.OverlapBucketCheck,
+		RejectPublicObjects: conf.RejectPublicObjects,
+		NormalizeKeys:       conf.NormalizeKeys,
+		StripBOM:            conf.StripBOM,
+	}
+	if conf.KnownHostsPath != "" {
+		resolved.KnownHosts = knownHostsCandidates(conf)
+	}
+	if conf.GPGAgent != nil {
+		resolved.GPGKeys = gpgKeyCandidates(conf)
+	}
+	if conf.DockerConfigPath != "" {
+		resolved.DockerConfigs = dockerConfigCandidates(conf)
+	}
+	if conf.NPMRCPath != "" {
+		resolved.NPMRCs = npmrcCandidates(conf)
+	}
+	if conf.KubeconfigPath != "" {
+		resolved.Kubeconfigs = kubeconfigCandidates(conf)
+	}
+	if conf.NetrcPath != "" {
+		resolved.Netrcs = netrcCandidates(conf)
+	}
+	if len(conf.EnvJSONExtract) > 0 {
+		resolved.EnvJSONBundle = envJSONBundleKey(conf)
+	}
+	if resolved.Bucket == "" && conf.Client != nil {
+		resolved.Bucket = conf.Client.Bucket()
+	}
+
+	switch resolved.EnvFilenameStrategy {
+	case "":
+		resolved.EnvFilenameStrategy = EnvFilenameMergeAll
+	case EnvFilenameMergeAll, EnvFilenamePreferEnv, EnvFilenamePreferEnvironment, EnvFilenameErrorOnBoth:
+	default:
+		return resolved, fmt.Errorf("unknown env filename strategy %q", resolved.EnvFilenameStrategy)
+	}
+
+	switch resolved.GitCredentialPolicy {
+	case "":
+		resolved.GitCredentialPolicy = GitCredentialFirstWins
+	case GitCredentialFirstWins, GitCredentialLastWins, GitCredentialError:
+	default:
+		return resolved, fmt.Errorf("unknown git credential policy %q", resolved.GitCredentialPolicy)
+	}
+
+	if err := checkKeyCycles(conf.DependsOn); err != nil {
+		return resolved, err
+	}
+	return resolved, nil
+}
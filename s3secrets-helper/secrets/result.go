@@ -0,0 +1,157 @@
+package secrets
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sentinel"
+)
+
+// RunResult describes what became of each key Run probed for; see
+// Config.Result. Keys are given as bucket/key.
+type RunResult struct {
+	// Types has the outcome for each type of secret, e.g. CategorySSHKey.
+	Types map[string]*TypeResult
+}
+
+// TypeResult describes what became of each key probed for a type of secret.
+type TypeResult struct {
+	// Applied are the secrets loaded (or which would be, in a DryRun).
+	Applied []string
+
+	// Skipped were downloaded but not applied, e.g. because they were
+	// duplicates, or were rejected.
+	Skipped []string
+
+	// Absent weren't found.
+	Absent []string
+
+	// Forbidden couldn't be read. S3 also reports this for keys which don't
+	// exist if the bucket can't be listed, so it's usually the same as
+	// Absent.
+	Forbidden []string
+
+	// Failed failed to download for any other reason.
+	Failed map[string]error
+}
+
+// Err returns an error summarizing every key which failed to download, which
+// matches ErrDownloadFailed, or nil if none did.
+func (r *RunResult) Err() error {
+	var failures []string
+	for _, t := range r.Types {
+		for k, err := range t.Failed {
+			failures = append(failures, fmt.Sprintf("%s: %v", k, err))
+		}
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+	sort.Strings(failures)
+	return withKind(ErrDownloadFailed, fmt.Errorf("%d secrets failed to download: %s", len(failures), strings.Join(failures, "; ")))
+}
+
+// resultRecorder builds a RunResult as secrets are downloaded and applied.
+type resultRecorder struct {
+	mu         sync.Mutex
+	types      map[string]*TypeResult
+	downloaded map[string][]string   // by type
+	applied    map[string]bool       // by type + " " + bucket/key
+	objects    map[string]objectInfo // by bucket/key
+	order      []ManifestEntry       // applied, with only type, bucket and key
+}
+
+// objectInfo describes a downloaded object for the Manifest.
+type objectInfo struct {
+	versionID string
+	bytes     int
+	sha256    string
+}
+
+func newResultRecorder() *resultRecorder {
+	return &resultRecorder{
+		types:      make(map[string]*TypeResult),
+		downloaded: make(map[string][]string),
+		applied:    make(map[string]bool),
+		objects:    make(map[string]objectInfo),
+	}
+}
+
+func (r *resultRecorder) typeResult(secretType string) *TypeResult {
+	t, ok := r.types[secretType]
+	if !ok {
+		t = &TypeResult{Failed: make(map[string]error)}
+		r.types[secretType] = t
+	}
+	return t
+}
+
+// download records the outcome of downloading a key of secretType, and the
+// size and hash of data if it was downloaded.
+func (r *resultRecorder) download(secretType, bucket, key string, data []byte, meta map[string]string, err error) {
+	var info objectInfo
+	if err == nil {
+		sum := sha256.Sum256(data)
+		info = objectInfo{versionID: meta[metaVersionID], bytes: len(data), sha256: hex.EncodeToString(sum[:])}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := r.typeResult(secretType)
+	id := bucket + "/" + key
+	switch {
+	case err == nil:
+		r.downloaded[secretType] = append(r.downloaded[secretType], id)
+		r.objects[id] = info
+	case errors.Is(err, sentinel.ErrNotFound):
+		t.Absent = append(t.Absent, id)
+	case errors.Is(err, sentinel.ErrForbidden):
+		t.Forbidden = append(t.Forbidden, id)
+	default:
+		t.Failed[id] = err
+	}
+}
+
+// apply records a key of secretType being applied.
+func (r *resultRecorder) apply(secretType, bucket, key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := r.typeResult(secretType)
+	id := bucket + "/" + key
+	t.Applied = append(t.Applied, id)
+	r.applied[secretType+" "+id] = true
+	r.order = append(r.order, ManifestEntry{Type: secretType, Bucket: bucket, Key: key})
+}
+
+// result returns the RunResult recorded so far, with every key that was
+// downloaded but not applied Skipped.
+func (r *resultRecorder) result() RunResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := RunResult{Types: make(map[string]*TypeResult, len(r.types))}
+	for secretType, t := range r.types {
+		c := &TypeResult{
+			Applied:   append([]string(nil), t.Applied...),
+			Absent:    append([]string(nil), t.Absent...),
+			Forbidden: append([]string(nil), t.Forbidden...),
+			Failed:    make(map[string]error, len(t.Failed)),
+		}
+		for k, err := range t.Failed {
+			c.Failed[k] = err
+		}
+		for _, id := range r.downloaded[secretType] {
+			if !r.applied[secretType+" "+id] {
+				c.Skipped = append(c.Skipped, id)
+			}
+		}
+		for _, s := range [][]string{c.Applied, c.Skipped, c.Absent, c.Forbidden} {
+			sort.Strings(s)
+		}
+		res.Types[secretType] = c
+	}
+	return res
+}
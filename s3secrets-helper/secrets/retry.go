@@ -0,0 +1,66 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sentinel"
+)
+
+const defaultMaxRetries = 3
+
+// The backoff between retries of transient errors is random, up to a limit
+// which starts at retryBaseDelay and doubles for each retry, to at most
+// retryMaxDelay.
+const (
+	retryBaseDelay = 100 * time.Millisecond
+	retryMaxDelay  = 5 * time.Second
+)
+
+// retryClient retries Gets which fail with sentinel.ErrTransient; see
+// MaxRetries.
+type retryClient struct {
+	Client
+	retries int
+	log     Logger
+}
+
+func (c *retryClient) Get(ctx context.Context, key string) ([]byte, error) {
+	data, _, err := c.GetWithMetadata(ctx, key)
+	return data, err
+}
+
+func (c *retryClient) GetWithMetadata(ctx context.Context, key string) ([]byte, map[string]string, error) {
+	for attempt := 0; ; attempt++ {
+		data, meta, err := getWithMetadata(ctx, c.Client, key)
+		if !errors.Is(err, sentinel.ErrTransient) || attempt >= c.retries || ctx.Err() != nil {
+			return data, meta, err
+		}
+		delay := retryDelay(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			// there isn't time to retry.
+			return data, meta, err
+		}
+		c.log.Info(
+			fmt.Sprintf("Failed to download %s/%s, retrying in %v: %v", c.Bucket(), key, delay.Round(time.Millisecond), err),
+			bucketField(c.Bucket()), keyField(key), errField(err),
+		)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+// retryDelay returns the random delay before the retry after attempt.
+func retryDelay(attempt int) time.Duration {
+	limit := retryMaxDelay
+	if attempt < 16 && retryBaseDelay<<uint(attempt) < limit {
+		limit = retryBaseDelay << uint(attempt)
+	}
+	return time.Duration(rand.Int63n(int64(limit)))
+}
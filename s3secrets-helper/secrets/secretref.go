@@ -0,0 +1,91 @@
+package secrets
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+)
+
+// defaultSecretRefScheme prefixes values which are references to other keys;
+// see Config.SecretRefScheme.
+const defaultSecretRefScheme = "s3secret://"
+
+// maxSecretRefDepth limits how many references may be followed to resolve a
+// value.
+const maxSecretRefDepth = 5
+
+func secretRefScheme(conf Config) string {
+	if conf.SecretRefScheme != "" {
+		return conf.SecretRefScheme
+	}
+	return defaultSecretRefScheme
+}
+
+// resolveSecretRefs replaces the value of each variable in env which is a
+// reference, e.g. DB_PASSWORD=s3secret://db/password, with the contents of
+// the referenced key in the bucket of r, the env file. A referenced key
+// whose contents are themselves a reference is followed in turn. If env is
+// changed, it's zeroed.
+func resolveSecretRefs(ctx context.Context, conf Config, r getResult, env []byte) ([]byte, error) {
+	scheme := secretRefScheme(conf)
+	if !conf.ResolveSecretRefs || !bytes.Contains(env, []byte(scheme)) {
+		return env, nil
+	}
+	defer zero(env)
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(env))
+	for scanner.Scan() {
+		line := scanner.Text()
+		vars := parseEnv([]byte(line))
+		if len(vars) == 0 || !strings.HasPrefix(vars[0][1], scheme) {
+			out.WriteString(line + "\n")
+			continue
+		}
+		name := vars[0][0]
+		value, err := resolveSecretRef(ctx, conf, r.bucket, vars[0][1], []string{r.key})
+		if err != nil {
+			zero(out.Bytes())
+			return nil, fmt.Errorf("resolving %s in %s/%s: %w", name, r.bucket, r.key, err)
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), "export ") {
+			out.WriteString("export ")
+		}
+		fmt.Fprintf(&out, "%s=%s\n", name, shellQuote(value))
+	}
+	return out.Bytes(), scanner.Err()
+}
+
+// resolveSecretRef returns the contents of the key ref refers to, following
+// further references. stack holds the keys referring to it, for cycle
+// detection.
+func resolveSecretRef(ctx context.Context, conf Config, bucket, ref string, stack []string) (string, error) {
+	key := strings.TrimPrefix(ref, secretRefScheme(conf))
+	for _, k := range stack {
+		if k == key {
+			return "", fmt.Errorf("secret reference cycle: %s -> %s", strings.Join(stack, " -> "), key)
+		}
+	}
+	if len(stack) > maxSecretRefDepth {
+		return "", fmt.Errorf("secret references are nested more than %d deep at %s/%s", maxSecretRefDepth, bucket, key)
+	}
+	data, err := clientFor(conf, bucket).Get(ctx, key)
+	if err != nil {
+		return "", fmt.Errorf("%s/%s: %w", bucket, key, err)
+	}
+	defer zero(data)
+	if rejectPublic(ctx, conf, getResult{bucket: bucket, key: key, data: data}) {
+		return "", fmt.Errorf("refusing to use %s/%s", bucket, key)
+	}
+	value := strings.TrimRight(string(data), "\r\n")
+	if strings.HasPrefix(value, secretRefScheme(conf)) {
+		return resolveSecretRef(ctx, conf, bucket, value, append(stack, key))
+	}
+	conf.redactor.add(CategoryEnv, []byte(value))
+	conf.log.Info(
+		fmt.Sprintf("Resolved a reference to %s/%s (%d bytes) in %s", bucket, key, len(value), stack[0]),
+		typeField(CategoryEnv), bucketField(bucket), keyField(key), bytesField(len(value)), Field{"referenced_by", stack[len(stack)-1]},
+	)
+	return value, nil
+}
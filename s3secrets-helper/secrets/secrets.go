@@ -2,21 +2,54 @@ package secrets
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"os"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sentinel"
 )
 
 // Client represents interaction with AWS S3
 type Client interface {
-	Bucket() (string)
-	Get(key string) ([]byte, error)
+	Bucket() string
+	Get(ctx context.Context, key string) ([]byte, error)
 	BucketExists() (bool, error)
 }
 
+// Warmer is an optional Client capability to prime connections (TLS
+// handshake etc) alongside the bucket check and the first fetches, so that
+// later Gets can reuse warm connections. Clients without it are not warmed
+// up.
+type Warmer interface {
+	Warmup(ctx context.Context) error
+}
+
+// MetadataGetter is an optional Client capability to get an object's
+// user-defined metadata along with its data. Metadata names are lowercase,
+// without the "x-amz-meta-" prefix. Without it, objects have no metadata.
+type MetadataGetter interface {
+	GetWithMetadata(ctx context.Context, key string) ([]byte, map[string]string, error)
+}
+
+// getWithMetadata gets key from c, with its metadata if c is a
+// MetadataGetter.
+func getWithMetadata(ctx context.Context, c Client, key string) ([]byte, map[string]string, error) {
+	if mg, ok := c.(MetadataGetter); ok {
+		return mg.GetWithMetadata(ctx, key)
+	}
+	data, err := c.Get(ctx, key)
+	return data, nil, err
+}
+
 // Agent represents interaction with an ssh-agent process
 type Agent interface {
 	Run() (bool, error)
@@ -25,6 +58,20 @@ type Agent interface {
 	Stdout() io.Reader
 }
 
+// ReaderAdder is an optional Agent capability to add a key streamed from a
+// reader, rather than passed as a slice.
+type ReaderAdder interface {
+	AddFromReader(r io.Reader) error
+}
+
+// ConstrainedAdder is an optional Agent capability to add a key which the
+// agent forgets after lifetime, unless it's zero, or which requires each use
+// to be confirmed; see Config.SSHKeyLifetime. passphrase is nil unless the
+// key is encrypted.
+type ConstrainedAdder interface {
+	AddConstrained(key, passphrase []byte, lifetime time.Duration, confirm bool) error
+}
+
 // Config holds all the parameters for Run()
 type Config struct {
 	// Repo from BUILDKITE_REPO
@@ -37,214 +84,1741 @@ type Config struct {
 	// defaulting to the value of BUILDKITE_PIPELINE_SLUG
 	Prefix string
 
+	// Prefixes, if set, replaces Prefix with several prefixes, from the
+	// most general to the most specific, e.g. "org", "org/team" and
+	// "org/team/pipeline". Secrets are probed for within each, and those
+	// in more specific prefixes take precedence as they would over those at
+	// the root of the bucket. Prefix and PrefixFromRepo must not be set.
+	Prefixes []string
+
 	// Client for S3
 	Client Client
 
+	// Buckets, if set, are searched in order for each key, using the first
+	// bucket it is found in; e.g. a team's bucket, then a shared one. Client
+	// is used for its own bucket, and NewClient for the others. Buckets
+	// which don't exist are skipped, as long as one does.
+	Buckets []string
+
+	// NewClient returns a Client for one of Buckets.
+	NewClient func(bucket string) (Client, error)
+
 	// Logger is expected to output to stderr
 	Logger *log.Logger
 
+	// LogFormat is the format of Logger's output; by default,
+	// LogFormatText.
+	LogFormat LogFormat
+
+	// Debug logs more detail, e.g. which env variables are skipped.
+	Debug bool
+
 	// SSHAgent represents an ssh-agent process
 	SSHAgent Agent
 
+	// SSHAgentOptional downgrades failures of the SSHAgent, or there being
+	// none, to warnings, so that the other types of secret are still loaded,
+	// e.g. in containers where ssh-agent isn't available. Otherwise they fail
+	// Run.
+	SSHAgentOptional bool
+
+	// GPGAgent, if set, imports gpg_key objects, e.g. so builds can sign
+	// commits and packages. If it's nil, gpg_key isn't probed for.
+	GPGAgent GPGAgent
+
 	// EnvSink has the contents of environment files written to it
 	EnvSink io.Writer
 
-	// GitCredentialHelper is the path to git-credential-s3-secrets
+	// EnvFilePath, if set, is a file that everything otherwise written to
+	// EnvSink is written to instead, atomically and only if Run succeeds.
+	// EnvSink must not also be set.
+	EnvFilePath string
+
+	// GitCredentialHelper is the path to git-credential-s3-secrets. If it's
+	// empty, git-credentials are instead written to a temporary file which
+	// is configured as a git credential store.
 	GitCredentialHelper string
+
+	// GitCredentialsStoreDir is the directory that the credential store is
+	// written to when GitCredentialHelper is empty. Defaults to the system
+	// temporary directory.
+	GitCredentialsStoreDir string
+
+	// EnvDestPath, if set, is a file that env files are written to, instead
+	// of EnvSink.
+	EnvDestPath string
+
+	// GitCredentialsDestPath, if set, is a file that the git credential
+	// helper config is written to, instead of EnvSink.
+	GitCredentialsDestPath string
+
+	// KnownHostsPath, if set, is a known_hosts file, e.g. ~/.ssh/known_hosts,
+	// that host keys in known_hosts objects are appended to, skipping those
+	// it already has. If it's empty, known_hosts isn't probed for.
+	KnownHostsPath string
+
+	// DockerConfigPath, if set, is a docker config file, e.g.
+	// $DOCKER_CONFIG/config.json, that docker-config.json objects are merged
+	// into, so docker can pull from private registries. If it's empty,
+	// docker-config.json isn't probed for.
+	DockerConfigPath string
+
+	// NPMRCPath, if set, is a file, e.g. ~/.npmrc, that npmrc objects are
+	// written to, replacing it, with NPMRCMode (0600 if it's zero). If it's
+	// empty, npmrc isn't probed for.
+	NPMRCPath string
+	NPMRCMode os.FileMode
+
+	// KubeconfigPath, if set, is a file, e.g. ~/.kube/config, that the
+	// kubeconfig in the most specific prefix is written to, replacing it. If
+	// it's empty, kubeconfig isn't probed for.
+	KubeconfigPath string
+
+	// NetrcPath, if set, is a file, e.g. ~/.netrc, that the netrc files in
+	// each prefix are written to, replacing it, so tools such as curl get
+	// credentials. If it's empty, netrc isn't probed for.
+	NetrcPath string
+
+	// Redactor, if set, redacts additional sensitive text from log output.
+	// The values of downloaded secrets, PEM headers and footers, and AWS
+	// access key IDs are always redacted.
+	Redactor Redactor
+
+	// RegisterRedactions writes the name of each variable set by env files
+	// to RedactionSink, one per line, so that their values can be
+	// registered with the agent's redactor (e.g. BUILDKITE_REDACTED_VARS)
+	// and masked in the job's log. Nothing is written in a DryRun, or if
+	// EnvDiffSink is set.
+	RegisterRedactions bool
+	RedactionSink      io.Writer
+
+	// SSHKeyNames, EnvFileNames and GitCredentialNames, if set, replace the
+	// default names of each type of secret (e.g. "private_ssh_key"). Each is
+	// probed for both within the prefix and at the root of the bucket.
+	SSHKeyNames        []string
+	EnvFileNames       []string
+	GitCredentialNames []string
+
+	// SSHKeyPrefix, if set, is a key prefix (e.g. "ssh-keys") under which
+	// every object is added to ssh-agent as a key, in lexical order, after
+	// the usual keys. Objects which aren't private keys are skipped. The
+	// Client must be a Lister.
+	SSHKeyPrefix string
+
+	// SSHKeyLifetime, if set, is how long ssh-agent holds each key before
+	// forgetting it, so that keys don't outlive a hung build, and
+	// SSHKeyConfirm makes it require each use of a key to be confirmed.
+	// Either requires an SSHAgent which is a ConstrainedAdder.
+	SSHKeyLifetime time.Duration
+	SSHKeyConfirm  bool
+
+	// ValidateSSHKeys parses SSH keys before they're added, skipping any
+	// which aren't valid private keys, explaining why, rather than failing
+	// when ssh-agent rejects them. Keys encrypted with a passphrase are only
+	// parsed once decrypted.
+	ValidateSSHKeys bool
+
+	// StripBOM strips a UTF-8 byte order mark from the start of text
+	// secrets (env files and git-credentials), which would otherwise e.g.
+	// become part of the first variable name. SSH keys are left untouched.
+	StripBOM bool
+
+	// RejectBinaryEnv skips env files which look like binary rather than
+	// text, e.g. an image uploaded to the wrong key, which would otherwise
+	// corrupt the environment. Env files containing NUL bytes are always
+	// skipped.
+	RejectBinaryEnv bool
+
+	// PipelineCreatedAt is when the pipeline was created, if known.
+	PipelineCreatedAt time.Time
+
+	// GraceWindow is how long after PipelineCreatedAt missing secrets are
+	// reported as informational rather than as warnings, since secrets for a
+	// new pipeline may not have been uploaded yet.
+	GraceWindow time.Duration
+
+	// NormalizeKeys trims whitespace and applies unicode NFC normalization to
+	// probed keys, and matches them against listed keys (if the Client is a
+	// Lister) normalized the same way. This catches invisible differences
+	// such as a trailing non-breaking space in an uploaded object's key.
+	NormalizeKeys bool
+
+	// KeySeparator joins a prefix and the name of a secret in the keys
+	// probed for, e.g. "." for keys such as "my-pipeline.private_ssh_key".
+	// Defaults to "/".
+	KeySeparator string
+
+	// LowercaseKeys lowercases the keys probed for, including the prefix.
+	LowercaseKeys bool
+
+	// OverlapBucketCheck starts fetching secrets concurrently with the
+	// BucketExists check, rather than after it. Nothing fetched is applied
+	// if the check finds a bucket missing, but if the check itself fails,
+	// e.g. with a network error, what was fetched is applied with a warning.
+	OverlapBucketCheck bool
+
+	// PrefixFromRepo derives the prefix from Repo instead of using Prefix, so
+	// that secrets are scoped to a repository rather than a pipeline; e.g.
+	// git@github.com:acme/app.git uses "repos/github.com/acme/app".
+	PrefixFromRepo bool
+
+	// RejectPublicObjects refuses to use any object which is publicly
+	// readable. The Client must be an ACLChecker.
+	RejectPublicObjects bool
+
+	// AuditBucket warns if a bucket is publicly readable, or doesn't have
+	// default encryption, as either means its secrets are at risk. It is
+	// only advisory; nothing fails because of it. The Client must be a
+	// BucketAuditor.
+	AuditBucket bool
+
+	// EnvPrefix, if set, is a key prefix (e.g. "my-pipeline/env.d") under
+	// which every object is loaded as an env file, in lexical order, after
+	// the usual env files. The Client must be a Lister.
+	EnvPrefix string
+
+	// EnvFormat is the format of env files; by default, EnvFormatRaw.
+	EnvFormat EnvFormat
+
+	// ResolveSecretRefs replaces the value of each env variable which is a
+	// reference to another key in the same bucket, e.g.
+	// DB_PASSWORD=s3secret://db/password, with that key's contents, less any
+	// trailing newline. A missing key is an error.
+	ResolveSecretRefs bool
+
+	// FirstMatchOnly loads only the secret with the highest precedence of
+	// each type which is found, e.g. a pipeline's env rather than both it and
+	// the env at the root of the bucket, cancelling the downloads of the
+	// rest. Only one SSH key is loaded, so SSH keys which are listed (see
+	// SSHKeyPrefix) are only used if none of the usual keys is found. A
+	// git-username is loaded along with its git-token.
+	FirstMatchOnly bool
+
+	// SecretRefScheme prefixes references; see ResolveSecretRefs. Defaults to
+	// "s3secret://".
+	SecretRefScheme string
+
+	// PinnedVersions, if set, maps keys (e.g. "my-pipeline/env") to the
+	// versions of them to get, in a versioned bucket. Other keys get the
+	// latest version. The Client must be a VersionGetter.
+	PinnedVersions map[string]string
+
+	// DiscoverKeys lists the bucket root and each prefix once, and only
+	// downloads the keys found, rather than probing for every key that might
+	// exist, which fills CloudTrail with 403s and 404s and is slow when most
+	// are absent. Keys elsewhere, e.g. under SSHKeyPrefix, are probed for as
+	// usual, as are keys in a prefix which can't be listed. The Client must
+	// be a Lister.
+	DiscoverKeys bool
+
+	// KeyManifest looks for a manifest.yaml in the prefix (the most specific,
+	// if there are several) which declares the keys to download and what
+	// each is: an SSH key, env file, git-credentials, or a file to write. If
+	// one is found, it replaces the keys usually probed for SSH keys, env
+	// files and git-credentials; otherwise they're probed for as usual. A
+	// manifest which exists but can't be downloaded is an error.
+	KeyManifest bool
+
+	// KeyManifestFileDir is the directory which files declared by a key
+	// manifest are written under; their paths are relative to it, and
+	// mustn't leave it. If it's unset, a manifest declaring files is an
+	// error.
+	KeyManifestFileDir string
+
+	// EnvAllowlist, if set, are the names of the only env variables loaded;
+	// others in env files are skipped, as are env files holding anything
+	// but comments and plain NAME=value assignments. If it's empty, all
+	// variables are loaded.
+	EnvAllowlist []string
+
+	// EnvDenylist, if set, are the names of env variables which are never
+	// loaded, as env files setting them may be an attempt to hijack the
+	// build, e.g. DefaultEnvDenylist. Names may include "*" wildcards. Each
+	// variable refused is warned about. Env files holding anything but
+	// comments and plain NAME=value assignments are loaded with a warning,
+	// unless they appear to assign a denied variable, when they're refused.
+	EnvDenylist []string
+
+	// EnvFilenameStrategy controls which of "env" and "environment" are
+	// loaded when both exist; by default both are.
+	EnvFilenameStrategy EnvFilenameStrategy
+
+	// ParameterStore and ParameterPath, if both set, load the parameters
+	// directly under ParameterPath (e.g. "/buildkite/my-pipeline/env") as env
+	// variables, named by the last segment of each parameter's name, after
+	// env files, so they take precedence.
+	ParameterStore ParameterStore
+	ParameterPath  string
+
+	// EnvDiffSink, if set, has a line written to it for each variable env
+	// secrets would set, saying whether it is new, overrides the current
+	// value, or is a no-op, instead of the env secrets being applied.
+	EnvDiffSink io.Writer
+
+	// Environ is the environment EnvDiffSink compares against; by default,
+	// os.Environ().
+	Environ []string
+
+	// EnvJSONExtract maps env var names to JSONPath-style paths (e.g.
+	// "$.db.password") within the JSON bundle object, so that one object can
+	// provide many env vars. Paths which aren't found are skipped.
+	EnvJSONExtract map[string]string
+
+	// EnvJSONBundle is the key of the JSON bundle object for EnvJSONExtract;
+	// by default, "secrets.json" within Prefix.
+	EnvJSONBundle string
+
+	// SecretFanout maps keys (as probed, or any other key) to destinations
+	// they are all written to, concurrently, instead of being applied as
+	// usual. Each is downloaded once.
+	SecretFanout map[string][]Destination
+
+	// GitCredentialPolicy controls precedence when git-credentials from
+	// more than one source have credentials for the same host.
+	GitCredentialPolicy GitCredentialPolicy
+
+	// Decryptor, if set, decrypts secrets which were encrypted before they
+	// were uploaded, e.g. age.Decryptor. Secrets it fails to decrypt are
+	// skipped.
+	Decryptor Decryptor
+
+	// EncryptedKeySuffix, if set, e.g. ".age", is appended to each SSH key,
+	// env file and git-credentials name for a second key to probe, right
+	// after the first, for secrets encrypted for the Decryptor. An env file
+	// with the suffix overrides the one without.
+	EncryptedKeySuffix string
+
+	// KMS decrypts the data keys of secrets stored with KMS envelope
+	// encryption, as marked by their metadata (the format of the S3
+	// encryption client). The Client must be a MetadataGetter. Objects
+	// using SSE-KMS are decrypted by S3, and don't need it. It also decrypts
+	// the data keys of env files encrypted by sops.
+	KMS KMSDecrypter
+
+	// KMSKeyID, if set, is the KMS key envelope encrypted secrets must have
+	// been encrypted with.
+	KMSKeyID string
+
+	// KMSDecrypt decrypts every secret which isn't envelope encrypted with
+	// KMS, as a ciphertext blob from the KMS Encrypt API (e.g. written by
+	// `aws kms encrypt`), which must have been encrypted with KMSKeyID if
+	// that's set. Secrets which fail to decrypt are skipped. It requires KMS.
+	KMSDecrypt bool
+
+	// Pipeline processes each downloaded secret, in order, before it is
+	// applied; e.g. to decompress, decrypt or validate it. A secret which
+	// fails processing is skipped.
+	Pipeline []SecretProcessor
+
+	// FeatureGate, if set, decides whether secrets tagged with a feature flag
+	// in FeatureFlags are applied. If nil, they all are.
+	FeatureGate FeatureGate
+
+	// FeatureFlags maps keys (as probed) to the feature flag which must be
+	// enabled for them to be applied.
+	FeatureFlags map[string]string
+
+	// Confirmer, if set, is asked to confirm each of the ProductionKeys
+	// before it is applied; those which aren't confirmed are skipped.
+	Confirmer Confirmer
+
+	// ProductionKeys are keys (as probed) of production secrets, which
+	// require confirmation by the Confirmer.
+	ProductionKeys []string
+
+	// DependsOn declares that a secret (by key, as probed) depends on others
+	// having been applied first, e.g. an env file which needs an SSH key to
+	// decrypt it. Types of secrets are applied in an order satisfying these
+	// dependencies.
+	DependsOn map[string][]string
+
+	// DisableSSH, DisableEnv and DisableGitCredentials skip that type of
+	// secret entirely, e.g. for pipelines which never use SSH, so that its
+	// keys aren't probed for and nothing is logged about it.
+	DisableSSH            bool
+	DisableEnv            bool
+	DisableGitCredentials bool
+
+	// RequireSSHKey and RequireEnv make Run return an error if no SSH key,
+	// or no env file, is loaded, for pipelines which can't work without
+	// one.
+	RequireSSHKey bool
+	RequireEnv    bool
+
+	// MinSSHKeys and MaxSSHKeys bound how many SSH keys must be loaded, and
+	// MinEnvFiles and MaxEnvFiles how many env files; Run returns an error
+	// if the number found is outside the bounds. A zero maximum is
+	// unbounded.
+	MinSSHKeys  int
+	MaxSSHKeys  int
+	MinEnvFiles int
+	MaxEnvFiles int
+
+	// OnSSHKeysLoaded, OnEnvLoaded and OnGitCredentialsLoaded, if set, are
+	// called once each type of secret has been loaded, with the number of
+	// SSH keys or git-credentials loaded, or the names of the variables set
+	// by env files, e.g. to seed known_hosts or validate the environment.
+	// If one returns an error, Run returns it.
+	OnSSHKeysLoaded        func(count int) error
+	OnEnvLoaded            func(vars []string) error
+	OnGitCredentialsLoaded func(count int) error
+
+	// MaxRetries is how many times a download which fails with a transient
+	// error (see sentinel.ErrTransient) is retried, with exponential backoff
+	// and jitter; 3 if not set, and none if negative.
+	MaxRetries int
+
+	// Concurrency bounds how many downloads of each type of secret are in
+	// flight at once; 10 if not set.
+	Concurrency int
+
+	// DeterministicOutput makes the logs and output of Run the same from
+	// one run to the next, given the same secrets, e.g. for tests which
+	// compare logs. Each type of secret is downloaded one at a time, and
+	// all of its results collected before it's handled, before moving on
+	// to the next type; Concurrency and OverlapBucketCheck are ignored.
+	DeterministicOutput bool
+
+	// MaxSecretBytes is the size of the largest secret used; larger ones
+	// are skipped with a warning. DefaultMaxSecretBytes if not set, and
+	// unlimited if negative. Gzipped secrets, which are decompressed, are
+	// limited both before and after decompression.
+	MaxSecretBytes int64
+
+	// Cache, if set, holds downloaded secrets across Runs, e.g. with a
+	// MemoryCache, so that each is only downloaded once. Keys which aren't
+	// found are only cached if CacheNotFound is set, and errors never are.
+	// Leased keys are never cached.
+	Cache         Cache
+	CacheNotFound bool
+
+	// DownloadTimeout, if set, bounds how long each download may take.
+	DownloadTimeout time.Duration
+
+	// SlowDownloadWarnAfter is how long a download may take before it's
+	// logged as still in progress, and again each time as long again
+	// passes; 10s if not set, and never if negative.
+	SlowDownloadWarnAfter time.Duration
+
+	// Metrics, if set, observes every download attempted, e.g. to track how
+	// long they take and which keys are found.
+	Metrics Metrics
+
+	// Stats, if set, counts the downloads of each type of secret, adding to
+	// any counts from previous Runs.
+	Stats *Stats
+
+	// RequiredKeys are keys (as probed) which must exist; Run returns an
+	// error if any aren't found.
+	RequiredKeys []string
+
+	// ConsistencyRetry is how many times to retry a required key which
+	// isn't found, with backoff, in case it was uploaded so recently that
+	// it isn't readable yet. Other keys aren't retried.
+	ConsistencyRetry int
+
+	// StateStore, if set, records a hash of each secret applied, keyed by
+	// bucket and key, so that changes between runs can be detected.
+	StateStore StateStore
+
+	// OnSecretChanged, if set, is called with the category and key of each
+	// secret whose hash differs from the one in the StateStore.
+	OnSecretChanged func(category, key string)
+
+	// Result, if set, is filled in by Run with what became of each key
+	// probed for, even if Run returns an error, so that partial failures,
+	// which are otherwise only logged as warnings, can be inspected.
+	Result *RunResult
+
+	// ManifestSink, if set, has a Manifest of the secrets loaded written to
+	// it as JSON once Run succeeds: the type, bucket, key, version, size and
+	// hash of each, but never their values.
+	ManifestSink io.Writer
+
+	// DryRun downloads secrets as usual, confirming they are readable, but
+	// only logs what would be loaded; nothing is added to the SSHAgent or
+	// written to EnvSink or any other destination.
+	DryRun bool
+
+	// Leaser, if set, acquires LeaseKeys as leases rather than downloading
+	// them from S3. The leases are revoked by the Cleanup returned from Run.
+	Leaser Leaser
+
+	// LeaseKeys are the keys (as probed, e.g. "my-pipeline/env") to acquire
+	// from the Leaser.
+	LeaseKeys []string
+
+	// discovered maps normalized keys to actual keys; see NormalizeKeys.
+	discovered map[string]string
+
+	// listings are what was found by listing each bucket, by bucket; see
+	// DiscoverKeys.
+	listings map[string]*listing
+
+	// keyManifest is the key manifest found, if any; see KeyManifest.
+	keyManifest *keyManifest
+
+	// listedSSHKeys are the keys found under SSHKeyPrefix.
+	listedSSHKeys map[string]bool
+
+	// envDest and gitDest are where env files and git credential config are
+	// written; see EnvDestPath and GitCredentialsDestPath.
+	envDest io.Writer
+	gitDest io.Writer
+
+	// envSink is EnvSink, with writes serialized; all output to EnvSink
+	// goes through it.
+	envSink *lockedWriter
+
+	// clients are the (wrapped) clients for each bucket searched, in order.
+	clients []Client
+
+	// aclCheckers are the ACLChecker capabilities of the clients, by bucket;
+	// see RejectPublicObjects.
+	aclCheckers map[string]ACLChecker
+
+	// productionKeys is the set of ProductionKeys.
+	productionKeys map[string]bool
+
+	// log receives log events, which it writes to Logger in LogFormat.
+	log Logger
+
+	// redactor redacts downloaded secrets from Logger's output.
+	redactor *redactingWriter
+
+	// applied counts the secrets applied, for MinSSHKeys etc.
+	applied *appliedCounts
+
+	// results records the outcome of each key, for Result.
+	results *resultRecorder
+
+	// prepareMu is held by prepare, so that the StateStore, Confirmer and
+	// so on aren't called concurrently by the handlers of each category.
+	prepareMu *sync.Mutex
 }
 
 // Run is the programmatic (as opposed to CLI) entrypoint to all
 // functionality; secrets are downloaded from S3, and loaded into ssh-agent
 // etc.
-func Run(conf Config) error {
-	bucket := conf.Client.Bucket()
-	log := conf.Logger
+// Cancelling ctx abandons any downloads in progress.
+// The returned Cleanup revokes any leases acquired, and is never nil. If Run
+// returns an error, leases have already been revoked.
+func Run(ctx context.Context, conf Config) (Cleanup, error) {
+	leases := &leases{leaser: conf.Leaser}
+	// leases must be revoked even if ctx was cancelled.
+	cleanup := func() error { return leases.revoke(context.Background()) }
+	if err := runEnvFile(ctx, conf, leases); err != nil {
+		if cerr := cleanup(); cerr != nil {
+			log, _ := newLogger(conf, nil)
+			log.Warn(cerr.Error(), errField(cerr))
+		}
+		return func() error { return nil }, err
+	}
+	return cleanup, nil
+}
+
+func run(ctx context.Context, conf Config, leases *leases) error {
+	// stops downloads which are no longer wanted if run returns early, or
+	// a handler fails.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var redactor *redactingWriter
+	conf.Logger, redactor = redactLogger(conf)
+	conf.redactor = redactor
+	defer redactor.close()
+	log, err := newLogger(conf, redactor)
+	if err != nil {
+		return err
+	}
+	conf.log = log
+
+	if conf.Metrics == nil {
+		conf.Metrics = nopMetrics{}
+	}
+	if conf.DisableSSH && conf.RequireSSHKey {
+		return errors.New("RequireSSHKey can't be set if DisableSSH is")
+	}
+	if conf.DisableEnv && conf.RequireEnv {
+		return errors.New("RequireEnv can't be set if DisableEnv is")
+	}
+	if conf.RegisterRedactions && conf.RedactionSink == nil {
+		return errors.New("RegisterRedactions requires a RedactionSink")
+	}
+	if conf.KMSDecrypt && conf.KMS == nil {
+		return errors.New("KMSDecrypt requires KMS")
+	}
+	if err := checkEnvDenylist(conf); err != nil {
+		return err
+	}
+	if conf.SSHKeyLifetime < 0 {
+		return fmt.Errorf("SSHKeyLifetime %v is negative", conf.SSHKeyLifetime)
+	}
+	if constrained(conf) && !conf.DisableSSH && conf.SSHAgent != nil {
+		if _, ok := conf.SSHAgent.(ConstrainedAdder); !ok {
+			return errors.New("SSHKeyLifetime and SSHKeyConfirm require an SSHAgent that can add constrained keys")
+		}
+	}
+	if conf.DeterministicOutput {
+		conf.Concurrency = 1
+		conf.OverlapBucketCheck = false
+	}
+	conf.results = newResultRecorder()
+	if conf.Result != nil {
+		defer func() { *conf.Result = conf.results.result() }()
+	}
+
+	clients, err := bucketClients(conf)
+	if err != nil {
+		return err
+	}
+	conf.Client = clients[0]
+
+	if err := resolvePrefixes(&conf); err != nil {
+		return err
+	}
+
+	log.Info(
+		fmt.Sprintf("~~~ Downloading secrets from :s3: %s", strings.Join(bucketNames(clients), ", ")),
+		Field{"buckets", bucketNames(clients)},
+	)
+
+	// connections are warmed up alongside the bucket check and the first
+	// fetches, rather than delaying them.
+	var warming sync.WaitGroup
+	defer func() {
+		cancel()
+		warming.Wait()
+	}()
+	for _, c := range clients {
+		warming.Add(1)
+		go func(conf Config, c Client) {
+			defer warming.Done()
+			warmup(ctx, conf, c)
+		}(conf, c)
+	}
+
+	if err := checkVersionGetters(conf, clients); err != nil {
+		return err
+	}
+
+	if conf.RejectPublicObjects {
+		conf.aclCheckers = make(map[string]ACLChecker, len(clients))
+		for _, c := range clients {
+			checker, ok := c.(ACLChecker)
+			if !ok {
+				return errors.New("RejectPublicObjects requires a Client that can check object ACLs")
+			}
+			conf.aclCheckers[c.Bucket()] = checker
+		}
+	}
+
+	// checkResult receives the result of the bucket check, which runs
+	// concurrently with the fetches if OverlapBucketCheck is set, in which
+	// case missing buckets are searched anyway, finding nothing.
+	checkResult := make(chan error, 1)
+	if conf.OverlapBucketCheck {
+		go func(conf Config) {
+			_, err := checkBuckets(ctx, conf, clients)
+			checkResult <- err
+		}(conf)
+	} else if clients, err = checkBuckets(ctx, conf, clients); err != nil {
+		return err
+	} else {
+		conf.Client = clients[0]
+		checkResult <- nil
+	}
+	var checkOnce sync.Once
+	var checkErr error
+	checked := func() error {
+		checkOnce.Do(func() { checkErr = <-checkResult })
+		return checkErr
+	}
+	// notFound returns the bucket check's error in place of err if it found
+	// a bucket missing, as that's the likelier cause of e.g. listing it
+	// failing.
+	notFound := func(err error) error {
+		if cerr := checked(); errors.Is(cerr, ErrBucketNotFound) {
+			return cerr
+		}
+		return err
+	}
 
-	log.Printf("~~~ Downloading secrets from :s3: %s", bucket)
+	conf.discovered = discoverKeys(ctx, conf)
+	if conf.DiscoverKeys {
+		if conf.listings, err = listBuckets(ctx, conf, clients); err != nil {
+			return notFound(err)
+		}
+	}
+	if conf.KeyManifest {
+		if conf.keyManifest, err = findKeyManifest(ctx, conf, clients, leases); err != nil {
+			return notFound(err)
+		}
+		if m := conf.keyManifest; m != nil {
+			log.Info(
+				fmt.Sprintf("Loading the %d secrets declared by %s/%s, rather than probing for them", len(m.entries), m.bucket, m.key),
+				bucketField(m.bucket), keyField(m.key),
+			)
+			conf.SecretFanout = withManifestFiles(conf)
+		}
+	}
 
-	if ok, err := conf.Client.BucketExists(); !ok {
+	var categories []*category
+	if !conf.DisableSSH {
+		sshKeys, err := listSSHKeys(ctx, conf, clients)
 		if err != nil {
-			log.Printf("+++ :warning: Bucket %q not found: %v", bucket, err)
-		} else {
-			log.Printf("+++ :warning: Bucket %q doesn't exist", bucket)
+			return notFound(err)
+		}
+		conf.listedSSHKeys = make(map[string]bool, len(sshKeys))
+		for _, k := range sshKeys {
+			conf.listedSSHKeys[k] = true
 		}
-		return fmt.Errorf("S3 bucket %q not found", bucket)
+		categories = append(categories, &category{
+			name:       "SSH keys",
+			secretType: CategorySSHKey,
+			keys:       append(declaredKeys(conf, CategorySSHKey, withEncryptedSuffix(conf, sshKeyCandidates(conf))), sshKeys...),
+			handle:     handleSSHKeys,
+			loaded:     sshKeysLoaded,
+		})
 	}
+	if !conf.DisableEnv {
+		fragments, err := listEnvFragments(ctx, conf, clients)
+		if err != nil {
+			return notFound(err)
+		}
+		categories = append(categories, &category{
+			name:       "environment files",
+			secretType: CategoryEnv,
+			keys:       append(declaredKeys(conf, CategoryEnv, envCandidates(conf)), fragments...),
+			handle:     handleEnvs,
+			loaded:     envLoaded,
+		})
+	}
+	if !conf.DisableGitCredentials {
+		categories = append(categories, &category{
+			name:       "git credentials",
+			secretType: CategoryGitCredentials,
+			keys:       declaredKeys(conf, CategoryGitCredentials, append(gitCredentialCandidates(conf), gitCredentialPairCandidates(conf)...)),
+			handle:     handleGitCredentials,
+			loaded:     gitCredentialsLoaded,
+		})
+	}
+	if conf.KnownHostsPath != "" {
+		categories = append(categories, &category{
+			name:       "known hosts",
+			secretType: CategoryKnownHosts,
+			keys:       knownHostsCandidates(conf),
+			handle:     handleKnownHosts,
+		})
+	}
+	if conf.GPGAgent != nil {
+		categories = append(categories, &category{
+			name:       "GPG keys",
+			secretType: CategoryGPGKey,
+			keys:       gpgKeyCandidates(conf),
+			handle:     handleGPGKeys,
+		})
+	}
+	if conf.DockerConfigPath != "" {
+		categories = append(categories, &category{
+			name:       "docker config",
+			secretType: CategoryDockerConfig,
+			keys:       dockerConfigCandidates(conf),
+			handle:     handleDockerConfig,
+		})
+	}
+	if conf.NPMRCPath != "" {
+		categories = append(categories, &category{
+			name:       "npmrc",
+			secretType: CategoryNPMRC,
+			keys:       npmrcCandidates(conf),
+			handle:     handleNPMRC,
+		})
+	}
+	if conf.KubeconfigPath != "" {
+		categories = append(categories, &category{
+			name:       "kubeconfig",
+			secretType: CategoryKubeconfig,
+			keys:       kubeconfigCandidates(conf),
+			handle:     handleKubeconfig,
+		})
+	}
+	if conf.NetrcPath != "" {
+		categories = append(categories, &category{
+			name:       "netrc",
+			secretType: CategoryNetrc,
+			keys:       netrcCandidates(conf),
+			handle:     handleNetrc,
+		})
+	}
+	if len(conf.EnvJSONExtract) > 0 && !conf.DisableEnv {
+		categories = append(categories, &category{
+			name:       "env JSON bundle",
+			secretType: CategoryEnv,
+			keys:       []string{envJSONBundleKey(conf)},
+			handle:     handleEnvJSON,
+		})
+	}
+	if len(conf.SecretFanout) > 0 {
+		withoutFanout(conf, categories)
+		categories = append(categories, &category{
+			name:       "fanned out secrets",
+			secretType: CategoryFanout,
+			keys:       fanoutKeys(conf),
+			handle:     handleFanout,
+		})
+	}
+	ordered, err := orderCategories(conf, categories)
+	if err != nil {
+		return err
+	}
+
+	var required *requiredKeys
+	if len(conf.RequiredKeys) > 0 {
+		if required, err = newRequiredKeys(conf, categories, bucketNames(clients)); err != nil {
+			return err
+		}
+	}
+	for i, c := range clients {
+		conf.clients = append(conf.clients, wrapClient(conf, c, i, leases, required))
+	}
+	conf.Client = conf.clients[0]
 
-	resultsSSH := make(chan getResult)
-	getSSHKeys(conf, resultsSSH)
+	conf.applied = &appliedCounts{}
+	conf.prepareMu = &sync.Mutex{}
+	conf.productionKeys = make(map[string]bool, len(conf.ProductionKeys))
+	for _, k := range conf.ProductionKeys {
+		conf.productionKeys[k] = true
+	}
+
+	closeDests, err := openDests(&conf)
+	if err != nil {
+		return err
+	}
+	defer closeDests()
+
+	var pendingEnv *bytes.Buffer
+	if conf.EnvDiffSink != nil {
+		pendingEnv = &bytes.Buffer{}
+		conf.envDest = pendingEnv
+		defer func() { zero(pendingEnv.Bytes()) }()
+	}
 
-	resultsEnv := make(chan getResult)
-	getEnvs(conf, resultsEnv)
+	for _, c := range categories {
+		c.results = make(chan getResult)
+		if !conf.DeterministicOutput {
+			// otherwise, each is fetched just before it's handled.
+			fetch(ctx, conf, c)
+		}
+	}
 
-	resultsGit := make(chan getResult)
-	getGitCredentials(conf, resultsGit)
+	if err := checked(); errors.Is(err, ErrBucketNotFound) {
+		// nothing may be applied from a bucket found missing.
+		for _, c := range categories {
+			drain(c.results)
+		}
+		return err
+	} else if err != nil {
+		// the check itself failed, e.g. with a network error, which only
+		// happens here if it overlapped the fetches. Those would have found
+		// nothing in a missing bucket, so what they found is applied.
+		log.Warn(fmt.Sprintf("Loading the secrets found without knowing the buckets exist; %v", err), errField(err))
+	}
 
-	if err := handleSSHKeys(conf, resultsSSH); err != nil {
+	if err := handleCategories(ctx, cancel, conf, ordered); err != nil {
 		return err
 	}
-	if err := handleEnvs(conf, resultsEnv); err != nil {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
-	if err := handleGitCredentials(conf, resultsGit); err != nil {
+	if required != nil {
+		if err := required.checkMissing(); err != nil {
+			return err
+		}
+	}
+	if err := checkCounts(conf); err != nil {
 		return err
 	}
-	return nil
+	if pendingEnv != nil {
+		if err := writeEnvDiff(conf, pendingEnv.Bytes()); err != nil {
+			return err
+		}
+	}
+	return writeManifest(conf)
 }
 
-func getSSHKeys(conf Config, results chan<- getResult) {
-	keys := []string{
-		conf.Prefix + "/private_ssh_key",
-		conf.Prefix + "/id_rsa_github",
-		"private_ssh_key",
-		"id_rsa_github",
+// wrapClient wraps c, the client for the bucket at index i, with the
+// behaviour configured for downloads: size limits, integrity checks,
+// decompression, caching, leases, timeouts, retries, required keys and logging slow
+// downloads.
+func wrapClient(conf Config, c Client, i int, leases *leases, required *requiredKeys) Client {
+	c = &versionClient{Client: c, pinned: conf.PinnedVersions, log: conf.log}
+	if l := conf.listings[c.Bucket()]; l != nil {
+		c = &discoveryClient{Client: c, listing: l, pinned: conf.PinnedVersions}
 	}
-	conf.Logger.Printf("Checking S3 for SSH keys:")
-	for _, k := range keys {
-		conf.Logger.Printf("- %s", k)
+	max := conf.MaxSecretBytes
+	if max == 0 {
+		max = DefaultMaxSecretBytes
+	}
+	if max > 0 {
+		c = &limitClient{Client: c, max: max}
 	}
-	go GetAll(conf.Client, conf.Client.Bucket(), keys, results)
+	c = &integrityClient{Client: c}
+	c = &gunzipClient{Client: c, max: max}
+	if conf.Cache != nil {
+		c = &cacheClient{Client: c, cache: conf.Cache, notFound: conf.CacheNotFound, log: conf.log}
+	}
+	if conf.Leaser != nil && len(conf.LeaseKeys) > 0 {
+		keys := make(map[string]bool, len(conf.LeaseKeys))
+		for _, k := range conf.LeaseKeys {
+			keys[k] = true
+		}
+		c = &leasingClient{Client: c, keys: keys, leases: leases}
+	}
+	if conf.DownloadTimeout > 0 {
+		c = &timeoutClient{Client: c, timeout: conf.DownloadTimeout}
+	}
+	if conf.MaxRetries >= 0 {
+		retries := conf.MaxRetries
+		if retries == 0 {
+			retries = defaultMaxRetries
+		}
+		c = &retryClient{Client: c, retries: retries, log: conf.log}
+	}
+	if required != nil {
+		c = required.wrap(c, i, conf)
+	}
+	if conf.SlowDownloadWarnAfter >= 0 {
+		after := conf.SlowDownloadWarnAfter
+		if after == 0 {
+			after = defaultSlowDownloadWarnAfter
+		}
+		c = &slowClient{Client: c, after: after, log: conf.log}
+	}
+	return c
 }
 
-func getEnvs(conf Config, results chan<- getResult) {
-	keys := []string{
-		"env",
-		"environment",
-		conf.Prefix + "/env",
-		conf.Prefix + "/environment",
+// openDests sets the destinations for env and git credential config, opening
+// EnvDestPath and GitCredentialsDestPath if set. The returned function closes
+// them. In a DryRun, everything is discarded.
+func openDests(conf *Config) (func(), error) {
+	if conf.DryRun {
+		conf.envSink = &lockedWriter{w: ioutil.Discard}
+		conf.envDest, conf.gitDest = conf.envSink, conf.envSink
+		return func() {}, nil
 	}
-	conf.Logger.Printf("Checking S3 for environment files:")
-	for _, k := range keys {
-		conf.Logger.Printf("- %s", k)
+	var files []*os.File
+	closeAll := func() {
+		for _, f := range files {
+			if err := f.Close(); err != nil {
+				conf.log.Warn(fmt.Sprintf("Failed to close %s: %v", f.Name(), err), Field{"path", f.Name()}, errField(err))
+			}
+		}
+	}
+	conf.envSink = &lockedWriter{w: conf.EnvSink}
+	open := func(path string) (io.Writer, error) {
+		if path == "" {
+			return conf.envSink, nil
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+		return &lockedWriter{w: f}, nil
+	}
+	var err error
+	if conf.envDest, err = open(conf.EnvDestPath); err != nil {
+		closeAll()
+		return nil, err
+	}
+	if conf.gitDest, err = open(conf.GitCredentialsDestPath); err != nil {
+		closeAll()
+		return nil, err
+	}
+	return closeAll, nil
+}
+
+// drain discards results, allowing the goroutines sending them to finish.
+func drain(results <-chan getResult) {
+	for range results {
+	}
+}
+
+// warmup primes the Client's connections if it supports it. Failure is not
+// fatal; the subsequent requests will establish their own connections.
+func warmup(ctx context.Context, conf Config, c Client) {
+	w, ok := c.(Warmer)
+	if !ok {
+		return
+	}
+	if err := w.Warmup(ctx); err != nil && ctx.Err() == nil {
+		conf.log.Info(fmt.Sprintf("Connection warmup failed: %v", err), bucketField(c.Bucket()), errField(err))
 	}
-	go GetAll(conf.Client, conf.Client.Bucket(), keys, results)
 }
 
-func getGitCredentials(conf Config, results chan<- getResult) {
-	keys := []string{
-		"git-credentials",
-		conf.Prefix + "/git-credentials",
+// category is a type of secret, e.g. SSH keys, with the keys to probe for it
+// and the handler to apply what is found.
+type category struct {
+	name       string
+	secretType string // e.g. CategorySSHKey, for Metrics
+	keys       []string
+	results    chan getResult
+	handle     func(context.Context, Config, <-chan getResult) error
+	loaded     func(Config) error // called once handle succeeds, if set
+}
+
+// fetch concurrently gets the category's keys, sending results to
+// c.results.
+func fetch(ctx context.Context, conf Config, c *category) {
+	conf.log.Info(fmt.Sprintf("Checking S3 for %s:", c.name))
+	for _, k := range c.keys {
+		conf.log.Info("- "+k, keyField(k))
 	}
-	conf.Logger.Printf("Checking S3 for git credentials:")
+	if conf.FirstMatchOnly && c.secretType != CategoryFanout {
+		getCtx, cancel := context.WithCancel(ctx)
+		results := make(chan getResult)
+		go firstMatch(ctx, conf, cancel, results, c.results)
+		go getAll(getCtx, observed(conf, c.secretType), priorityOrder(conf, c.secretType, c.keys), conf.Concurrency, results)
+		return
+	}
+	go getAll(ctx, observed(conf, c.secretType), c.keys, conf.Concurrency, c.results)
+}
+
+// Default names of each type of secret; see Config.SSHKeyNames etc.
+var (
+	defaultSSHKeyNames        = []string{"private_ssh_key", "id_rsa_github", "id_ed25519", "id_ecdsa"}
+	defaultEnvFileNames       = []string{"env", "environment"}
+	defaultGitCredentialNames = []string{"git-credentials"}
+)
+
+// namesOr returns names, or defaults if there are none.
+func namesOr(names, defaults []string) []string {
+	if len(names) > 0 {
+		return names
+	}
+	return defaults
+}
+
+// prefixed returns names within each prefix, from the most general prefix
+// to the most specific.
+func prefixed(conf Config, names []string) []string {
+	var keys []string
+	for _, p := range prefixes(conf) {
+		for _, n := range names {
+			keys = append(keys, candidateKey(conf, p, n))
+		}
+	}
+	return keys
+}
+
+// rootAndPrefixed returns names at the root of the bucket, followed by
+// names within each prefix.
+func rootAndPrefixed(conf Config, names []string) []string {
+	keys := make([]string, 0, len(names))
+	for _, n := range names {
+		keys = append(keys, caseKey(conf, n))
+	}
+	return append(keys, prefixed(conf, names)...)
+}
+
+// dedupeKeys returns keys without repeats, keeping the first of each.
+func dedupeKeys(keys []string) []string {
+	seen := make(map[string]bool, len(keys))
+	deduped := keys[:0]
 	for _, k := range keys {
-		conf.Logger.Printf("- %s", k)
+		if !seen[k] {
+			seen[k] = true
+			deduped = append(deduped, k)
+		}
+	}
+	return deduped
+}
+
+func sshKeyCandidates(conf Config) []string {
+	names := namesOr(conf.SSHKeyNames, defaultSSHKeyNames)
+	// ssh offers keys in the order they're added, so the most specific
+	// prefix's keys come first.
+	ps := prefixes(conf)
+	var keys []string
+	for i := len(ps) - 1; i >= 0; i-- {
+		for _, n := range names {
+			keys = append(keys, candidateKey(conf, ps[i], n))
+		}
+	}
+	for _, n := range names {
+		keys = append(keys, caseKey(conf, n))
 	}
-	go GetAll(conf.Client, conf.Client.Bucket(), keys, results)
+	return dedupeKeys(normalizeKeys(conf, keys))
 }
 
-func handleSSHKeys(conf Config, results <-chan getResult) error {
-	log := conf.Logger
+func envCandidates(conf Config) []string {
+	names := namesOr(conf.EnvFileNames, defaultEnvFileNames)
+	return withEncryptedSuffix(conf, dedupeKeys(normalizeKeys(conf, rootAndPrefixed(conf, names))))
+}
+
+func gitCredentialCandidates(conf Config) []string {
+	names := namesOr(conf.GitCredentialNames, defaultGitCredentialNames)
+	return withEncryptedSuffix(conf, dedupeKeys(normalizeKeys(conf, rootAndPrefixed(conf, names))))
+}
+
+// sshKeyHash identifies a key regardless of line endings and surrounding
+// whitespace, so that the same key stored at more than one path is only
+// added once.
+func sshKeyHash(key []byte) [sha256.Size]byte {
+	normalized := bytes.Replace(bytes.TrimSpace(key), []byte("\r\n"), []byte("\n"), -1)
+	defer zero(normalized)
+	return sha256.Sum256(normalized)
+}
+
+func handleSSHKeys(ctx context.Context, conf Config, results <-chan getResult) error {
+	log := conf.log
 	keyFound := false
+	agentStarted := false
+	var agentErr error // why the agent is unavailable, if SSHAgentOptional
+	if conf.SSHAgent == nil {
+		agentErr = errors.New("no ssh-agent is configured")
+	}
+	added := make(map[[sha256.Size]byte]string) // hash -> bucket/key
 	for r := range results {
 		if r.err != nil {
-			if r.err != sentinel.ErrNotFound && r.err != sentinel.ErrForbidden {
-				log.Printf("+++ :warning: Failed to download ssh-key %s/%s: %v", r.bucket, r.key, r.err)
+			if !absent(r.err) {
+				log.Warn(
+					fmt.Sprintf("Failed to download ssh-key %s/%s: %v", r.bucket, r.key, r.err),
+					typeField(CategorySSHKey), bucketField(r.bucket), keyField(r.key), errField(r.err),
+				)
 			}
 			continue
 		}
-		if started, err := conf.SSHAgent.Run(); err != nil {
-			return err
-		} else if started {
-			log.Printf("Started ephemeral ssh-agent (pid %d)", conf.SSHAgent.Pid())
+		r, ok := prepare(ctx, conf, CategorySSHKey, r)
+		if !ok {
+			continue
+		}
+		if conf.listedSSHKeys[r.key] && !isPrivateKey(r.data) {
+			log.Warn(
+				fmt.Sprintf("Skipping %s/%s; it isn't a PEM or OpenSSH private key", r.bucket, r.key),
+				typeField(CategorySSHKey), bucketField(r.bucket), keyField(r.key),
+			)
+			zero(r.data)
+			continue
+		}
+		if want, got, ok := checkSSHKeyType(conf, r); !ok {
+			log.Warn(
+				fmt.Sprintf("Skipping %s/%s; it's named for a key of type %s, but is of type %s", r.bucket, r.key, want, got),
+				typeField(CategorySSHKey), bucketField(r.bucket), keyField(r.key), Field{"key_type", got},
+			)
+			zero(r.data)
+			continue
 		}
-		log.Printf(
-			"Loading %s/%s (%d bytes) into ssh-agent (pid %d)",
-			r.bucket, r.key, len(r.data), conf.SSHAgent.Pid(),
+		// some ssh-agents reject keys with carriage returns, or without a
+		// trailing newline.
+		r.data = normalizeSSHKey(r.data)
+		if conf.ValidateSSHKeys {
+			if err := validateSSHKey(r.data); err != nil {
+				log.Warn(
+					fmt.Sprintf("Skipping %s/%s; %v", r.bucket, r.key, err),
+					typeField(CategorySSHKey), bucketField(r.bucket), keyField(r.key), errField(err),
+				)
+				zero(r.data)
+				continue
+			}
+		}
+		hash := sshKeyHash(r.data)
+		if first, ok := added[hash]; ok {
+			log.Info(
+				fmt.Sprintf("Skipping duplicate key %s/%s; it is the same as %s", r.bucket, r.key, first),
+				typeField(CategorySSHKey), bucketField(r.bucket), keyField(r.key),
+			)
+			zero(r.data)
+			continue
+		}
+		added[hash] = r.bucket + "/" + r.key
+		var passphrase []byte
+		if isEncryptedKey(r.data) {
+			var err error
+			passphrase, err = passphraseFor(ctx, conf, r)
+			if errors.Is(err, errNoPassphrase) {
+				log.Warn(
+					fmt.Sprintf(
+						"Skipping %s/%s; it is encrypted with a passphrase, but %s/%s%s doesn't exist. Upload its passphrase there, or upload an unencrypted key.",
+						r.bucket, r.key, r.bucket, r.key, passphraseSuffix,
+					),
+					typeField(CategorySSHKey), bucketField(r.bucket), keyField(r.key),
+				)
+				zero(r.data)
+				continue
+			} else if err != nil {
+				zero(r.data)
+				return fmt.Errorf("ssh-agent add %s/%s: %w", r.bucket, r.key, err)
+			}
+		}
+		if conf.DryRun {
+			log.Info(
+				fmt.Sprintf("(dry-run) would load %s/%s (%d bytes) into ssh-agent", r.bucket, r.key, len(r.data)),
+				typeField(CategorySSHKey), bucketField(r.bucket), keyField(r.key), bytesField(len(r.data)), Field{"dry_run", true},
+			)
+			zero(r.data)
+			zero(passphrase)
+			keyFound = true
+			conf.applied.sshKeys++
+			conf.results.apply(CategorySSHKey, r.bucket, r.key)
+			continue
+		}
+		if agentErr == nil && !agentStarted {
+			if started, err := conf.SSHAgent.Run(); err != nil {
+				agentErr = err
+			} else {
+				agentStarted = true
+				if started {
+					log.Info(fmt.Sprintf("Started ephemeral ssh-agent (pid %d)", conf.SSHAgent.Pid()), Field{"pid", conf.SSHAgent.Pid()})
+				}
+			}
+		}
+		if agentErr != nil {
+			zero(r.data)
+			zero(passphrase)
+			if !conf.SSHAgentOptional {
+				return withKind(ErrAgentFailed, agentErr)
+			}
+			log.Warn(
+				fmt.Sprintf("Skipping %s/%s; ssh-agent isn't available: %v", r.bucket, r.key, agentErr),
+				typeField(CategorySSHKey), bucketField(r.bucket), keyField(r.key), errField(agentErr), Field{"reason", "agent unavailable"},
+			)
+			continue
+		}
+		log.Info(
+			fmt.Sprintf("Loading %s/%s (%d bytes) into ssh-agent (pid %d)", r.bucket, r.key, len(r.data), conf.SSHAgent.Pid()),
+			typeField(CategorySSHKey), bucketField(r.bucket), keyField(r.key), bytesField(len(r.data)), Field{"pid", conf.SSHAgent.Pid()},
 		)
-		if err := conf.SSHAgent.Add(r.data); err != nil {
-			return fmt.Errorf("ssh-agent add: %w", err)
+		if err := addKey(conf, r.data, passphrase); err != nil {
+			if !conf.SSHAgentOptional {
+				return withKind(ErrAgentFailed, fmt.Errorf("ssh-agent add: %w", err))
+			}
+			log.Warn(
+				fmt.Sprintf("Skipping %s/%s; ssh-agent rejected it: %v", r.bucket, r.key, err),
+				typeField(CategorySSHKey), bucketField(r.bucket), keyField(r.key), errField(err), Field{"reason", "key rejected"},
+			)
+			continue
 		}
 		keyFound = true
+		conf.applied.sshKeys++
+		conf.results.apply(CategorySSHKey, r.bucket, r.key)
 	}
-	if !keyFound && strings.HasPrefix(conf.Repo, "git@") {
-		log.Printf("+++ :warning: Failed to find an SSH key in secret bucket")
-		log.Printf(
-			"The repository %q appears to use SSH for transport, but the elastic-ci-stack-s3-secrets-hooks plugin did not find any SSH keys in the %q S3 bucket.",
-			conf.Repo, conf.Bucket,
+	if !keyFound && strings.HasPrefix(conf.Repo, "git@") && inGraceWindow(conf) {
+		log.Info(
+			fmt.Sprintf(
+				"No SSH key found in the %q S3 bucket; secrets may not be provisioned yet for this new pipeline (created %s)",
+				conf.Bucket, conf.PipelineCreatedAt.Format(time.RFC3339),
+			),
+			typeField(CategorySSHKey), bucketField(conf.Bucket),
 		)
-		log.Printf("See https://github.com/buildkite/elastic-ci-stack-for-aws#build-secrets for more information.")
+	} else if !keyFound && strings.HasPrefix(conf.Repo, "git@") {
+		log.Warn("Failed to find an SSH key in secret bucket", typeField(CategorySSHKey), bucketField(conf.Bucket))
+		log.Info(
+			fmt.Sprintf(
+				"The repository %q appears to use SSH for transport, but the elastic-ci-stack-s3-secrets-hooks plugin did not find any SSH keys in the %q S3 bucket.",
+				conf.Repo, conf.Bucket,
+			),
+			typeField(CategorySSHKey), bucketField(conf.Bucket), Field{"repo", conf.Repo},
+		)
+		log.Info("See https://github.com/buildkite/elastic-ci-stack-for-aws#build-secrets for more information.")
+	}
+	if !keyFound && conf.RequireSSHKey {
+		candidates := sshKeyCandidates(conf)
+		if conf.SSHKeyPrefix != "" {
+			candidates = append(candidates, strings.TrimSuffix(conf.SSHKeyPrefix, "/")+"/*")
+		}
+		return notFoundError(conf, "SSH key", candidates)
 	}
-	if _, err := io.Copy(conf.EnvSink, conf.SSHAgent.Stdout()); err != nil {
+	if conf.DryRun || agentErr != nil {
+		// an unavailable agent has no env to export.
+		return nil
+	}
+	// written at once so it can't be interleaved with other output.
+	agentEnv, err := ioutil.ReadAll(conf.SSHAgent.Stdout())
+	if err != nil {
+		return withKind(ErrAgentFailed, fmt.Errorf("reading ssh-agent env: %w", err))
+	}
+	if _, err := conf.envSink.Write(agentEnv); err != nil {
 		return fmt.Errorf("copying ssh-agent env: %w", err)
 	}
 	return nil
 }
 
-func handleEnvs(conf Config, results <-chan getResult) error {
-	log := conf.Logger
-	for r := range results {
+// prepare readies a downloaded secret to be applied, returning false if it
+// must be skipped (in which case its data has been zeroed).
+func prepare(ctx context.Context, conf Config, category string, r getResult) (getResult, bool) {
+	conf.prepareMu.Lock()
+	defer conf.prepareMu.Unlock()
+	if rejectPublic(ctx, conf, r) || !gateAllows(ctx, conf, r) || !confirmed(ctx, conf, r) {
+		zero(r.data)
+		return r, false
+	}
+	r, ok := decryptEnvelope(ctx, conf, r)
+	if !ok {
+		return r, false
+	}
+	r, ok = decrypt(conf, r)
+	if !ok {
+		return r, false
+	}
+	if category == CategoryEnv {
+		r, ok = decryptSops(ctx, conf, r)
+		if !ok {
+			return r, false
+		}
+	}
+	r, ok = process(ctx, conf, category, r)
+	if !ok {
+		return r, false
+	}
+	if conf.StripBOM && category != CategorySSHKey {
+		r.data = stripBOM(r.data)
+	}
+	conf.redactor.add(category, r.data)
+	trackChange(ctx, conf, category, r)
+	return r, true
+}
+
+// addKey loads key into the agent, constrained by SSHKeyLifetime and
+// SSHKeyConfirm if either is set, streaming it if the agent is a
+// ReaderAdder, or decrypting it with passphrase if that's set. The key and
+// passphrase are zeroed afterwards so that key material doesn't linger in
+// memory.
+func addKey(conf Config, key, passphrase []byte) error {
+	defer zero(key)
+	defer zero(passphrase)
+	if constrained(conf) {
+		// run checked the agent is a ConstrainedAdder.
+		return conf.SSHAgent.(ConstrainedAdder).AddConstrained(key, passphrase, conf.SSHKeyLifetime, conf.SSHKeyConfirm)
+	}
+	if passphrase != nil {
+		// passphraseFor checked the agent is an EncryptedAdder.
+		return conf.SSHAgent.(EncryptedAdder).AddEncrypted(key, passphrase)
+	}
+	if ra, ok := conf.SSHAgent.(ReaderAdder); ok {
+		return ra.AddFromReader(bytes.NewReader(key))
+	}
+	return conf.SSHAgent.Add(key)
+}
+
+// constrained reports whether SSH keys are added to the agent with
+// constraints.
+func constrained(conf Config) bool {
+	return conf.SSHKeyLifetime > 0 || conf.SSHKeyConfirm
+}
+
+// loading is how the loading of a secret is described in the log.
+func loading(conf Config) string {
+	if conf.DryRun {
+		return "(dry-run) would load"
+	}
+	return "Loading"
+}
+
+// inGraceWindow reports whether the pipeline was created within the
+// GraceWindow, so missing secrets are expected rather than alarming.
+func inGraceWindow(conf Config) bool {
+	if conf.GraceWindow <= 0 || conf.PipelineCreatedAt.IsZero() {
+		return false
+	}
+	return time.Since(conf.PipelineCreatedAt) < conf.GraceWindow
+}
+
+// utf8BOM is the byte order mark some (Windows) editors prefix UTF-8 with.
+var utf8BOM = []byte{0xef, 0xbb, 0xbf}
+
+// stripBOM returns data without a leading UTF-8 byte order mark.
+func stripBOM(data []byte) []byte {
+	return bytes.TrimPrefix(data, utf8BOM)
+}
+
+// isBinary reports whether data, ignoring any byte order mark, isn't valid
+// UTF-8 text or contains control characters other than whitespace.
+func isBinary(data []byte) bool {
+	data = stripBOM(data)
+	if !utf8.Valid(data) {
+		return true
+	}
+	for _, b := range data {
+		if b < 0x20 && b != '\t' && b != '\n' && b != '\r' || b == 0x7f {
+			return true
+		}
+	}
+	return false
+}
+
+// zero overwrites b with zeroes. It must not be used on a slice that is
+// still referenced elsewhere, e.g. by a cache.
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// zeroAll zeroes the data of each result.
+func zeroAll(results []getResult) {
+	for _, r := range results {
+		zero(r.data)
+	}
+}
+
+func handleEnvs(ctx context.Context, conf Config, results <-chan getResult) error {
+	log := conf.log
+	collected := collect(results)
+	defer zeroAll(collected)
+	allowlist := newEnvAllowlist(conf)
+	var files []envFile
+	defer func() {
+		for _, f := range files {
+			zero(f.data)
+			zero(f.raw)
+		}
+	}()
+	resolved, err := resolveEnvFilenames(conf, collected)
+	if err != nil {
+		return err
+	}
+	for _, r := range resolved {
 		if r.err != nil {
-			if r.err != sentinel.ErrNotFound && r.err != sentinel.ErrForbidden {
-				log.Printf("+++ :warning: Failed to download env from %s/%s: %v", r.bucket, r.key, r.err)
+			if !absent(r.err) {
+				log.Warn(
+					fmt.Sprintf("Failed to download env from %s/%s: %v", r.bucket, r.key, r.err),
+					typeField(CategoryEnv), bucketField(r.bucket), keyField(r.key), errField(r.err),
+				)
 			}
 			continue
 		}
-		data := r.data
-		if data[len(data)-1] != '\n' {
+		r, ok := prepare(ctx, conf, CategoryEnv, r)
+		if !ok {
+			continue
+		}
+		// a shell can't source NUL bytes, so such files are always skipped.
+		if (conf.RejectBinaryEnv && isBinary(r.data)) || bytes.IndexByte(r.data, 0) >= 0 {
+			log.Warn(
+				fmt.Sprintf("Skipping env %s/%s; it looks like a binary file rather than env", r.bucket, r.key),
+				typeField(CategoryEnv), bucketField(r.bucket), keyField(r.key),
+			)
+			zero(r.data)
+			continue
+		}
+		data, err := expandIncludes(ctx, conf, r, nil)
+		if err != nil {
+			return err
+		}
+		if data, err = formatEnv(conf, data); err != nil {
+			zero(r.data)
+			return fmt.Errorf("parsing env %s/%s: %w", r.bucket, r.key, err)
+		}
+		data = allowlist.filter(conf, r, data)
+		data = filterEnvDenylist(conf, r, data)
+		if data, err = resolveSecretRefs(ctx, conf, r, data); err != nil {
+			return err
+		}
+		if len(data) > 0 && data[len(data)-1] != '\n' {
 			data = append(data, '\n')
 		}
-		log.Printf("Loading %s/%s (%d bytes) of env", r.bucket, r.key, len(r.data))
-		if _, err := bytes.NewReader(data).WriteTo(conf.EnvSink); err != nil {
-			return fmt.Errorf("copying env: %w", err)
+		log.Info(
+			fmt.Sprintf("%s %s/%s (%d bytes) of env", loading(conf), r.bucket, r.key, len(r.data)),
+			typeField(CategoryEnv), bucketField(r.bucket), keyField(r.key), bytesField(len(r.data)), Field{"dry_run", conf.DryRun},
+		)
+		// r.data may differ from data after include expansion etc.
+		files = append(files, envFile{source: r.bucket + "/" + r.key, data: data, raw: r.data})
+		conf.applied.envFiles++
+		conf.results.apply(CategoryEnv, r.bucket, r.key)
+	}
+	if conf.ParameterStore != nil && conf.ParameterPath != "" {
+		f, ok, err := getParameterEnv(ctx, conf)
+		if err != nil {
+			return err
+		}
+		if ok {
+			// the allowlist and denylist name the source as ssm/<path>.
+			r := getResult{bucket: "ssm", key: strings.TrimPrefix(conf.ParameterPath, "/")}
+			f.data = filterEnvDenylist(conf, r, allowlist.filter(conf, r, f.data))
+			files = append(files, f)
+			conf.applied.envFiles++
+		}
+	}
+	allowlist.logMissing(conf)
+	if len(files) > 0 {
+		env := resolveEnvPrecedence(conf, files)
+		conf.applied.addEnvVars(env)
+		_, err := bytes.NewReader(env).WriteTo(conf.envDest)
+		if err == nil {
+			if err = registerRedactions(conf, env); err != nil {
+				err = fmt.Errorf("registering redactions: %w", err)
+			}
+		} else {
+			err = fmt.Errorf("copying env: %w", err)
+		}
+		zero(env)
+		if err != nil {
+			return err
+		}
+	}
+	if conf.applied.envFiles == 0 && conf.RequireEnv {
+		candidates := envCandidates(conf)
+		if conf.EnvPrefix != "" {
+			candidates = append(candidates, strings.TrimSuffix(conf.EnvPrefix, "/")+"/*")
 		}
+		return notFoundError(conf, "env file", candidates)
 	}
 	return nil
 }
 
-func handleGitCredentials(conf Config, results <-chan getResult) error {
-	log := conf.Logger
-	var helpers []string
+// notFoundError describes a required type of secret not being found in any
+// of the candidate keys.
+func notFoundError(conf Config, what string, candidates []string) error {
+	return fmt.Errorf(
+		"no %s found in %s; looked for %s",
+		what, strings.Join(bucketNames(conf.clients), ", "), strings.Join(candidates, ", "),
+	)
+}
+
+func handleGitCredentials(ctx context.Context, conf Config, results <-chan getResult) error {
+	log := conf.log
+	store := conf.GitCredentialHelper == ""
+	mode := "helper"
+	if store {
+		mode = "store"
+	}
+	var sources []gitCredentialSource
+	var pairs gitCredentialPairs
 	for r := range results {
 		if r.err != nil {
-			if r.err != sentinel.ErrNotFound && r.err != sentinel.ErrForbidden {
-				log.Printf("+++ :warning: Failed to check %s/%s: %v", r.bucket, r.key, r.err)
+			if !absent(r.err) {
+				log.Warn(
+					fmt.Sprintf("Failed to check %s/%s: %v", r.bucket, r.key, r.err),
+					typeField(CategoryGitCredentials), bucketField(r.bucket), keyField(r.key), errField(r.err),
+				)
 			}
 			continue
 		}
-		log.Printf("Adding git-credentials in %s/%s as a credential helper", r.bucket, r.key)
-		helpers = append(helpers, fmt.Sprintf(
-			"'credential.helper=%s %s %s'",
-			conf.GitCredentialHelper, r.bucket, r.key,
-		))
+		r, ok := prepare(ctx, conf, CategoryGitCredentials, r)
+		if !ok {
+			continue
+		}
+		if pairs.add(conf, r) {
+			continue
+		}
+		s := gitCredentialSource{bucket: r.bucket, key: r.key, hosts: parseGitCredentialHosts(r.data)}
+		if store {
+			s.data = r.data
+		} else {
+			// the credential helper downloads the credentials itself when needed.
+			zero(r.data)
+		}
+		sources = append(sources, s)
+	}
+	// pairs apply to any host, so come after files for particular hosts.
+	sources = append(sources, pairs.sources(conf)...)
+	defer func() {
+		for _, s := range sources {
+			zero(s.data)
+			zero(s.token)
+		}
+	}()
+	sources, err := orderGitCredentialSources(conf, sources)
+	if err != nil {
+		return err
 	}
-	if len(helpers) == 0 {
+	conf.applied.gitCredentials = len(sources)
+	for _, s := range sources {
+		conf.results.apply(CategoryGitCredentials, s.bucket, s.key)
+		if s.tokenKey != "" {
+			conf.results.apply(CategoryGitCredentials, s.bucket, s.tokenKey)
+		}
+	}
+	if len(sources) == 0 {
 		return nil
 	}
-	env := "GIT_CONFIG_PARAMETERS=\"" + strings.Join(helpers, " ") + "\"\n"
-	if _, err := io.WriteString(conf.EnvSink, env); err != nil {
+	if !store {
+		if err := checkGitCredentialHelper(conf.GitCredentialHelper); err != nil {
+			log.Warn(
+				fmt.Sprintf("%v; git will fail to use these git-credentials", err),
+				typeField(CategoryGitCredentials), errField(err),
+			)
+		}
+	}
+
+	var helpers []string
+	var files []gitCredentialSource
+	var pair *gitCredentialSource // the pair written to a helper script, in a store
+	for i, s := range sources {
+		var msg string
+		switch {
+		case store && s.tokenKey != "" && pair != nil:
+			// git uses the first helper to answer, which is the first pair's.
+			msg = fmt.Sprintf("Skipping %s, as %s takes precedence", s.describe(), pair.describe())
+		case store && s.tokenKey != "" && conf.DryRun:
+			msg = fmt.Sprintf("(dry-run) would add %s as a credential helper script", s.describe())
+		case store && s.tokenKey != "":
+			msg = fmt.Sprintf("Adding %s as a credential helper script", s.describe())
+		case store && conf.DryRun:
+			msg = fmt.Sprintf("(dry-run) would add %s to a credential store", s.describe())
+		case store:
+			msg = fmt.Sprintf("Adding %s to a credential store", s.describe())
+		case conf.DryRun:
+			msg = fmt.Sprintf("(dry-run) would add %s as a credential helper", s.describe())
+		default:
+			msg = fmt.Sprintf("Adding %s as a credential helper", s.describe())
+		}
+		log.Info(
+			msg,
+			typeField(CategoryGitCredentials), bucketField(s.bucket), keyField(s.key),
+			Field{"mode", mode}, Field{"dry_run", conf.DryRun},
+		)
+		switch {
+		case !store && s.tokenKey != "":
+			helpers = append(helpers, fmt.Sprintf(
+				"'credential.helper=%s %s %s %s'",
+				conf.GitCredentialHelper, s.bucket, s.key, s.tokenKey,
+			))
+		case !store:
+			helpers = append(helpers, fmt.Sprintf(
+				"'credential.helper=%s %s %s'",
+				conf.GitCredentialHelper, s.bucket, s.key,
+			))
+		case s.tokenKey == "":
+			files = append(files, s)
+		case pair == nil:
+			pair = &sources[i]
+		}
+	}
+
+	var env string
+	if store {
+		if conf.DryRun {
+			return nil
+		}
+		if len(files) > 0 {
+			path, err := writeGitCredentialStore(conf, files)
+			if err != nil {
+				return err
+			}
+			log.Info(fmt.Sprintf("Using git credential store %s", path), typeField(CategoryGitCredentials), Field{"mode", mode})
+			env = fmt.Sprintf("%s=%s\n", envGitCredentialsStore, path)
+			helpers = append(helpers, fmt.Sprintf("'credential.helper=store --file=%s'", path))
+		}
+		if pair != nil {
+			path, err := writeGitCredentialHelper(conf, *pair)
+			if err != nil {
+				return err
+			}
+			log.Info(fmt.Sprintf("Using git credential helper script %s", path), typeField(CategoryGitCredentials), Field{"mode", mode})
+			env += fmt.Sprintf("%s=%s\n", envGitCredentialHelper, path)
+			helpers = append(helpers, fmt.Sprintf("'credential.helper=%s'", path))
+		}
+	} else {
+		log.Info(fmt.Sprintf("Using git credential helper %s", conf.GitCredentialHelper), typeField(CategoryGitCredentials), Field{"mode", mode})
+	}
+	env += "GIT_CONFIG_PARAMETERS=\"" + strings.Join(helpers, " ") + "\"\n"
+	if _, err := io.WriteString(conf.gitDest, env); err != nil {
 		return fmt.Errorf("writing GIT_CONFIG_PARAMETERS env: %w", err)
 	}
 	return nil
 }
 
+// timeoutClient bounds each Get; see DownloadTimeout.
+type timeoutClient struct {
+	Client
+	timeout time.Duration
+}
+
+func (c *timeoutClient) Get(ctx context.Context, key string) ([]byte, error) {
+	data, _, err := c.GetWithMetadata(ctx, key)
+	return data, err
+}
+
+func (c *timeoutClient) GetWithMetadata(ctx context.Context, key string) ([]byte, map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return getWithMetadata(ctx, c.Client, key)
+}
+
+// absent reports whether err means the object isn't there (or can't be seen,
+// which S3 reports instead when the caller can't list the bucket), which is
+// expected for most of the keys probed and so isn't worth a warning.
+func absent(err error) bool {
+	return errors.Is(err, sentinel.ErrNotFound) || errors.Is(err, sentinel.ErrForbidden)
+}
+
 type getResult struct {
 	bucket string
 	key    string
 	data   []byte
+	meta   map[string]string
 	err    error
 }
 
-// GetAll fetches keys from an S3 bucket concurrently.
-// Concurrency is unbounded; intended for use with a handful of keys.
+// defaultConcurrency is the number of downloads of each type of secret in
+// flight at once if Config.Concurrency isn't set.
+const defaultConcurrency = 10
+
+// GetAll fetches keys from an S3 bucket concurrently, with at most
+// concurrency (or defaultConcurrency, if it's not positive) fetches in flight.
 // Results are sent to a channel in the originally requested order.
 // This is done by creating a chain of channels between each goroutine.
 // The results channel is passed through that chain.
-func GetAll(c Client, bucket string, keys []string, results chan<- getResult) {
+// Once ctx is cancelled, results which aren't received are dropped, so that
+// no goroutine is left waiting; the results channel is still closed.
+// Downloads which don't match the object's length or checksum fail with an
+// IntegrityError.
+func GetAll(ctx context.Context, c Client, bucket string, keys []string, concurrency int, results chan<- getResult) {
+	c = &integrityClient{Client: c}
+	get := func(ctx context.Context, k string) getResult {
+		data, meta, err := getWithMetadata(ctx, c, k)
+		return getResult{bucket: bucket, key: k, data: data, meta: meta, err: err}
+	}
+	getAllWith(ctx, get, keys, concurrency, results)
+}
+
+// getAll is GetAll, searching each of clients in order for each key; see
+// getFirst.
+func getAll(ctx context.Context, clients []Client, keys []string, concurrency int, results chan<- getResult) {
+	get := func(ctx context.Context, k string) getResult { return getFirst(ctx, clients, k) }
+	getAllWith(ctx, get, keys, concurrency, results)
+}
+
+// getAllWith implements GetAll, fetching each key with get.
+func getAllWith(ctx context.Context, get func(context.Context, string) getResult, keys []string, concurrency int, results chan<- getResult) {
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+	// a goroutine holds a slot until it has passed on the results channel,
+	// which bounds the number of goroutines as well as fetches.
+	slots := make(chan struct{}, concurrency)
+
 	// first link in chain; will pass results channel into the first goroutine
 	link := make(chan chan<- getResult, 1)
 	link <- results
 	close(link)
 
 	for _, k := range keys {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			close(<-link) // wait for the last goroutine started
+			return
+		}
+
 		// next link in chain; will pass results channel to the next goroutine.
-		nextLink := make(chan chan<- getResult)
+		// It's buffered so a goroutine can finish, freeing its slot, before the
+		// next one has been started.
+		nextLink := make(chan chan<- getResult, 1)
 
 		// goroutine immediately fetches from S3, then waits for its turn to send
 		// to the results channel; concurrent fetch, ordered results.
 		go func(k string, link <-chan chan<- getResult, nextLink chan<- chan<- getResult) {
-			data, err := c.Get(k)
+			defer func() { <-slots }()
+			r := get(ctx, k)
 			results := <-link // wait for results channel from previous goroutine
-			results <- getResult{bucket: bucket, key: k, data: data, err: err}
+			select {
+			case results <- r:
+			case <-ctx.Done():
+				zero(r.data)
+			}
 			nextLink <- results // send results channel to the next goroutine
 			close(nextLink)
 		}(k, link, nextLink)
@@ -0,0 +1,44 @@
+package secretstest_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/secrets"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/secrets/secretstest"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sentinel"
+)
+
+func Example() {
+	client := secretstest.NewFakeClient("my-bucket", map[string][]byte{
+		"my-pipeline/private_ssh_key": []byte("my key"),
+		"env":                         []byte("A=one"),
+	})
+	client.Errors = map[string]error{"environment": sentinel.ErrForbidden}
+	agent := &secretstest.FakeAgent{}
+
+	_, err := secrets.Run(context.Background(), secrets.Config{
+		Repo:                "git@github.com:org/repo.git",
+		Bucket:              "my-bucket",
+		Prefix:              "my-pipeline",
+		Client:              client,
+		Logger:              log.New(ioutil.Discard, "", 0),
+		SSHAgent:            agent,
+		EnvSink:             os.Stdout,
+		GitCredentialHelper: "/path/to/git-credential-s3-secrets",
+	})
+	if err != nil {
+		fmt.Println(err)
+	}
+	fmt.Println(agent.Keys())
+
+	// Output:
+	// SSH_AUTH_SOCK=/path/to/socket; export SSH_AUTH_SOCK;
+	// SSH_AGENT_PID=42; export SSH_AGENT_PID;
+	// echo Agent pid 42
+	// A=one
+	// [my key]
+}
@@ -0,0 +1,155 @@
+// Package secretstest provides fakes of the secrets package's interfaces, for
+// testing code which calls secrets.Run without S3 or ssh-agent.
+package secretstest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/secrets"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sentinel"
+)
+
+var (
+	_ secrets.Client = (*FakeClient)(nil)
+	_ secrets.Agent  = (*FakeAgent)(nil)
+)
+
+// FakeClient is a secrets.Client for a bucket whose objects are held in
+// memory. Its fields may be set before it's used, but not changed after.
+type FakeClient struct {
+	// Name is returned by Bucket.
+	Name string
+
+	// Objects are the contents of the bucket, by key. Keys which aren't
+	// present are sentinel.ErrNotFound.
+	Objects map[string][]byte
+
+	// Errors, if set, are returned by Get for their keys instead of any
+	// object, e.g. sentinel.ErrForbidden or sentinel.ErrTransient.
+	Errors map[string]error
+
+	// Missing makes BucketExists report that the bucket doesn't exist.
+	Missing bool
+
+	// BucketErr, if set, is returned by BucketExists.
+	BucketErr error
+
+	mu   sync.Mutex
+	gets []string
+}
+
+// NewFakeClient returns a FakeClient for bucket, containing objects.
+func NewFakeClient(bucket string, objects map[string][]byte) *FakeClient {
+	return &FakeClient{Name: bucket, Objects: objects}
+}
+
+// Bucket returns c.Name.
+func (c *FakeClient) Bucket() string {
+	return c.Name
+}
+
+// Get returns a copy of the object at key, or its injected error.
+func (c *FakeClient) Get(ctx context.Context, key string) ([]byte, error) {
+	c.mu.Lock()
+	c.gets = append(c.gets, key)
+	c.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err, ok := c.Errors[key]; ok {
+		return nil, err
+	}
+	data, ok := c.Objects[key]
+	if !ok {
+		return nil, sentinel.ErrNotFound
+	}
+	// like a real client, return a new slice each time, as it may be zeroed.
+	return append([]byte(nil), data...), nil
+}
+
+// BucketExists reports whether the bucket exists, per Missing and BucketErr.
+func (c *FakeClient) BucketExists() (bool, error) {
+	if c.BucketErr != nil {
+		return false, c.BucketErr
+	}
+	return !c.Missing, nil
+}
+
+// Gets returns the keys that have been got, in the order they were asked
+// for.
+func (c *FakeClient) Gets() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.gets...)
+}
+
+// FakePid is the pid of every FakeAgent.
+const FakePid = 42
+
+// FakeAgent is a secrets.Agent which records the keys added to it. The zero
+// value is ready to use.
+type FakeAgent struct {
+	// AddErr, if set, is returned by Add.
+	AddErr error
+
+	mu   sync.Mutex
+	run  bool
+	keys [][]byte
+}
+
+// Run reports that the agent was started the first time it's called.
+func (a *FakeAgent) Run() (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	started := !a.run
+	a.run = true
+	return started, nil
+}
+
+// Add records a copy of key, which must only be added after Run, as with a
+// real agent.
+func (a *FakeAgent) Add(key []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.run {
+		return fmt.Errorf("ssh-agent must Run() before Add()")
+	}
+	if a.AddErr != nil {
+		return a.AddErr
+	}
+	a.keys = append(a.keys, append([]byte(nil), key...))
+	return nil
+}
+
+// Pid returns FakePid.
+func (a *FakeAgent) Pid() int {
+	return FakePid
+}
+
+// Stdout returns the env a real ssh-agent prints, if any keys were added.
+func (a *FakeAgent) Stdout() io.Reader {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.keys) == 0 {
+		return strings.NewReader("")
+	}
+	return strings.NewReader(fmt.Sprintf(
+		"SSH_AUTH_SOCK=/path/to/socket; export SSH_AUTH_SOCK;\nSSH_AGENT_PID=%d; export SSH_AGENT_PID;\necho Agent pid %d\n",
+		FakePid, FakePid,
+	))
+}
+
+// Keys returns the keys added, in order.
+func (a *FakeAgent) Keys() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	keys := make([]string, len(a.keys))
+	for i, k := range a.keys {
+		keys[i] = string(k)
+	}
+	return keys
+}
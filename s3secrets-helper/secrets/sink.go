@@ -0,0 +1,20 @@
+package secrets
+
+import (
+	"io"
+	"sync"
+)
+
+// lockedWriter serializes writes, so that output written by handlers or
+// goroutines sharing it isn't interleaved. Each Write is applied whole, so
+// callers should write complete lines at once.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
@@ -0,0 +1,62 @@
+package secrets
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// slowWriter writes a byte at a time, so unserialized concurrent writes
+// would interleave.
+type slowWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	for i, b := range p {
+		w.buf.WriteByte(b)
+		if i%8 == 0 {
+			runtime.Gosched()
+		}
+	}
+	return len(p), nil
+}
+
+func TestLockedWriter(t *testing.T) {
+	w := &slowWriter{}
+	sink := &lockedWriter{w: w}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				line := fmt.Sprintf("GOROUTINE_%d_LINE_%d=%s\n", g, i, strings.Repeat("x", 64))
+				if _, err := sink.Write([]byte(line)); err != nil {
+					t.Error(err)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	var lines int
+	scanner := bufio.NewScanner(&w.buf)
+	for scanner.Scan() {
+		var g, i int
+		var value string
+		line := scanner.Text()
+		if _, err := fmt.Sscanf(line, "GOROUTINE_%d_LINE_%d=%s", &g, &i, &value); err != nil || value != strings.Repeat("x", 64) {
+			t.Errorf("torn line: %q", line)
+		}
+		lines++
+	}
+	if lines != 800 {
+		t.Errorf("expected 800 lines, got %d", lines)
+	}
+}
@@ -0,0 +1,52 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// defaultSlowDownloadWarnAfter is how long a download takes before it's
+// logged as slow if Config.SlowDownloadWarnAfter isn't set.
+const defaultSlowDownloadWarnAfter = 10 * time.Second
+
+// slowClient logs downloads which are taking a long time, each time another
+// interval passes, so that a stalled build shows what it's waiting for.
+type slowClient struct {
+	Client
+	after time.Duration
+	log   Logger
+}
+
+func (c *slowClient) Get(ctx context.Context, key string) ([]byte, error) {
+	data, _, err := c.GetWithMetadata(ctx, key)
+	return data, err
+}
+
+func (c *slowClient) GetWithMetadata(ctx context.Context, key string) ([]byte, map[string]string, error) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		start := time.Now()
+		ticker := time.NewTicker(c.after)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				elapsed := time.Since(start).Round(c.after)
+				c.log.Info(
+					fmt.Sprintf("Still downloading %s/%s after %v", c.Bucket(), key, elapsed),
+					bucketField(c.Bucket()), keyField(key), Field{"elapsed", elapsed.String()},
+				)
+			case <-done:
+				return
+			}
+		}
+	}()
+	data, meta, err := getWithMetadata(ctx, c.Client, key)
+	// nothing is logged about the download once it's done.
+	close(done)
+	<-stopped
+	return data, meta, err
+}
@@ -0,0 +1,209 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Metadata of env files encrypted by sops, in its dotenv format, which
+// flattens its metadata into variables such as
+// sops_kms__list_0__map_enc.
+const (
+	sopsPrefix       = "sops_"
+	sopsVersion      = "sops_version"
+	sopsMAC          = "sops_mac"
+	sopsLastModified = "sops_lastmodified"
+	sopsMACOnlyEnc   = "sops_mac_only_encrypted"
+	sopsKMSList      = "sops_kms__list_"
+	sopsKMSContext   = "context__map_"
+)
+
+// isSops reports whether data is an env file encrypted by sops.
+func isSops(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(sopsVersion+"=")) || bytes.Contains(data, []byte("\n"+sopsVersion+"="))
+}
+
+// decryptSops decrypts r if it's an env file encrypted by sops with a KMS
+// key, as written by `sops --encrypt --input-type dotenv`. Each value is
+// shell quoted. Secrets which can't be decrypted are skipped.
+func decryptSops(ctx context.Context, conf Config, r getResult) (getResult, bool) {
+	if !isSops(r.data) {
+		return r, true
+	}
+	if conf.KMS == nil {
+		conf.log.Warn(
+			fmt.Sprintf("Skipping %s/%s; it is sops encrypted, but no KMS decrypter is configured", r.bucket, r.key),
+			bucketField(r.bucket), keyField(r.key),
+		)
+		zero(r.data)
+		return r, false
+	}
+	plaintext, err := openSops(ctx, conf, r.data)
+	zero(r.data)
+	if err != nil {
+		conf.log.Warn(
+			fmt.Sprintf("Skipping %s/%s; failed to decrypt it with sops: %v", r.bucket, r.key, err),
+			bucketField(r.bucket), keyField(r.key), errField(err),
+		)
+		return r, false
+	}
+	r.data = plaintext
+	return r, true
+}
+
+// sopsKMSKey is a KMS key which encrypted the data key of a sops file.
+type sopsKMSKey struct {
+	arn     string
+	enc     string
+	context map[string]string
+}
+
+func openSops(ctx context.Context, conf Config, data []byte) ([]byte, error) {
+	type variable struct{ name, value string }
+	var vars []variable
+	meta := map[string]string{}
+	keys := map[string]*sopsKMSKey{}
+	for _, line := range strings.Split(string(data), "\n") {
+		name := envLineName(line)
+		if name == "" {
+			continue
+		}
+		value := line[strings.Index(line, "=")+1:]
+		if !strings.HasPrefix(name, sopsPrefix) {
+			vars = append(vars, variable{name, value})
+			continue
+		}
+		meta[name] = value
+		if !strings.HasPrefix(name, sopsKMSList) {
+			continue
+		}
+		// e.g. sops_kms__list_0__map_arn
+		parts := strings.SplitN(strings.TrimPrefix(name, sopsKMSList), "__map_", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		k := keys[parts[0]]
+		if k == nil {
+			k = &sopsKMSKey{context: map[string]string{}}
+			keys[parts[0]] = k
+		}
+		switch field := parts[1]; {
+		case field == "arn":
+			k.arn = value
+		case field == "enc":
+			k.enc = value
+		case strings.HasPrefix(field, sopsKMSContext):
+			k.context[strings.TrimPrefix(field, sopsKMSContext)] = value
+		}
+	}
+
+	dataKey, err := sopsDataKey(ctx, conf, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(dataKey)
+
+	macOnlyEncrypted := meta[sopsMACOnlyEnc] == "true"
+	hash := sha512.New()
+	var out bytes.Buffer
+	for _, v := range vars {
+		value := v.value
+		encrypted := strings.HasPrefix(value, "ENC[")
+		if encrypted {
+			plaintext, err := sopsDecryptValue(dataKey, value, v.name+":")
+			if err != nil {
+				return nil, fmt.Errorf("decrypting %s: %w", v.name, err)
+			}
+			value = string(plaintext)
+			zero(plaintext)
+		}
+		if encrypted || !macOnlyEncrypted {
+			hash.Write([]byte(value))
+		}
+		fmt.Fprintf(&out, "%s=%s\n", v.name, shellQuote(value))
+	}
+
+	mac, err := sopsDecryptValue(dataKey, meta[sopsMAC], meta[sopsLastModified])
+	if err != nil {
+		zero(out.Bytes())
+		return nil, fmt.Errorf("decrypting MAC: %w", err)
+	}
+	if expected := fmt.Sprintf("%X", hash.Sum(nil)); string(mac) != expected {
+		zero(out.Bytes())
+		return nil, errors.New("MAC mismatch; the file may have been tampered with")
+	}
+	return out.Bytes(), nil
+}
+
+// sopsDataKey decrypts the data key with the first KMS key which can.
+func sopsDataKey(ctx context.Context, conf Config, keys map[string]*sopsKMSKey) ([]byte, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no KMS key in its metadata")
+	}
+	indexes := make([]string, 0, len(keys))
+	for i := range keys {
+		indexes = append(indexes, i)
+	}
+	sort.Strings(indexes)
+	var errs []string
+	for _, i := range indexes {
+		k := keys[i]
+		enc, err := base64.StdEncoding.DecodeString(k.enc)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: decoding data key: %v", k.arn, err))
+			continue
+		}
+		keyID := k.arn
+		if conf.KMSKeyID != "" {
+			keyID = conf.KMSKeyID
+		}
+		key, err := conf.KMS.Decrypt(ctx, keyID, enc, k.context)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", k.arn, err))
+			continue
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("decrypting data key: %s", strings.Join(errs, "; "))
+}
+
+// sopsDecryptValue decrypts a value such as
+// ENC[AES256_GCM,data:...,iv:...,tag:...,type:str] with AES-GCM, authenticating
+// additionalData along with it.
+func sopsDecryptValue(key []byte, value, additionalData string) ([]byte, error) {
+	if !strings.HasPrefix(value, "ENC[AES256_GCM,") || !strings.HasSuffix(value, "]") {
+		return nil, errors.New("malformed encrypted value")
+	}
+	fields := map[string][]byte{}
+	for _, field := range strings.Split(strings.TrimSuffix(strings.TrimPrefix(value, "ENC[AES256_GCM,"), "]"), ",") {
+		parts := strings.SplitN(field, ":", 2)
+		if len(parts) != 2 || parts[0] == "type" {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("decoding %s: %w", parts[0], err)
+		}
+		fields[parts[0]] = b
+	}
+	if len(fields["iv"]) == 0 {
+		return nil, errors.New("malformed encrypted value")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(fields["iv"]))
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, fields["iv"], append(fields["data"], fields["tag"]...), []byte(additionalData))
+}
@@ -0,0 +1,198 @@
+package secrets
+
+import (
+	"bytes"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// normalizeSSHKey returns a PEM encoded key without carriage returns, and
+// with a trailing newline, as some ssh-agents reject keys without. Anything
+// else is returned as it is, for ssh-agent to judge. key is zeroed if a copy
+// is returned.
+func normalizeSSHKey(key []byte) []byte {
+	if !bytes.HasPrefix(bytes.TrimLeft(key, " \t\r\n"), []byte("-----BEGIN ")) {
+		return key
+	}
+	if bytes.IndexByte(key, '\r') < 0 && bytes.HasSuffix(key, []byte("\n")) {
+		return key
+	}
+	normalized := make([]byte, 0, len(key)+1)
+	for _, b := range key {
+		if b != '\r' {
+			normalized = append(normalized, b)
+		}
+	}
+	if !bytes.HasSuffix(normalized, []byte("\n")) {
+		normalized = append(normalized, '\n')
+	}
+	zero(key)
+	return normalized
+}
+
+// validateSSHKey returns an error describing why key isn't a private key
+// ssh-agent would accept, if it isn't, by parsing it with x/crypto/ssh. The
+// contents of encrypted keys can't be checked without their passphrase, so
+// they pass if they're otherwise well-formed.
+func validateSSHKey(key []byte) error {
+	block, rest := pem.Decode(key)
+	if block == nil {
+		return errors.New("it isn't PEM encoded; expected a -----BEGIN ... PRIVATE KEY----- block")
+	}
+	zero(block.Bytes)
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return errors.New("it has data after the end of the key")
+	}
+	if !strings.HasSuffix(block.Type, "PRIVATE KEY") {
+		return fmt.Errorf("it is a %s, not a private key", block.Type)
+	}
+	raw, err := ssh.ParseRawPrivateKey(key)
+	var missing *ssh.PassphraseMissingError
+	switch {
+	case errors.As(err, &missing):
+		return nil
+	case err != nil:
+		return fmt.Errorf("its %s is malformed: %w", block.Type, err)
+	}
+	zeroPrivateKey(raw)
+	return nil
+}
+
+// zeroPrivateKey zeroes the private parts of a key parsed by
+// ssh.ParseRawPrivateKey, as far as they can be.
+func zeroPrivateKey(key interface{}) {
+	var ints []*big.Int
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		ints = append([]*big.Int{k.D, k.Precomputed.Dp, k.Precomputed.Dq, k.Precomputed.Qinv}, k.Primes...)
+	case *ecdsa.PrivateKey:
+		ints = []*big.Int{k.D}
+	case *dsa.PrivateKey:
+		ints = []*big.Int{k.X}
+	case *ed25519.PrivateKey:
+		zero(*k)
+	case ed25519.PrivateKey:
+		zero(k)
+	}
+	for _, n := range ints {
+		if n == nil {
+			continue
+		}
+		words := n.Bits()
+		for i := range words {
+			words[i] = 0
+		}
+	}
+}
+
+// sshKeyNameTypes are the types of key that default SSH key names imply, as
+// named by ssh-keygen.
+var sshKeyNameTypes = map[string]string{
+	"id_ed25519": "ed25519",
+	"id_ecdsa":   "ecdsa",
+}
+
+// checkSSHKeyType returns false if r is named for a type of key (e.g.
+// id_ed25519) but is another type, along with both types. Keys which aren't
+// named for a type, or whose type can't be told, pass.
+func checkSSHKeyType(conf Config, r getResult) (want, got string, ok bool) {
+	_, name := splitKey(conf, r.key)
+	want, named := sshKeyNameTypes[strings.ToLower(name)]
+	if !named {
+		return "", "", true
+	}
+	got = sshKeyType(r.data)
+	return want, got, got == "" || got == want
+}
+
+// sshKeyType returns the type of the private key, e.g. "ed25519", or "" if
+// it can't be told.
+func sshKeyType(key []byte) string {
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return ""
+	}
+	defer zero(block.Bytes)
+	switch block.Type {
+	case "OPENSSH PRIVATE KEY":
+		return opensshKeyType(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return "rsa"
+	case "EC PRIVATE KEY":
+		return "ecdsa"
+	case "DSA PRIVATE KEY":
+		return "dsa"
+	case "PRIVATE KEY":
+		k, err := ssh.ParseRawPrivateKey(key)
+		if err != nil {
+			return ""
+		}
+		defer zeroPrivateKey(k)
+		switch k.(type) {
+		case ed25519.PrivateKey, *ed25519.PrivateKey:
+			return "ed25519"
+		case *ecdsa.PrivateKey:
+			return "ecdsa"
+		case *rsa.PrivateKey:
+			return "rsa"
+		}
+	}
+	return ""
+}
+
+// opensshKeyType returns the type of the key in the body of an OpenSSH
+// private key, from its public key, which isn't encrypted.
+func opensshKeyType(body []byte) string {
+	if !bytes.HasPrefix(body, opensshMagic) {
+		return ""
+	}
+	body = body[len(opensshMagic):]
+	next := func(skip int) ([]byte, bool) {
+		if len(body) < skip+4 {
+			return nil, false
+		}
+		body = body[skip:]
+		n := binary.BigEndian.Uint32(body)
+		if uint64(len(body)-4) < uint64(n) {
+			return nil, false
+		}
+		s := body[4 : 4+n]
+		body = body[4+n:]
+		return s, true
+	}
+	// the cipher name, KDF name and KDF options, then the number of keys
+	// before the public key, whose first field is its type.
+	var publicKey []byte
+	for _, skip := range []int{0, 0, 0, 4} {
+		var ok bool
+		if publicKey, ok = next(skip); !ok {
+			return ""
+		}
+	}
+	body = publicKey
+	t, ok := next(0)
+	if !ok {
+		return ""
+	}
+	switch t := string(t); {
+	case t == "ssh-ed25519":
+		return "ed25519"
+	case strings.HasPrefix(t, "ecdsa-sha2-"):
+		return "ecdsa"
+	case t == "ssh-rsa":
+		return "rsa"
+	case t == "ssh-dss":
+		return "dsa"
+	}
+	return ""
+}
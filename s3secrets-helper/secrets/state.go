@@ -0,0 +1,47 @@
+package secrets
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// StateStore records a hash of each secret applied, so that changes can be
+// detected across runs, e.g. by a long-running agent; see OnSecretChanged.
+type StateStore interface {
+	// Get returns the hash last recorded for key, if any.
+	Get(ctx context.Context, key string) (hash string, ok bool, err error)
+	Put(ctx context.Context, key, hash string) error
+}
+
+// trackChange records the hash of r in the StateStore, calling
+// OnSecretChanged if it differs from the hash previously recorded. Failures
+// are warnings; change detection never prevents a secret being applied.
+func trackChange(ctx context.Context, conf Config, category string, r getResult) {
+	if conf.StateStore == nil {
+		return
+	}
+	sum := sha256.Sum256(r.data)
+	hash := hex.EncodeToString(sum[:])
+	id := r.bucket + "/" + r.key
+
+	prev, ok, err := conf.StateStore.Get(ctx, id)
+	if err != nil {
+		conf.log.Warn(fmt.Sprintf("Failed to get state of %s: %v", id, err), bucketField(r.bucket), keyField(r.key), errField(err))
+		return
+	}
+	if ok && prev == hash {
+		return
+	}
+	// nothing is applied in a DryRun, so the recorded state mustn't change.
+	if !conf.DryRun {
+		if err := conf.StateStore.Put(ctx, id, hash); err != nil {
+			conf.log.Warn(fmt.Sprintf("Failed to record state of %s: %v", id, err), bucketField(r.bucket), keyField(r.key), errField(err))
+		}
+	}
+	if ok && conf.OnSecretChanged != nil {
+		conf.log.Info(fmt.Sprintf("%s has changed since it was last applied", id), typeField(category), bucketField(r.bucket), keyField(r.key))
+		conf.OnSecretChanged(category, r.key)
+	}
+}
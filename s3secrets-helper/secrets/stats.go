@@ -0,0 +1,100 @@
+package secrets
+
+import (
+	"sync/atomic"
+)
+
+// Stats counts downloads by type of secret, cumulatively across every Run
+// it's passed to, e.g. to be exported as Prometheus counters; see
+// Config.Stats. Its counters are updated atomically, so they must be read
+// with Load.
+type Stats struct {
+	SSHKey         TypeStats
+	Env            TypeStats
+	GitCredentials TypeStats
+	Fanout         TypeStats
+	KnownHosts     TypeStats
+	GPGKey         TypeStats
+	DockerConfig   TypeStats
+	NPMRC          TypeStats
+	Kubeconfig     TypeStats
+	Netrc          TypeStats
+}
+
+// TypeStats counts downloads of a type of secret.
+type TypeStats struct {
+	// Attempted is the number of downloads attempted, which is the sum of
+	// Hits, Misses and Errors.
+	Attempted int64
+
+	// Hits is the number of keys found, and Bytes their total size.
+	Hits  int64
+	Bytes int64
+
+	// Misses is the number of keys that weren't found, or were forbidden,
+	// which S3 reports instead if the bucket can't be listed.
+	Misses int64
+
+	// Errors is the number of downloads that failed otherwise.
+	Errors int64
+}
+
+// ForType returns the counters for secretType (e.g. CategorySSHKey), or nil
+// if it isn't one.
+func (s *Stats) ForType(secretType string) *TypeStats {
+	switch secretType {
+	case CategorySSHKey:
+		return &s.SSHKey
+	case CategoryEnv:
+		return &s.Env
+	case CategoryGitCredentials:
+		return &s.GitCredentials
+	case CategoryFanout:
+		return &s.Fanout
+	case CategoryKnownHosts:
+		return &s.KnownHosts
+	case CategoryGPGKey:
+		return &s.GPGKey
+	case CategoryDockerConfig:
+		return &s.DockerConfig
+	case CategoryNPMRC:
+		return &s.NPMRC
+	case CategoryKubeconfig:
+		return &s.Kubeconfig
+	case CategoryNetrc:
+		return &s.Netrc
+	}
+	return nil
+}
+
+// Load returns a copy of t's counters, each read atomically.
+func (t *TypeStats) Load() TypeStats {
+	return TypeStats{
+		Attempted: atomic.LoadInt64(&t.Attempted),
+		Hits:      atomic.LoadInt64(&t.Hits),
+		Bytes:     atomic.LoadInt64(&t.Bytes),
+		Misses:    atomic.LoadInt64(&t.Misses),
+		Errors:    atomic.LoadInt64(&t.Errors),
+	}
+}
+
+// observe counts a download of secretType; s may be nil.
+func (s *Stats) observe(secretType string, bytes int, err error) {
+	if s == nil {
+		return
+	}
+	t := s.ForType(secretType)
+	if t == nil {
+		return
+	}
+	atomic.AddInt64(&t.Attempted, 1)
+	switch {
+	case err == nil:
+		atomic.AddInt64(&t.Hits, 1)
+		atomic.AddInt64(&t.Bytes, int64(bytes))
+	case absent(err):
+		atomic.AddInt64(&t.Misses, 1)
+	default:
+		atomic.AddInt64(&t.Errors, 1)
+	}
+}
@@ -0,0 +1,71 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sentinel"
+)
+
+// VersionGetter is an optional Client capability to get a particular version
+// of an object, with its metadata; see Config.PinnedVersions.
+type VersionGetter interface {
+	GetVersion(ctx context.Context, key, versionID string) ([]byte, map[string]string, error)
+}
+
+// metaVersionID is the metadata of an object in a versioned bucket naming
+// the version got.
+const metaVersionID = "x-amz-version-id"
+
+// versionClient gets the pinned versions of keys, and logs the version of
+// each object got.
+type versionClient struct {
+	Client
+	pinned map[string]string
+	log    Logger
+}
+
+func (c *versionClient) Get(ctx context.Context, key string) ([]byte, error) {
+	data, _, err := c.GetWithMetadata(ctx, key)
+	return data, err
+}
+
+func (c *versionClient) GetWithMetadata(ctx context.Context, key string) ([]byte, map[string]string, error) {
+	versionID, pinned := c.pinned[key]
+	var data []byte
+	var meta map[string]string
+	var err error
+	if pinned {
+		data, meta, err = c.Client.(VersionGetter).GetVersion(ctx, key, versionID)
+	} else {
+		data, meta, err = getWithMetadata(ctx, c.Client, key)
+	}
+	switch {
+	case pinned && errors.Is(err, sentinel.ErrNotFound):
+		c.log.Warn(
+			fmt.Sprintf("Pinned version %s of %s/%s not found", versionID, c.Bucket(), key),
+			bucketField(c.Bucket()), keyField(key), Field{"version_id", versionID},
+		)
+	case err == nil && meta[metaVersionID] != "" && meta[metaVersionID] != "null":
+		c.log.Info(
+			fmt.Sprintf("Got %s/%s version %s", c.Bucket(), key, meta[metaVersionID]),
+			bucketField(c.Bucket()), keyField(key), Field{"version_id", meta[metaVersionID]}, Field{"pinned", pinned},
+		)
+	}
+	return data, meta, err
+}
+
+// checkVersionGetters returns an error if versions are pinned but any of
+// clients can't get them.
+func checkVersionGetters(conf Config, clients []Client) error {
+	if len(conf.PinnedVersions) == 0 {
+		return nil
+	}
+	for _, c := range clients {
+		if _, ok := c.(VersionGetter); !ok {
+			return errors.New("PinnedVersions requires a Client that can get object versions")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+// Package secretsmanager gets secrets from AWS Secrets Manager, as an
+// alternative to S3. Secrets are named like S3 keys, within a namespace which
+// stands in for the bucket, e.g. "buildkite/my-pipeline/env".
+package secretsmanager
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sentinel"
+)
+
+const envDefaultRegion = "AWS_DEFAULT_REGION"
+
+type Client struct {
+	namespace string
+	region    string
+	sm        *secretsmanager.SecretsManager
+}
+
+// Config configures the Secrets Manager endpoint and HTTP client. The zero
+// value uses AWS Secrets Manager in the current region with the default
+// credentials.
+type Config struct {
+	// Endpoint overrides the Secrets Manager endpoint URL.
+	Endpoint string
+
+	// HTTPClient, if set, makes every request; see s3.Config.HTTPClient.
+	HTTPClient *http.Client
+}
+
+// New returns a Client for the secrets within namespace.
+func New(log *log.Logger, namespace string, conf Config) (*Client, error) {
+	sess, err := session.NewSession(&aws.Config{HTTPClient: conf.HTTPClient})
+	if err != nil {
+		return nil, err
+	}
+
+	region := os.Getenv(envDefaultRegion)
+	if region == "" {
+		region, _ = ec2metadata.New(sess).Region()
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	log.Printf("Discovered current region as %q\n", region)
+
+	awsConf := &aws.Config{Region: aws.String(region)}
+	if conf.Endpoint != "" {
+		log.Printf("Using Secrets Manager endpoint %q\n", conf.Endpoint)
+		awsConf.Endpoint = aws.String(conf.Endpoint)
+	}
+	return &Client{
+		namespace: namespace,
+		region:    region,
+		sm:        secretsmanager.New(sess, awsConf),
+	}, nil
+}
+
+// Bucket returns the namespace, which stands in for a bucket.
+func (c *Client) Bucket() string {
+	return c.namespace
+}
+
+// Region is the region secrets are got from.
+func (c *Client) Region() string {
+	return c.region
+}
+
+// Credentials returns nil, meaning the default credentials.
+func (c *Client) Credentials() *credentials.Credentials {
+	return nil
+}
+
+// BucketExists is always true, as a namespace is only a prefix of the names
+// of secrets.
+func (c *Client) BucketExists() (bool, error) {
+	return true, nil
+}
+
+// Get gets the value of the secret named key within the namespace, whether
+// it's a string or binary. sentinel.ErrNotFound and sentinel.ErrForbidden are
+// returned for those cases. Errors worth retrying match
+// sentinel.ErrTransient; they aren't retried. Other errors are returned
+// verbatim.
+func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
+	out, err := c.sm.GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(c.namespace + "/" + key),
+	}, withoutRetries)
+	if err != nil {
+		return nil, classify(err)
+	}
+	if out.SecretBinary != nil {
+		return out.SecretBinary, nil
+	}
+	return []byte(aws.StringValue(out.SecretString)), nil
+}
+
+// withoutRetries disables the SDK's retries, for requests retried by the
+// caller on sentinel.ErrTransient.
+func withoutRetries(r *request.Request) {
+	r.Retryer = client.NoOpRetryer{}
+}
+
+// transientError is an error which errors.Is sentinel.ErrTransient.
+type transientError struct {
+	error
+}
+
+func (e transientError) Is(target error) bool {
+	return target == sentinel.ErrTransient
+}
+
+func (e transientError) Unwrap() error {
+	return e.error
+}
+
+// classify maps errors meaning a secret isn't there, or can't be seen, to
+// sentinel.ErrNotFound and sentinel.ErrForbidden, and wraps errors worth
+// retrying so they match sentinel.ErrTransient. Other errors are returned
+// verbatim.
+func classify(err error) error {
+	if request.IsErrorRetryable(err) || request.IsErrorThrottle(err) {
+		return transientError{err}
+	}
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return err
+	}
+	switch aerr.Code() {
+	case secretsmanager.ErrCodeResourceNotFoundException:
+		return sentinel.ErrNotFound
+	case "AccessDeniedException":
+		return sentinel.ErrForbidden
+	case request.CanceledErrorCode:
+		if aerr.OrigErr() == context.DeadlineExceeded {
+			return transientError{err}
+		}
+	}
+	return err
+}
@@ -0,0 +1,107 @@
+package secretsmanager
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sentinel"
+)
+
+// testClient returns a Client for namespace "buildkite" on a server with the
+// given secrets, and a function to clean up after it. Secrets are strings,
+// except "buildkite/binary".
+func testClient(t *testing.T, secrets map[string]string) (*Client, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var in struct{ SecretId string }
+		if target := r.Header.Get("X-Amz-Target"); target != "secretsmanager.GetSecretValue" {
+			t.Errorf("unexpected request %q", target)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			t.Error(err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		value, ok := secrets[in.SecretId]
+		switch {
+		case in.SecretId == "buildkite/forbidden":
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"__type": "AccessDeniedException", "message": "denied"})
+		case !ok:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"__type": "ResourceNotFoundException", "message": "not found"})
+		case in.SecretId == "buildkite/binary":
+			json.NewEncoder(w).Encode(map[string]string{"Name": in.SecretId, "SecretBinary": base64.StdEncoding.EncodeToString([]byte(value))})
+		default:
+			json.NewEncoder(w).Encode(map[string]string{"Name": in.SecretId, "SecretString": value})
+		}
+	}))
+	env := map[string]string{
+		envDefaultRegion:        "ap-southeast-2",
+		"AWS_ACCESS_KEY_ID":     "AKIAEXAMPLE",
+		"AWS_SECRET_ACCESS_KEY": "example",
+	}
+	restore := make(map[string]string, len(env))
+	for name, value := range env {
+		restore[name] = os.Getenv(name)
+		os.Setenv(name, value)
+	}
+	cleanup := func() {
+		server.Close()
+		for name, value := range restore {
+			os.Setenv(name, value)
+		}
+	}
+
+	c, err := New(log.New(ioutil.Discard, "", 0), "buildkite", Config{Endpoint: server.URL})
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return c, cleanup
+}
+
+func TestGet(t *testing.T) {
+	c, cleanup := testClient(t, map[string]string{
+		"buildkite/pipeline/env": "A=one\n",
+		"buildkite/binary":       "\x00\x01",
+	})
+	defer cleanup()
+
+	for key, expected := range map[string]string{
+		"pipeline/env": "A=one\n",
+		"binary":       "\x00\x01",
+	} {
+		data, err := c.Get(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Errorf("%s: expected %q, got %q", key, expected, data)
+		}
+	}
+	if c.Bucket() != "buildkite" || c.Region() != "ap-southeast-2" {
+		t.Errorf("expected namespace buildkite in ap-southeast-2, got %q in %q", c.Bucket(), c.Region())
+	}
+}
+
+func TestGetErrors(t *testing.T) {
+	c, cleanup := testClient(t, nil)
+	defer cleanup()
+
+	for key, expected := range map[string]error{
+		"missing":   sentinel.ErrNotFound,
+		"forbidden": sentinel.ErrForbidden,
+	} {
+		if _, err := c.Get(context.Background(), key); !errors.Is(err, expected) {
+			t.Errorf("%s: expected %v, got %v", key, expected, err)
+		}
+	}
+}
@@ -6,8 +6,15 @@ import "errors"
 
 var (
 	// ErrNotFound indicates something was not found
-	ErrNotFound = errors.New("Forbidden")
+	ErrNotFound = errors.New("NotFound")
 
 	// ErrForbidden indicates something was forbidden
-	ErrForbidden = errors.New("NotFound")
+	ErrForbidden = errors.New("Forbidden")
+
+	// ErrTransient indicates a failure which may not recur if retried, e.g.
+	// throttling or a server error; errors are matched with errors.Is
+	ErrTransient = errors.New("Transient")
+
+	// ErrTooLarge indicates an object larger than is allowed
+	ErrTooLarge = errors.New("TooLarge")
 )
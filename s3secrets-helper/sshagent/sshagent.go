@@ -2,13 +2,23 @@ package sshagent
 
 import (
 	"bytes"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
 	"errors"
 	"fmt"
 	"io"
+	"math/big"
+	"net"
 	"os"
 	"os/exec"
 	"regexp"
 	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 const (
@@ -73,11 +83,38 @@ func (a *Agent) Run() (bool, error) {
 
 // Add wraps `ssh-agent add`
 func (a *Agent) Add(key []byte) error {
+	return a.AddFromReader(bytes.NewReader(key))
+}
+
+// AddFromReader wraps `ssh-agent add`, streaming the key from r to its stdin.
+func (a *Agent) AddFromReader(r io.Reader) error {
+	return a.add(r, 0, false)
+}
+
+// AddEncrypted adds a key encrypted with passphrase. The key is decrypted
+// in-process and added over the agent protocol, so that the passphrase is
+// never given to another process.
+func (a *Agent) AddEncrypted(key, passphrase []byte) error {
+	return a.AddConstrained(key, passphrase, 0, false)
+}
+
+// AddConstrained wraps `ssh-agent add -t lifetime`, and `-c` if confirm is
+// set, so that the agent forgets the key after lifetime, or requires each use
+// of it to be confirmed. passphrase is nil unless the key is encrypted, in
+// which case it's added as by AddEncrypted.
+func (a *Agent) AddConstrained(key, passphrase []byte, lifetime time.Duration, confirm bool) error {
+	if passphrase != nil {
+		return a.addDecrypted(key, passphrase, lifetime, confirm)
+	}
+	return a.add(bytes.NewReader(key), lifetime, confirm)
+}
+
+func (a *Agent) add(r io.Reader, lifetime time.Duration, confirm bool) error {
 	if a.pid == 0 || a.sock == "" {
 		return errors.New("Agent must Run() before Add()")
 	}
-	cmd := exec.Command("ssh-add", "-")
-	cmd.Stdin = bytes.NewReader(key)
+	cmd := exec.Command("ssh-add", addArgs(lifetime, confirm)...)
+	cmd.Stdin = r
 	cmd.Env = []string{
 		"SSH_AGENT_PID=" + strconv.Itoa(a.pid),
 		"SSH_AUTH_SOCK=" + a.sock,
@@ -86,6 +123,76 @@ func (a *Agent) Add(key []byte) error {
 	return cmd.Run()
 }
 
+// addDecrypted decrypts key with passphrase, and adds it over the agent
+// protocol.
+func (a *Agent) addDecrypted(key, passphrase []byte, lifetime time.Duration, confirm bool) error {
+	if a.pid == 0 || a.sock == "" {
+		return errors.New("Agent must Run() before Add()")
+	}
+	raw, err := ssh.ParseRawPrivateKeyWithPassphrase(key, passphrase)
+	if err != nil {
+		return fmt.Errorf("decrypting key: %w", err)
+	}
+	defer zeroKey(raw)
+	conn, err := net.Dial("unix", a.sock)
+	if err != nil {
+		return fmt.Errorf("connecting to ssh-agent: %w", err)
+	}
+	defer conn.Close()
+	return agent.NewClient(conn).Add(agent.AddedKey{
+		PrivateKey:       raw,
+		LifetimeSecs:     uint32(lifetimeSecs(lifetime)),
+		ConfirmBeforeUse: confirm,
+	})
+}
+
+// zeroKey zeroes the private parts of a key parsed by ssh.ParseRawPrivateKey,
+// as far as they can be.
+func zeroKey(key interface{}) {
+	var ints []*big.Int
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		ints = append([]*big.Int{k.D, k.Precomputed.Dp, k.Precomputed.Dq, k.Precomputed.Qinv}, k.Primes...)
+	case *ecdsa.PrivateKey:
+		ints = []*big.Int{k.D}
+	case *dsa.PrivateKey:
+		ints = []*big.Int{k.X}
+	case *ed25519.PrivateKey:
+		zeroKey(*k)
+	case ed25519.PrivateKey:
+		for i := range k {
+			k[i] = 0
+		}
+	}
+	for _, n := range ints {
+		if n == nil {
+			continue
+		}
+		words := n.Bits()
+		for i := range words {
+			words[i] = 0
+		}
+	}
+}
+
+// addArgs returns the arguments to ssh-add to add a key from stdin with a
+// lifetime, if it's not zero, rounded up to whole seconds.
+func addArgs(lifetime time.Duration, confirm bool) []string {
+	var args []string
+	if lifetime > 0 {
+		args = append(args, "-t", strconv.FormatInt(lifetimeSecs(lifetime), 10))
+	}
+	if confirm {
+		args = append(args, "-c")
+	}
+	return append(args, "-")
+}
+
+// lifetimeSecs returns lifetime rounded up to whole seconds.
+func lifetimeSecs(lifetime time.Duration) int64 {
+	return int64((lifetime + time.Second - 1) / time.Second)
+}
+
 // Pid is the process ID of the ssh-agent, either found in existing
 // environment, or started by us.
 func (a *Agent) Pid() int {
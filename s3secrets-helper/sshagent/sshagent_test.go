@@ -1,6 +1,22 @@
 package sshagent
 
-import "testing"
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
 
 func TestParseOutputSock(t *testing.T) {
 	out := `SSH_AUTH_SOCK=/path/to/socket; export SSH_AUTH_SOCK;
@@ -29,3 +45,79 @@ echo Agent pid 42
 		t.Errorf("pid expected %d, got %d", expected, actual)
 	}
 }
+
+func TestAddArgs(t *testing.T) {
+	for _, tc := range []struct {
+		lifetime time.Duration
+		confirm  bool
+		expected []string
+	}{
+		{0, false, []string{"-"}},
+		{time.Hour, false, []string{"-t", "3600", "-"}},
+		{1500 * time.Millisecond, true, []string{"-t", "2", "-c", "-"}},
+		{0, true, []string{"-c", "-"}},
+	} {
+		if actual := addArgs(tc.lifetime, tc.confirm); !reflect.DeepEqual(tc.expected, actual) {
+			t.Errorf("lifetime %v, confirm %v: expected %q, got %q", tc.lifetime, tc.confirm, tc.expected, actual)
+		}
+	}
+}
+
+func TestAddEncrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshagent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	keyring := agent.NewKeyring()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key), []byte("hunter2"), x509.PEMCipherAES128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := pem.EncodeToMemory(block)
+
+	a := &Agent{pid: 42, sock: sock}
+	if err := a.AddEncrypted(encrypted, []byte("wrong")); err == nil {
+		t.Error("expected the wrong passphrase to fail")
+	}
+	if err := a.AddConstrained(encrypted, []byte("hunter2"), 1500*time.Millisecond, false); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := keyring.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("expected 1 key to be added, got %d", len(keys))
+	}
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pub.Marshal(), keys[0].Marshal()) {
+		t.Errorf("expected the key to be added, got %s", keys[0])
+	}
+}
@@ -0,0 +1,58 @@
+// Package ssm gets parameters from AWS SSM Parameter Store, for env secrets
+// kept there rather than in S3.
+package ssm
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+type Client struct {
+	ssm *ssm.SSM
+}
+
+// New returns a Client using Parameter Store in region, with creds, or the
+// default credentials if that's nil.
+func New(region string, creds *credentials.Credentials) (*Client, error) {
+	sess, err := session.NewSession(&aws.Config{Region: &region, Credentials: creds})
+	if err != nil {
+		return nil, err
+	}
+	return &Client{ssm: ssm.New(sess)}, nil
+}
+
+// GetParametersByPath returns the decrypted values of the parameters directly
+// under path, by their full names.
+func (c *Client) GetParametersByPath(ctx context.Context, path string) (map[string]string, error) {
+	params := map[string]string{}
+	err := c.ssm.GetParametersByPathPagesWithContext(ctx, &ssm.GetParametersByPathInput{
+		Path:           aws.String(path),
+		Recursive:      aws.Bool(false),
+		WithDecryption: aws.Bool(true),
+	}, func(out *ssm.GetParametersByPathOutput, last bool) bool {
+		for _, p := range out.Parameters {
+			params[aws.StringValue(p.Name)] = aws.StringValue(p.Value)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+// GetParameter returns the decrypted value of the parameter name.
+func (c *Client) GetParameter(ctx context.Context, name string) (string, error) {
+	out, err := c.ssm.GetParameterWithContext(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.Parameter.Value), nil
+}